@@ -21,11 +21,13 @@ package inject
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"reflect"
 	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/ghodss/yaml"
@@ -147,6 +149,22 @@ type Params struct {
 	// redirect outbound traffic to Envoy for these IP
 	// ranges. Otherwise all outbound traffic is redirected to Envoy.
 	IncludeIPRanges string `json:"includeIPRanges"`
+	// ProxyLogLevel sets the log level of Envoy, the agent default if empty.
+	ProxyLogLevel string `json:"proxyLogLevel"`
+	// UserVolumes are added to the pod, and UserVolumeMounts to the
+	// proxy container, e.g. to provide extra configuration or certificates.
+	UserVolumes      []v1.Volume      `json:"userVolumes,omitempty"`
+	UserVolumeMounts []v1.VolumeMount `json:"userVolumeMounts,omitempty"`
+	// HoldApplicationUntilProxyStarts starts the proxy before the other
+	// containers of the pod, which only start once Envoy is ready. It
+	// requires DebugMode as the hook waiting for Envoy runs the shell and
+	// curl of the debug proxy image.
+	HoldApplicationUntilProxyStarts bool `json:"holdApplicationUntilProxyStarts,omitempty"`
+	// ProxyResources sets the compute resources of the proxy container if not nil.
+	ProxyResources *v1.ResourceRequirements `json:"proxyResources,omitempty"`
+	// ProxyImagePullPolicy overrides ImagePullPolicy for the proxy container,
+	// e.g. Always to pull a freshly pushed proxy image with the same tag.
+	ProxyImagePullPolicy string `json:"proxyImagePullPolicy,omitempty"`
 }
 
 // Config specifies the initializer configuration for sidecar
@@ -167,6 +185,23 @@ type Config struct {
 
 	// InitializerName specifies the name of the initializer.
 	InitializerName string `json:"initializerName"`
+
+	// Template optionally replaces the built-in sidecar. It is rendered
+	// with the Params and must produce the initContainers, containers
+	// and volumes added to the pod spec.
+	Template string `json:"template,omitempty"`
+}
+
+// sidecarTemplateData is the output of a sidecar template
+type sidecarTemplateData struct {
+	InitContainers []v1.Container `json:"initContainers"`
+	Containers     []v1.Container `json:"containers"`
+	Volumes        []v1.Volume    `json:"volumes"`
+}
+
+// ParseTemplate parses a sidecar template.
+func ParseTemplate(sidecarTemplate string) (*template.Template, error) {
+	return template.New("sidecar").Parse(sidecarTemplate)
 }
 
 // GetInitializerConfig fetches the initializer configuration from a Kubernetes ConfigMap.
@@ -322,6 +357,18 @@ func timeString(dur *duration.Duration) string {
 	return out.String()
 }
 
+// toPullPolicy returns the pull policy of the name, IfNotPresent if unknown
+func toPullPolicy(policy string) v1.PullPolicy {
+	switch policy {
+	case "Always":
+		return v1.PullAlways
+	case "Never":
+		return v1.PullNever
+	default:
+		return v1.PullIfNotPresent
+	}
+}
+
 func injectIntoSpec(p *Params, spec *v1.PodSpec, metadata *metav1.ObjectMeta) {
 	// proxy initContainer 1.6 spec
 	initArgs := []string{
@@ -332,16 +379,10 @@ func injectIntoSpec(p *Params, spec *v1.PodSpec, metadata *metav1.ObjectMeta) {
 		initArgs = append(initArgs, "-i", p.IncludeIPRanges)
 	}
 
-	var pullPolicy v1.PullPolicy
-	switch p.ImagePullPolicy {
-	case "Always":
-		pullPolicy = v1.PullAlways
-	case "IfNotPresent":
-		pullPolicy = v1.PullIfNotPresent
-	case "Never":
-		pullPolicy = v1.PullNever
-	default:
-		pullPolicy = v1.PullIfNotPresent
+	pullPolicy := toPullPolicy(p.ImagePullPolicy)
+	proxyPullPolicy := pullPolicy
+	if p.ProxyImagePullPolicy != "" {
+		proxyPullPolicy = toPullPolicy(p.ProxyImagePullPolicy)
 	}
 
 	privTrue := true
@@ -409,6 +450,9 @@ func injectIntoSpec(p *Params, spec *v1.PodSpec, metadata *metav1.ObjectMeta) {
 	args = append(args, "--statsdUdpAddress", p.Mesh.DefaultConfig.StatsdUdpAddress)
 	args = append(args, "--proxyAdminPort", fmt.Sprintf("%d", p.Mesh.DefaultConfig.ProxyAdminPort))
 	args = append(args, "--controlPlaneAuthPolicy", p.Mesh.DefaultConfig.ControlPlaneAuthPolicy.String())
+	if p.ProxyLogLevel != "" {
+		args = append(args, "--proxyLogLevel", p.ProxyLogLevel)
+	}
 
 	volumeMounts := []v1.VolumeMount{
 		{
@@ -447,6 +491,9 @@ func injectIntoSpec(p *Params, spec *v1.PodSpec, metadata *metav1.ObjectMeta) {
 		},
 	})
 
+	spec.Volumes = append(spec.Volumes, p.UserVolumes...)
+	volumeMounts = append(volumeMounts, p.UserVolumeMounts...)
+
 	// In debug mode we need to be able to write in the proxy container
 	// and change the iptables.
 	readOnly := !p.DebugMode
@@ -478,7 +525,7 @@ func injectIntoSpec(p *Params, spec *v1.PodSpec, metadata *metav1.ObjectMeta) {
 				},
 			},
 		}},
-		ImagePullPolicy: pullPolicy,
+		ImagePullPolicy: proxyPullPolicy,
 		SecurityContext: &v1.SecurityContext{
 			RunAsUser:              &p.SidecarProxyUID,
 			ReadOnlyRootFilesystem: &readOnly,
@@ -486,11 +533,85 @@ func injectIntoSpec(p *Params, spec *v1.PodSpec, metadata *metav1.ObjectMeta) {
 		},
 		VolumeMounts: volumeMounts,
 	}
+	if p.ProxyResources != nil {
+		sidecar.Resources = *p.ProxyResources
+	}
+
+	if p.HoldApplicationUntilProxyStarts {
+		// the kubelet starts the containers in order and waits for the
+		// post start hook of a container before starting the next one.
+		// Envoy lists no listener until it applied the first LDS response.
+		sidecar.Lifecycle = &v1.Lifecycle{
+			PostStart: &v1.Handler{
+				Exec: &v1.ExecAction{
+					Command: []string{"/bin/sh", "-c", fmt.Sprintf(
+						"until curl -fs http://127.0.0.1:%d/listeners | grep -q :; do sleep 1; done",
+						p.Mesh.DefaultConfig.ProxyAdminPort)},
+				},
+			},
+		}
+		spec.Containers = append([]v1.Container{sidecar}, spec.Containers...)
+		return
+	}
 
 	spec.Containers = append(spec.Containers, sidecar)
 }
 
+// templateIgnoredParams returns the names of the params set in p that only the
+// built-in sidecar honors, a template has to render them itself.
+func templateIgnoredParams(p *Params) []string {
+	var ignored []string
+	if p.ProxyLogLevel != "" {
+		ignored = append(ignored, "proxyLogLevel")
+	}
+	if len(p.UserVolumes) > 0 {
+		ignored = append(ignored, "userVolumes")
+	}
+	if len(p.UserVolumeMounts) > 0 {
+		ignored = append(ignored, "userVolumeMounts")
+	}
+	if p.HoldApplicationUntilProxyStarts {
+		ignored = append(ignored, "holdApplicationUntilProxyStarts")
+	}
+	if p.ProxyResources != nil {
+		ignored = append(ignored, "proxyResources")
+	}
+	if p.ProxyImagePullPolicy != "" {
+		ignored = append(ignored, "proxyImagePullPolicy")
+	}
+	return ignored
+}
+
+// injectTemplateIntoSpec adds the sidecar rendered from the template to the pod spec.
+func injectTemplateIntoSpec(sidecarTemplate string, p *Params, spec *v1.PodSpec) error {
+	if ignored := templateIgnoredParams(p); len(ignored) > 0 {
+		return fmt.Errorf("sidecar template does not support %s", strings.Join(ignored, ", "))
+	}
+
+	tmpl, err := ParseTemplate(sidecarTemplate)
+	if err != nil {
+		return err
+	}
+	var rendered bytes.Buffer
+	if err = tmpl.Execute(&rendered, p); err != nil {
+		return err
+	}
+	var sidecar sidecarTemplateData
+	if err = yaml.Unmarshal(rendered.Bytes(), &sidecar); err != nil {
+		return fmt.Errorf("invalid sidecar template output: %v", err)
+	}
+
+	spec.InitContainers = append(spec.InitContainers, sidecar.InitContainers...)
+	spec.Containers = append(spec.Containers, sidecar.Containers...)
+	spec.Volumes = append(spec.Volumes, sidecar.Volumes...)
+	return nil
+}
+
 func intoObject(c *Config, in runtime.Object) (interface{}, error) {
+	if c.Params.HoldApplicationUntilProxyStarts && !c.Params.DebugMode {
+		return nil, fmt.Errorf("holdApplicationUntilProxyStarts requires debugMode")
+	}
+
 	obj, err := meta.Accessor(in)
 	if err != nil {
 		return nil, err
@@ -544,7 +665,13 @@ func intoObject(c *Config, in runtime.Object) (interface{}, error) {
 		m.Annotations[istioSidecarAnnotationStatusKey] = "injected-version-" + c.Params.Version
 	}
 
-	injectIntoSpec(&c.Params, templatePodSpec, templateObjectMeta)
+	if c.Template != "" {
+		if err = injectTemplateIntoSpec(c.Template, &c.Params, templatePodSpec); err != nil {
+			return nil, err
+		}
+	} else {
+		injectIntoSpec(&c.Params, templatePodSpec, templateObjectMeta)
+	}
 
 	return out, nil
 }
@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/ghodss/yaml"
@@ -224,6 +225,140 @@ func TestIntoResourceFile(t *testing.T) {
 	}
 }
 
+func TestProxyImagePullPolicy(t *testing.T) {
+	mesh := model.DefaultMeshConfig()
+	for _, c := range []struct {
+		policy, proxyPolicy string
+		wantInit, wantProxy v1.PullPolicy
+	}{
+		{"IfNotPresent", "", v1.PullIfNotPresent, v1.PullIfNotPresent},
+		{"Never", "", v1.PullNever, v1.PullNever},
+		{"IfNotPresent", "Always", v1.PullIfNotPresent, v1.PullAlways},
+		{"Always", "Never", v1.PullAlways, v1.PullNever},
+	} {
+		p := &Params{
+			InitImage:            InitImageName(unitTestHub, unitTestTag, false),
+			ProxyImage:           ProxyImageName(unitTestHub, unitTestTag, false),
+			ImagePullPolicy:      c.policy,
+			ProxyImagePullPolicy: c.proxyPolicy,
+			SidecarProxyUID:      DefaultSidecarProxyUID,
+			Mesh:                 &mesh,
+		}
+		spec := &v1.PodSpec{Containers: []v1.Container{{Name: "app", ImagePullPolicy: v1.PullNever}}}
+		injectIntoSpec(p, spec, &metav1.ObjectMeta{})
+
+		if len(spec.Containers) != 2 || spec.Containers[1].Name != ProxyContainerName {
+			t.Fatalf("unexpected containers %v", spec.Containers)
+		}
+		if got := spec.Containers[1].ImagePullPolicy; got != c.wantProxy {
+			t.Errorf("%s/%s: got proxy pull policy %s, want %s", c.policy, c.proxyPolicy, got, c.wantProxy)
+		}
+		if got := spec.InitContainers[0].ImagePullPolicy; got != c.wantInit {
+			t.Errorf("%s/%s: got init pull policy %s, want %s", c.policy, c.proxyPolicy, got, c.wantInit)
+		}
+		if got := spec.Containers[0].ImagePullPolicy; got != v1.PullNever {
+			t.Errorf("%s/%s: the pull policy of the app changed to %s", c.policy, c.proxyPolicy, got)
+		}
+	}
+}
+
+func TestHoldApplicationUntilProxyStarts(t *testing.T) {
+	mesh := model.DefaultMeshConfig()
+	config := &Config{
+		Policy:            InjectionPolicyEnabled,
+		IncludeNamespaces: []string{v1.NamespaceAll},
+		Params: Params{
+			InitImage:                       InitImageName(unitTestHub, unitTestTag, false),
+			ProxyImage:                      ProxyImageName(unitTestHub, unitTestTag, false),
+			SidecarProxyUID:                 DefaultSidecarProxyUID,
+			Mesh:                            &mesh,
+			HoldApplicationUntilProxyStarts: true,
+		},
+	}
+
+	in, err := os.Open("testdata/hello.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = in.Close() }()
+	var got bytes.Buffer
+	if err = IntoResourceFile(config, in, &got); err == nil {
+		t.Error("expected an error without the shell and curl of the debug image")
+	}
+
+	config.Params.DebugMode = true
+	spec := &v1.PodSpec{Containers: []v1.Container{{Name: "app"}}}
+	injectIntoSpec(&config.Params, spec, &metav1.ObjectMeta{})
+	if len(spec.Containers) != 2 || spec.Containers[0].Name != ProxyContainerName {
+		t.Fatalf("proxy is not the first container: %v", spec.Containers)
+	}
+	lifecycle := spec.Containers[0].Lifecycle
+	if lifecycle == nil || lifecycle.PostStart == nil || lifecycle.PostStart.Exec == nil ||
+		!strings.Contains(strings.Join(lifecycle.PostStart.Exec.Command, " "), "http://127.0.0.1:15000/listeners") {
+		t.Errorf("proxy is missing the post start hook waiting for the listeners: %v", lifecycle)
+	}
+}
+
+const testSidecarTemplate = `initContainers:
+- name: istio-init
+  image: {{.InitImage}}
+containers:
+- name: istio-proxy
+  image: {{.ProxyImage}}
+  args: ["proxy", "sidecar", "--experimental"]
+volumes:
+- name: istio-envoy
+  emptyDir:
+    medium: Memory
+`
+
+func TestInjectTemplateIntoSpec(t *testing.T) {
+	p := &Params{
+		InitImage:  InitImageName(unitTestHub, unitTestTag, false),
+		ProxyImage: ProxyImageName(unitTestHub, unitTestTag, false),
+	}
+	spec := &v1.PodSpec{Containers: []v1.Container{{Name: "app"}}}
+	if err := injectTemplateIntoSpec(testSidecarTemplate, p, spec); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(spec.InitContainers) != 1 || spec.InitContainers[0].Image != p.InitImage {
+		t.Errorf("unexpected init containers %v", spec.InitContainers)
+	}
+	if len(spec.Containers) != 2 || spec.Containers[0].Name != "app" || spec.Containers[1].Image != p.ProxyImage {
+		t.Errorf("unexpected containers %v", spec.Containers)
+	}
+	if want := []string{"proxy", "sidecar", "--experimental"}; !reflect.DeepEqual(spec.Containers[1].Args, want) {
+		t.Errorf("got proxy args %v, want %v", spec.Containers[1].Args, want)
+	}
+	if len(spec.Volumes) != 1 || spec.Volumes[0].EmptyDir == nil {
+		t.Errorf("unexpected volumes %v", spec.Volumes)
+	}
+
+	for _, invalid := range []string{"{{.InitImage", "{{.Missing}}", "containers: {{.ProxyImage}}"} {
+		if err := injectTemplateIntoSpec(invalid, p, &v1.PodSpec{}); err == nil {
+			t.Errorf("expected an error for template %q", invalid)
+		}
+	}
+
+	// the params honored only by the built-in sidecar are rejected
+	for name, set := range map[string]func(*Params){
+		"proxyLogLevel":                   func(p *Params) { p.ProxyLogLevel = "debug" },
+		"userVolumes":                     func(p *Params) { p.UserVolumes = []v1.Volume{{Name: "extra"}} },
+		"userVolumeMounts":                func(p *Params) { p.UserVolumeMounts = []v1.VolumeMount{{Name: "extra"}} },
+		"holdApplicationUntilProxyStarts": func(p *Params) { p.HoldApplicationUntilProxyStarts = true },
+		"proxyResources":                  func(p *Params) { p.ProxyResources = &v1.ResourceRequirements{} },
+		"proxyImagePullPolicy":            func(p *Params) { p.ProxyImagePullPolicy = "Always" },
+	} {
+		params := *p
+		set(&params)
+		err := injectTemplateIntoSpec(testSidecarTemplate, &params, &v1.PodSpec{})
+		if err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("%s: expected an error for a param ignored by the template, got %v", name, err)
+		}
+	}
+}
+
 func TestInjectRequired(t *testing.T) {
 	cases := []struct {
 		policy InjectionPolicy
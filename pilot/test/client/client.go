@@ -19,6 +19,7 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -43,9 +44,14 @@ var (
 	url       string
 	headerKey string
 	headerVal string
+	token     string
 	msg       string
 
 	caFile string
+
+	// client certificate presented in TLS handshakes
+	certFile string
+	keyFile  string
 )
 
 const (
@@ -58,10 +64,26 @@ func init() {
 	flag.StringVar(&url, "url", "", "Specify URL")
 	flag.StringVar(&headerKey, "key", "", "Header key (use Host for authority)")
 	flag.StringVar(&headerVal, "val", "", "Header value")
+	flag.StringVar(&token, "token", "", "Bearer token sent in the Authorization header")
 	flag.StringVar(&caFile, "ca", "/cert.crt", "CA root cert file")
+	flag.StringVar(&certFile, "cert", "", "Client cert file presented in TLS handshakes (empty for none)")
+	// -key is the header key
+	flag.StringVar(&keyFile, "cert-key", "", "Key file of the client cert")
 	flag.StringVar(&msg, "msg", "HelloWorld", "message to send (for websockets)")
 }
 
+// clientCertificates returns the client certificate presented in TLS handshakes, if any
+func clientCertificates() []tls.Certificate {
+	if certFile == "" && keyFile == "" {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		log.Fatalf("failed to load the client cert %s %v", certFile, err)
+	}
+	return []tls.Certificate{cert}
+}
+
 func makeHTTPRequest(client *http.Client) func(int) func() error {
 	return func(i int) func() error {
 		return func() error {
@@ -78,13 +100,24 @@ func makeHTTPRequest(client *http.Client) func(int) func() error {
 				req.Header.Add(headerKey, headerVal)
 				log.Printf("[%d] Header=%s:%s\n", i, headerKey, headerVal)
 			}
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
 
+			start := time.Now()
 			resp, err := client.Do(req)
 			if err != nil {
+				if strings.Contains(err.Error(), "tls:") {
+					log.Printf("[%d] TLSHandshake=failed\n", i)
+				}
 				return err
 			}
 
+			if resp.TLS != nil {
+				log.Printf("[%d] TLSHandshake=ok\n", i)
+			}
 			log.Printf("[%d] StatusCode=%d\n", i, resp.StatusCode)
+			log.Printf("[%d] Latency=%v\n", i, time.Since(start))
 
 			data, err := ioutil.ReadAll(resp.Body)
 			defer func() {
@@ -180,12 +213,15 @@ func makeGRPCRequest(client pb.EchoTestServiceClient) func(int) func() error {
 
 func main() {
 	flag.Parse()
+	certs := clientCertificates()
+
 	var f func(int) func() error
 	if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
 		/* #nosec */
 		client := &http.Client{
 			Transport: &http.Transport{
 				TLSClientConfig: &tls.Config{
+					Certificates:       certs,
 					InsecureSkipVerify: true,
 				},
 			},
@@ -210,11 +246,19 @@ func main() {
 		// transport security
 		security := grpc.WithInsecure()
 		if secure {
-			creds, err := credentials.NewClientTLSFromFile(caFile, authority)
+			ca, err := ioutil.ReadFile(caFile)
 			if err != nil {
 				log.Fatalf("failed to load client certs %s %v", caFile, err)
 			}
-			security = grpc.WithTransportCredentials(creds)
+			roots := x509.NewCertPool()
+			if !roots.AppendCertsFromPEM(ca) {
+				log.Fatalf("failed to load client certs %s", caFile)
+			}
+			security = grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+				ServerName:   authority,
+				RootCAs:      roots,
+				Certificates: certs,
+			}))
 		}
 
 		conn, err := grpc.Dial(address,
@@ -236,6 +280,7 @@ func main() {
 		/* #nosec */
 		client := &websocket.Dialer{
 			TLSClientConfig: &tls.Config{
+				Certificates:       certs,
 				InsecureSkipVerify: true,
 			},
 			HandshakeTimeout: timeout,
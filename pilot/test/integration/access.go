@@ -113,5 +113,5 @@ func (a *accessLogs) check(infra *infra) error {
 			}
 		})(app)
 	}
-	return parallel(funcs)
+	return infra.parallel(funcs)
 }
@@ -65,5 +65,5 @@ func (r *authExclusion) makeRequests() error {
 			}
 		}
 	}
-	return parallel(funcs)
+	return r.parallel(funcs)
 }
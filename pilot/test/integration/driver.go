@@ -17,23 +17,26 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
 	"text/template"
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
+	"github.com/ghodss/yaml"
 	"github.com/golang/glog"
 	// TODO(nmittler): Remove this
 	_ "github.com/golang/glog"
 	"github.com/golang/sync/errgroup"
 	multierror "github.com/hashicorp/go-multierror"
+	apiextensionsclient "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
 	"k8s.io/client-go/kubernetes"
 
 	meshconfig "istio.io/api/mesh/v1alpha1"
@@ -55,8 +58,15 @@ var (
 	// The particular test to run, e.g. "HTTP reachability" or "routing rules"
 	testType string
 
+	// wait for the developer after each deploy step of the setup
+	pauseAfterStep bool
+
 	kubeconfig string
 	client     kubernetes.Interface
+	crdClient  apiextensionsclient.Interface
+
+	// comma separated kube config files of the remote clusters
+	remoteKubeconfigs string
 )
 
 const (
@@ -68,25 +78,39 @@ const (
 
 	pilotConfigFile     = "/etc/istio/proxy/envoy_pilot.json"
 	pilotConfigAuthFile = "/etc/istio/proxy/envoy_pilot_auth.json"
+
+	// templates are resolved relative to the repository root
+	testDataDir = "pilot/test/integration/testdata/"
 )
 
 func init() {
 	flag.StringVar(&params.Hub, "hub", "gcr.io/istio-testing", "Docker hub")
 	flag.StringVar(&params.Tag, "tag", "", "Docker tag")
+	flag.StringVar(&params.AppHub, "app-hub", "", "Docker hub of the test app image, the Docker hub if empty")
+	flag.StringVar(&params.AppTag, "app-tag", "", "Docker tag of the test app image, the Docker tag if empty")
+	flag.StringVar(&params.ImagePullPolicy, "image-pull-policy", "",
+		"Image pull policy of the app and Istio containers: Always, IfNotPresent or Never (empty for IfNotPresent)")
+	flag.StringVar(&params.ProxyImagePullPolicy, "proxy-image-pull-policy", "",
+		"Image pull policy of the injected proxies, e.g. Always to pull a pushed proxy image (empty for -image-pull-policy)")
 	flag.StringVar(&params.IstioNamespace, "ns", "",
 		"Namespace in which to install Istio components (empty to create/delete temporary one)")
 	flag.StringVar(&params.Namespace, "n", "",
 		"Namespace in which to install the applications (empty to create/delete temporary one)")
+	flag.StringVar(&params.RunID, "run-id", "",
+		"Suffix of the cluster-scoped resources to run in a cluster shared with other runs (empty to generate one)")
 	flag.StringVar(&params.Registry, "registry", string(platform.KubernetesRegistry), "Pilot registry")
 	flag.BoolVar(&verbose, "verbose", false, "Debug level noise from proxies")
 	flag.BoolVar(&params.checkLogs, "logs", true, "Validate pod logs (expensive in long-running tests)")
 
 	flag.StringVar(&kubeconfig, "kubeconfig", os.Getenv("KUBECONFIG"),
 		"kube config file (missing or empty file makes the test use in-cluster kube config instead)")
+	flag.StringVar(&remoteKubeconfigs, "remote-kubeconfigs", "",
+		"Comma separated kube config files of the remote clusters for multi-cluster tests")
 	flag.IntVar(&count, "count", 1, "Number of times to run the tests after deploying")
 	flag.StringVar(&authmode, "auth", "both", "Enable / disable auth, or test both.")
 	flag.BoolVar(&params.Mixer, "mixer", true, "Enable / disable mixer.")
 	flag.StringVar(&params.errorLogsDir, "errorlogsdir", "", "Store per pod logs as individual files in specific directory instead of writing to stderr.")
+	flag.StringVar(&params.metricsDir, "metricsdir", "", "Export the collected metrics as JSON files in specific directory for CI dashboards.")
 
 	// If specified, only run one test
 	flag.StringVar(&testType, "testtype", "", "Select test to run (default is all tests)")
@@ -94,6 +118,8 @@ func init() {
 	// Keep disabled until default no-op initializer is distributed
 	// and running in test clusters.
 	flag.BoolVar(&params.UseInitializer, "use-initializer", false, "Use k8s sidecar initializer")
+	flag.StringVar(&params.InjectTemplateOverride, "inject-template", "",
+		"Sidecar template file replacing the built-in sidecar of the injection")
 	flag.BoolVar(&params.UseAdmissionWebhook, "use-admission-webhook", false,
 		"Use k8s external admission webhook for config validation")
 
@@ -101,10 +127,16 @@ func init() {
 		"Name of admission webhook service name")
 
 	flag.IntVar(&params.DebugPort, "debugport", 0, "Debugging port")
+	flag.IntVar(&params.AdminPort, "admin-port", 15000, "Envoy admin port of the sidecars, as in the injection template")
 
 	flag.BoolVar(&params.debugImagesAndMode, "debug", true, "Use debug images and mode (false for prod)")
 	flag.BoolVar(&params.SkipCleanup, "skip-cleanup", false, "Debug, skip clean up")
 	flag.BoolVar(&params.SkipCleanupOnFailure, "skip-cleanup-on-failure", false, "Debug, skip clean up on failure")
+	flag.BoolVar(&pauseAfterStep, "pause-after-step", false, "Debug, wait for Enter after each deploy step of the setup")
+	flag.BoolVar(&params.restartProxiesOnReset, "restart-proxies-on-reset", false,
+		"Debug, restart the app pods on reset to clear the state cached by the proxies")
+	flag.BoolVar(&params.SkipControlPlane, "skip-control-plane", false,
+		"Use the control plane installed in the Istio namespace (-ns) instead of deploying one")
 }
 
 type test interface {
@@ -130,6 +162,12 @@ func main() {
 	}
 
 	params.Name = "(default infra)"
+	if pauseAfterStep {
+		params.PauseAfterStep = waitForEnter
+	}
+	if remoteKubeconfigs != "" {
+		params.RemoteKubeconfigs = strings.Split(remoteKubeconfigs, ",")
+	}
 	params.Auth = meshconfig.MeshConfig_NONE
 	params.Ingress = true
 	params.Zipkin = true
@@ -146,12 +184,16 @@ func main() {
 		kubeconfig = "pilot/platform/kube/config"
 		glog.Info("Using linked in kube config. Set KUBECONFIG env before running the test.")
 	}
-	var err error
-	_, client, err = kube.CreateInterface(kubeconfig)
+	config, kubeClient, err := kube.CreateInterface(kubeconfig)
 	if err != nil {
 		log.Errora(err)
 		os.Exit(-1)
 	}
+	client = kubeClient
+	if crdClient, err = apiextensionsclient.NewForConfig(config); err != nil {
+		log.Errora(err)
+		os.Exit(-1)
+	}
 
 	switch authmode {
 	case "enable":
@@ -188,15 +230,25 @@ func tlogFatal(header, s string) {
 	os.Exit(-1)
 }
 
+// waitForEnter pauses until the developer presses Enter
+func waitForEnter(step string) error {
+	fmt.Printf("Deployed %s, press Enter to continue\n", step)
+	_, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	return err
+}
+
 func runTests(envs ...infra) {
 	var result error
 	for _, istio := range envs {
 		var errs error
 		tlog("Deploying infrastructure", spew.Sdump(istio))
+		start := time.Now()
 		if err := istio.setup(); err != nil {
 			result = multierror.Append(result, err)
 			continue
 		}
+		istio.recordSetupDuration("setup", time.Since(start))
+		appsStart := time.Now()
 		if err := istio.deployApps(); err != nil {
 			result = multierror.Append(result, err)
 			continue
@@ -208,6 +260,10 @@ func runTests(envs ...infra) {
 			result = multierror.Append(result, errs)
 			break
 		}
+		istio.recordSetupDuration("apps", time.Since(appsStart))
+		if err := istio.recordReadiness(); err != nil {
+			log.Infof("Failed to record the readiness of the apps: %v", err)
+		}
 
 		tests := []test{
 			&http{infra: &istio},
@@ -222,6 +278,14 @@ func runTests(envs ...infra) {
 			&authExclusion{infra: &istio},
 		}
 
+		tlog("Running smoke test", istio.Name)
+		if err := istio.smokeTest(); err != nil {
+			tlogError("Smoke test failed", err.Error())
+			errs = multierror.Append(errs, err)
+			// the mesh is broken, skip the tests
+			tests = nil
+		}
+
 		for _, test := range tests {
 			// If the user has specified a test, skip all other tests
 			if len(testType) > 0 && testType != test.String() {
@@ -248,6 +312,9 @@ func runTests(envs ...infra) {
 
 		// spill all logs on error
 		if errs != nil {
+			if err := istio.collectControlPlaneLogs(); err != nil {
+				log.Errorf("Failed to collect the control plane logs: %v", err)
+			}
 			for _, pod := range util.GetPods(client, istio.Namespace) {
 				var filename, content string
 				if strings.HasPrefix(pod, "istio-pilot") {
@@ -279,6 +346,13 @@ func runTests(envs ...infra) {
 			}
 		}
 
+		if len(istio.metricsDir) > 0 {
+			path := istio.metricsDir + "/" + metricsFileName(istio.Name)
+			if err := istio.exportMetrics(path); err != nil {
+				log.Errorf("Failed to export the metrics to %s: %v", path, err)
+			}
+		}
+
 		cleanup := !istio.SkipCleanup
 
 		if errs == nil {
@@ -305,12 +379,60 @@ func runTests(envs ...infra) {
 	}
 }
 
+// templateFuncs are the helpers available to the templates, named as in sprig
+var templateFuncs = template.FuncMap{
+	"default": templateDefault,
+	"indent":  templateIndent,
+	"toYaml":  templateToYAML,
+	"quote":   templateQuote,
+}
+
+// templateDefault returns the value or the default if the value is empty,
+// e.g. {{default "istio" .name}}
+func templateDefault(def, value interface{}) interface{} {
+	if value == nil {
+		return def
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		if v.Len() == 0 {
+			return def
+		}
+	default:
+		if reflect.DeepEqual(value, reflect.Zero(v.Type()).Interface()) {
+			return def
+		}
+	}
+	return value
+}
+
+// templateIndent indents every line of the text by the number of spaces
+func templateIndent(spaces int, text string) string {
+	pad := strings.Repeat(" ", spaces)
+	return pad + strings.Replace(text, "\n", "\n"+pad, -1)
+}
+
+// templateToYAML encodes the value as YAML without the trailing newline
+func templateToYAML(value interface{}) (string, error) {
+	out, err := yaml.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+// templateQuote returns the value as a double-quoted string
+func templateQuote(value interface{}) string {
+	return strconv.Quote(fmt.Sprint(value))
+}
+
 // fill a file based on a template
 func fill(inFile string, values interface{}) (string, error) {
 	var bytes bytes.Buffer
 	w := bufio.NewWriter(&bytes)
 
-	tmpl, err := template.ParseFiles("pilot/test/integration/testdata/" + inFile)
+	tmpl, err := template.New(filepath.Base(inFile)).Funcs(templateFuncs).ParseFiles(testDataDir + inFile)
 	if err != nil {
 		return "", err
 	}
@@ -332,9 +454,10 @@ var (
 	errAgain status = errors.New("try again")
 )
 
-// run in parallel with retries. all funcs must succeed for the function to succeed
-func parallel(fs map[string]func() status) error {
-	g, ctx := errgroup.WithContext(context.Background())
+// run in parallel with retries. all funcs must succeed for the function to succeed.
+// The retries stop when the harness context is cancelled.
+func (infra *infra) parallel(fs map[string]func() status) error {
+	g, ctx := errgroup.WithContext(infra.context())
 	repeat := func(name string, f func() status) func() error {
 		return func() error {
 			for n := 0; n < budget; n++ {
@@ -353,7 +476,8 @@ func parallel(fs map[string]func() status) error {
 				case <-time.After(time.Second):
 					// try again
 				case <-ctx.Done():
-					return nil
+					// the error of the failed func or of the harness is returned by Wait
+					return ctx.Err()
 				}
 			}
 			return fmt.Errorf("failed all %d attempts for %s", budget, name)
@@ -365,8 +489,9 @@ func parallel(fs map[string]func() status) error {
 	return g.Wait()
 }
 
-// repeat a check up to budget until it does not return an error
-func repeat(f func() error, budget int, delay time.Duration) error {
+// repeat a check up to budget until it does not return an error or the harness
+// context is cancelled
+func (infra *infra) repeat(f func() error, budget int, delay time.Duration) error {
 	var errs error
 	for i := 0; i < budget; i++ {
 		err := f()
@@ -375,7 +500,9 @@ func repeat(f func() error, budget int, delay time.Duration) error {
 		}
 		errs = multierror.Append(errs, multierror.Prefix(err, fmt.Sprintf("attempt %d", i)))
 		log.Infof("attempt #%d failed with %v", i, err)
-		time.Sleep(delay)
+		if err = infra.sleep(delay); err != nil {
+			return multierror.Append(errs, err)
+		}
 	}
 	return errs
 }
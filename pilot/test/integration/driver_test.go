@@ -0,0 +1,123 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"istio.io/istio/pilot/test/util"
+)
+
+var updateGolden = flag.Bool("update", false, "Update the golden files of the rendered templates")
+
+func TestMain(m *testing.M) {
+	// templates are resolved relative to the repository root
+	if _, err := os.Stat(testDataDir); os.IsNotExist(err) {
+		if err = os.Chdir("../../.."); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(-1)
+		}
+	}
+
+	// do not wait for config propagation in unit tests
+	configPropagationDelay = 0
+	pollInterval = time.Millisecond
+	kubectlBackoff = time.Millisecond
+
+	os.Exit(m.Run())
+}
+
+// assertRenderedGolden fills the template and compares the output to the golden
+// file, which is rewritten instead with -update or REFRESH_GOLDEN=true
+func assertRenderedGolden(t *testing.T, templateName string, data interface{}, goldenPath string) {
+	t.Helper()
+	rendered, err := fill(templateName, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *updateGolden {
+		t.Logf("Updating golden file %s", goldenPath)
+		if err = ioutil.WriteFile(goldenPath, []byte(rendered), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	util.CompareContent([]byte(rendered), goldenPath, t)
+}
+
+func TestFillTemplateFuncs(t *testing.T) {
+	data := map[string]interface{}{
+		"labels": map[string]string{"app": "a", "version": "v1"},
+		"config": "mesh:\n  enableTracing: true",
+	}
+	want := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: istio-funcs
+  labels:
+    app: a
+    version: v1
+data:
+  port: "8080"
+  config: |-
+    mesh:
+      enableTracing: true
+`
+	got, err := fill("template-funcs.yaml.tmpl", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	data["name"], data["port"] = "custom", 9090
+	if got, err = fill("template-funcs.yaml.tmpl", data); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"  name: custom\n", `  port: "9090"` + "\n"} {
+		if !strings.Contains(got, line) {
+			t.Errorf("rendered template is missing %q:\n%s", line, got)
+		}
+	}
+}
+
+func TestAppTemplateGolden(t *testing.T) {
+	assertRenderedGolden(t, "app.yaml.tmpl", map[string]string{
+		"Hub":            "gcr.io/istio-testing",
+		"Tag":            "test",
+		"service":        "a",
+		"perServiceAuth": "false",
+		"deployment":     "a-v1",
+		"port1":          "8080",
+		"port2":          "80",
+		"port3":          "9090",
+		"port4":          "90",
+		"port5":          "7070",
+		"port6":          "70",
+		"version":        "v1",
+		"istioNamespace": "istio-system",
+		"injectProxy":    "true",
+		"healthPort":     "true",
+		"livenessPath":   defaultLivenessPath,
+		"probePort":      "3333",
+	}, testDataDir+"app.yaml.golden")
+}
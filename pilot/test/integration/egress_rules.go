@@ -104,7 +104,7 @@ func (t *egressRules) run() error {
 			return err
 		}
 
-		if err := repeat(cs.check, 3, time.Second); err != nil {
+		if err := t.repeat(cs.check, 3, time.Second); err != nil {
 			log.Infof("Failed the test with %v", err)
 			errs = multierror.Append(errs, multierror.Prefix(err, cs.description))
 		} else {
@@ -143,5 +143,5 @@ func (t *egressRules) verifyReachable(url string, shouldBeReachable bool) error
 		})(src)
 	}
 
-	return parallel(funcs)
+	return t.parallel(funcs)
 }
@@ -101,5 +101,5 @@ func (t *grpc) makeRequests() error {
 			}
 		}
 	}
-	return parallel(funcs)
+	return t.parallel(funcs)
 }
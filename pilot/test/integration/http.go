@@ -118,5 +118,5 @@ func (r *http) makeRequests() error {
 			}
 		}
 	}
-	return parallel(funcs)
+	return r.parallel(funcs)
 }
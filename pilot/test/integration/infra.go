@@ -16,29 +16,45 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"math/big"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
+	"github.com/ghodss/yaml"
+	multierror "github.com/hashicorp/go-multierror"
 	"k8s.io/api/core/v1"
+	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
 
 	meshconfig "istio.io/api/mesh/v1alpha1"
+	routingv2 "istio.io/api/routing/v1alpha2"
 	"istio.io/istio/pilot/adapter/config/crd"
 	"istio.io/istio/pilot/model"
 	"istio.io/istio/pilot/platform"
+	"istio.io/istio/pilot/platform/kube"
 	"istio.io/istio/pilot/platform/kube/inject"
 	"istio.io/istio/pilot/test/util"
 	"istio.io/istio/pkg/log"
@@ -46,6 +62,20 @@ import (
 
 const (
 	ingressSecretName = "istio-ingress-certs"
+
+	// caRootSecretName is the secret of the custom CA root mounted by ca.yaml.tmpl
+	caRootSecretName = "istio-ca-root"
+)
+
+var (
+	// configPropagationDelay is the time given to config changes to reach the proxies
+	configPropagationDelay = 3 * time.Second
+
+	// routeTimeout is the time given to a route change to reach the proxies
+	routeTimeout = time.Minute
+
+	// crdEstablishedTimeout is the time given to the API server to serve the config CRDs
+	crdEstablishedTimeout = time.Minute
 )
 
 type infra struct { // nolint: maligned
@@ -54,25 +84,53 @@ type infra struct { // nolint: maligned
 	// docker tags
 	Hub, Tag string
 
+	// AppHub and AppTag of the test app image, Hub and Tag if empty
+	AppHub, AppTag string
+
+	// ImagePullPolicy of the app and Istio containers, the templates default to IfNotPresent
+	ImagePullPolicy string
+	// ProxyImagePullPolicy of the injected proxies, ImagePullPolicy if empty
+	ProxyImagePullPolicy string
+
 	Namespace      string
 	IstioNamespace string
 	Registry       string
 	Verbosity      int
 
+	// RunID is appended to the names of the cluster-scoped resources, e.g. the
+	// ClusterRoleBindings, so that independent runs can share a cluster. The
+	// setup generates one if empty.
+	RunID string
+
 	// map from app to pods
 	apps map[string][]string
 
+	// customApps are deployed along with the default apps, see addApp
+	customApps []appDefinition
+
 	Auth                   meshconfig.MeshConfig_AuthPolicy
 	ControlPlaneAuthPolicy meshconfig.AuthenticationPolicy
 	MixerCustomConfigFile  string
 	PilotCustomConfigFile  string
 
+	// AdminPort is the port of the Envoy admin interface used by the proxy
+	// inspection utilities, 15000 if zero. It has to match the injection template.
+	AdminPort int
+
 	// switches for infrastructure components
 	Mixer     bool
 	Ingress   bool
 	Zipkin    bool
 	DebugPort int
 
+	// SkipControlPlane uses the control plane already installed in IstioNamespace
+	// instead of deploying one
+	SkipControlPlane bool
+
+	// PauseAfterStep is called with the template name after each deploy step of
+	// the setup, e.g. to inspect the cluster. An error aborts the setup.
+	PauseAfterStep func(step string) error
+
 	SkipCleanup          bool
 	SkipCleanupOnFailure bool
 
@@ -90,30 +148,187 @@ type infra struct { // nolint: maligned
 	UseInitializer bool
 	InjectConfig   *inject.Config
 
+	// InjectTemplateOverride is the path of a sidecar template replacing the built-in
+	// sidecar, both for the injection of the apps and in the initializer configmap
+	InjectTemplateOverride string
+
+	// InjectionPolicy is the sidecar injection policy of the namespaces, enabled if empty
+	InjectionPolicy inject.InjectionPolicy
+	// NamespaceInjectionPolicies overrides the injection policy per namespace
+	NamespaceInjectionPolicies map[string]inject.InjectionPolicy
+
+	// CustomCARoot signs the workload certificates instead of the self-signed
+	// root of the CA if set
+	CustomCARoot *CARoot
+
 	// External Admission Webhook for validation
 	UseAdmissionWebhook  bool
 	AdmissionServiceName string
 
 	config model.IstioConfigStore
+
+	// ConfigStoreFactory builds the config store, the CRD client if nil
+	ConfigStoreFactory func() (model.IstioConfigStore, error)
+
+	// configs created by the harness keyed by config key, see reset
+	createdConfigs map[string]model.ConfigMeta
+
+	// generations of the configs last applied by the harness keyed by config key
+	configGenerations map[string]int64
+
+	// reset restarts the app pods to clear the state cached by the proxies
+	restartProxiesOnReset bool
+
+	// kube config files of the remote clusters and their clients, indexed by cluster
+	RemoteKubeconfigs []string
+	remoteClients     []kubernetes.Interface
+
+	// ctx is cancelled on teardown to abort all in-flight waits
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// configMutex serializes the config writes of the harness with the ones of
+	// the expiry goroutines, see applyConfigWithTTL. It is created by setup, behind
+	// a pointer as the driver copies the infra by value.
+	configMutex *sync.Mutex
+
+	// cleanups run on teardown in reverse order of registration
+	cleanups []func() error
+
+	// metrics collected for CI dashboards, see exportMetrics. The mutex is
+	// created by setup like configMutex.
+	metrics      metricsReport
+	metricsMutex *sync.Mutex
+	// metricsDir stores the exported metrics if not empty
+	metricsDir string
+
+	// timings are the durations of the phases of the last setup, see setupTimings
+	timings map[string]time.Duration
+}
+
+// CARoot is a PEM encoded CA certificate and its private key
+type CARoot struct {
+	CertPEM, KeyPEM []byte
+}
+
+// newRunID returns a random run ID usable in resource names
+func newRunID() (string, error) {
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// initConfigStore builds the config store with the factory, defaulting to the
+// CRD client
+func (infra *infra) initConfigStore() error {
+	factory := infra.ConfigStoreFactory
+	if factory == nil {
+		factory = crdConfigStore
+	}
+
+	store, err := factory()
+	if err != nil {
+		return err
+	}
+	infra.config = store
+	return nil
+}
+
+// crdConfigStore returns a config store backed by the CRDs of the cluster
+func crdConfigStore() (model.IstioConfigStore, error) {
+	crdclient, err := crd.NewClient(kubeconfig, model.IstioConfigTypes, "")
+	if err != nil {
+		return nil, err
+	}
+	if err = crdclient.RegisterResources(); err != nil {
+		return nil, err
+	}
+	return model.MakeIstioStore(crdclient), nil
+}
+
+// waitForCRDsEstablished polls the CRDs of the config types until the API server
+// reports them established, so that the first configs written do not fail with
+// "no matches for kind"
+func (infra *infra) waitForCRDsEstablished(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		var pending []string
+		for _, schema := range infra.config.ConfigDescriptor() {
+			name := crd.ResourceName(schema.Plural) + "." + model.IstioAPIGroup
+			established, err := crdEstablished(name)
+			if err != nil {
+				log.Infof("Failed to get CRD %s: %v", name, err)
+			}
+			if !established {
+				pending = append(pending, name)
+			}
+		}
+		if len(pending) == 0 {
+			log.Info("All config CRDs are established")
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %v waiting for CRDs to be established: %s", timeout, strings.Join(pending, ", "))
+		}
+		if err := infra.sleep(pollInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// crdEstablished checks the Established condition of the CRD
+func crdEstablished(name string) (bool, error) {
+	definition, err := crdClient.ApiextensionsV1beta1().CustomResourceDefinitions().Get(name, meta_v1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+	for _, cond := range definition.Status.Conditions {
+		if cond.Type == apiextensionsv1beta1.Established && cond.Status == apiextensionsv1beta1.ConditionTrue {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
 func (infra *infra) setup() error {
-	crdclient, crderr := crd.NewClient(kubeconfig, model.IstioConfigTypes, "")
-	if crderr != nil {
-		return crderr
+	infra.ctx, infra.cancel = context.WithCancel(context.Background())
+	infra.configMutex = &sync.Mutex{}
+	infra.metricsMutex = &sync.Mutex{}
+
+	if infra.RunID == "" {
+		var err error
+		if infra.RunID, err = newRunID(); err != nil {
+			return err
+		}
 	}
-	if err := crdclient.RegisterResources(); err != nil {
+	log.Infof("Using run ID %s", infra.RunID)
+
+	infra.timings = make(map[string]time.Duration)
+	defer infra.logSetupTimings()
+
+	phaseStart := time.Now()
+	if err := infra.initConfigStore(); err != nil {
 		return err
 	}
+	if infra.ConfigStoreFactory == nil {
+		if err := infra.waitForCRDsEstablished(crdEstablishedTimeout); err != nil {
+			return err
+		}
+	}
+	infra.timings["crd"] = time.Since(phaseStart)
 
-	infra.config = model.MakeIstioStore(crdclient)
+	if infra.SkipControlPlane && infra.IstioNamespace == "" {
+		return errors.New("the namespace of the existing control plane is required")
+	}
 
+	phaseStart = time.Now()
 	if infra.Namespace == "" {
-		var err error
-		if infra.Namespace, err = util.CreateNamespaceWithPrefix(client, "istio-test-app-"); err != nil {
+		if err := infra.createAppNamespace(); err != nil {
 			return err
 		}
-		infra.namespaceCreated = true
 	} else {
 		if _, err := client.CoreV1().Namespaces().Get(infra.Namespace, meta_v1.GetOptions{}); err != nil {
 			return err
@@ -132,20 +347,47 @@ func (infra *infra) setup() error {
 		}
 	}
 
+	// remote clusters host apps only, in a namespace named as the local one
+	infra.remoteClients = nil
+	for _, config := range infra.RemoteKubeconfigs {
+		_, remote, err := kube.CreateInterface(config)
+		if err != nil {
+			return fmt.Errorf("cannot create a client for remote cluster %s: %v", config, err)
+		}
+		infra.remoteClients = append(infra.remoteClients, remote)
+		if infra.namespaceCreated {
+			if _, err = remote.CoreV1().Namespaces().Create(&v1.Namespace{
+				ObjectMeta: meta_v1.ObjectMeta{Name: infra.Namespace},
+			}); err != nil {
+				return err
+			}
+		} else if _, err = remote.CoreV1().Namespaces().Get(infra.Namespace, meta_v1.GetOptions{}); err != nil {
+			return err
+		}
+	}
+	infra.timings["namespace"] = time.Since(phaseStart)
+
 	deploy := func(name, namespace string) error {
+		deployStart := time.Now()
 		if yaml, err := fill(name, infra); err != nil {
 			return err
 		} else if err = infra.kubeApply(yaml, namespace); err != nil {
 			return err
 		}
+		infra.timings["deploy "+name] = time.Since(deployStart)
+		if infra.PauseAfterStep != nil {
+			return infra.PauseAfterStep(name)
+		}
 		return nil
 	}
-	if err := deploy("rbac-beta.yaml.tmpl", infra.IstioNamespace); err != nil {
-		return err
-	}
+	if !infra.SkipControlPlane {
+		if err := deploy("rbac-beta.yaml.tmpl", infra.IstioNamespace); err != nil {
+			return err
+		}
 
-	if err := deploy("config.yaml.tmpl", infra.IstioNamespace); err != nil {
-		return err
+		if err := deploy("config.yaml.tmpl", infra.IstioNamespace); err != nil {
+			return err
+		}
 	}
 
 	_, mesh, err := inject.GetMeshConfig(client, infra.IstioNamespace, "istio")
@@ -162,335 +404,2034 @@ func (infra *infra) setup() error {
 		includeNamespaces = []string{infra.Namespace}
 	}
 
+	if err = infra.labelInjectionPolicy(infra.Namespace); err != nil {
+		return err
+	}
+
+	sidecarTemplate, err := infra.injectTemplate()
+	if err != nil {
+		return err
+	}
+
 	infra.InjectConfig = &inject.Config{
-		Policy:            inject.InjectionPolicyEnabled,
+		Policy:            infra.injectionPolicy(infra.Namespace),
 		IncludeNamespaces: includeNamespaces,
+		Template:          sidecarTemplate,
 		Params: inject.Params{
-			InitImage:       inject.InitImageName(infra.Hub, infra.Tag, debugMode),
-			ProxyImage:      inject.ProxyImageName(infra.Hub, infra.Tag, debugMode),
-			Verbosity:       infra.Verbosity,
-			SidecarProxyUID: inject.DefaultSidecarProxyUID,
-			EnableCoreDump:  true,
-			Version:         "integration-test",
-			Mesh:            mesh,
-			DebugMode:       debugMode,
+			InitImage:            inject.InitImageName(infra.Hub, infra.Tag, debugMode),
+			ProxyImage:           inject.ProxyImageName(infra.Hub, infra.Tag, debugMode),
+			ImagePullPolicy:      infra.ImagePullPolicy,
+			ProxyImagePullPolicy: infra.ProxyImagePullPolicy,
+			Verbosity:            infra.Verbosity,
+			SidecarProxyUID:      inject.DefaultSidecarProxyUID,
+			EnableCoreDump:       true,
+			Version:              "integration-test",
+			Mesh:                 mesh,
+			DebugMode:            debugMode,
 		},
 	}
 
-	if infra.UseInitializer {
-		if err := deploy("initializer-config.yaml.tmpl", infra.IstioNamespace); err != nil {
+	if infra.SkipControlPlane {
+		if err = infra.checkControlPlane(); err != nil {
 			return err
 		}
-		if yaml, err := fill("initializer-configmap.yaml.tmpl", &infra.InjectConfig); err != nil {
-			return err
-		} else if err = infra.kubeApply(yaml, infra.IstioNamespace); err != nil {
-			return err
+		return deploy("headless.yaml.tmpl", infra.Namespace)
+	}
+
+	steps, err := topoSortDeploys(infra.controlPlaneSteps(deploy))
+	if err != nil {
+		return err
+	}
+	for _, step := range steps {
+		if !step.enabled {
+			continue
 		}
-		if err := deploy("initializer.yaml.tmpl", infra.IstioNamespace); err != nil {
+		if err = step.deploy(); err != nil {
 			return err
 		}
-		// InitializerConfiguration will block *all* deployments and
-		// could possibly lead to timeouts when trying to create other
-		// Istio runtime components. Wait until it's pod is ready
-		// before proceeding with the test setup.
-		if _, err = util.GetAppPods(client, kubeconfig, []string{infra.IstioNamespace}); err != nil {
-			return fmt.Errorf("initialized failed to start: %v", err)
+	}
+	return nil
+}
+
+// setupTimings returns the durations of the phases of the last setup keyed by
+// phase: "crd", "namespace", "deploy <template>" and "initializer wait"
+func (infra *infra) setupTimings() map[string]time.Duration {
+	out := make(map[string]time.Duration, len(infra.timings))
+	for phase, d := range infra.timings {
+		out[phase] = d
+	}
+	return out
+}
+
+// logSetupTimings logs the durations of the setup phases, longest first
+func (infra *infra) logSetupTimings() {
+	phases := make([]string, 0, len(infra.timings))
+	var total time.Duration
+	for phase, d := range infra.timings {
+		phases = append(phases, phase)
+		total += d
+	}
+	sort.Slice(phases, func(i, j int) bool {
+		if infra.timings[phases[i]] != infra.timings[phases[j]] {
+			return infra.timings[phases[i]] > infra.timings[phases[j]]
 		}
+		return phases[i] < phases[j]
+	})
+	lines := make([]string, 0, len(phases))
+	for _, phase := range phases {
+		lines = append(lines, fmt.Sprintf("  %-40s %v", phase, infra.timings[phase]))
 	}
+	log.Infof("Setup took %v:\n%s", total, strings.Join(lines, "\n"))
+}
 
-	if infra.UseAdmissionWebhook {
-		if err := infra.createAdmissionWebhookSecret(); err != nil {
-			return err
+// deployStep is a component deployed by the setup once the components it
+// depends on are deployed
+type deployStep struct {
+	name string
+	// dependsOn are the names of the steps deployed first, disabled steps count
+	// as deployed
+	dependsOn []string
+	enabled   bool
+	deploy    func() error
+}
+
+// controlPlaneSteps returns the deploy steps of the control plane, deploying the
+// templates with the deploy function of the setup
+func (infra *infra) controlPlaneSteps(deploy func(name, namespace string) error) []deployStep {
+	// the InitializerConfiguration blocks all deployments until the initializer runs
+	return []deployStep{
+		{
+			name:    "initializer",
+			enabled: infra.UseInitializer,
+			deploy: func() error {
+				if err := deploy("initializer-config.yaml.tmpl", infra.IstioNamespace); err != nil {
+					return err
+				}
+				if yaml, err := fill("initializer-configmap.yaml.tmpl", &infra.InjectConfig); err != nil {
+					return err
+				} else if err = infra.kubeApply(yaml, infra.IstioNamespace); err != nil {
+					return err
+				}
+				if err := deploy("initializer.yaml.tmpl", infra.IstioNamespace); err != nil {
+					return err
+				}
+				// InitializerConfiguration will block *all* deployments and
+				// could possibly lead to timeouts when trying to create other
+				// Istio runtime components. Wait until it's pod is ready
+				// before proceeding with the test setup.
+				waitStart := time.Now()
+				if _, err := util.GetAppPods(client, kubeconfig, []string{infra.IstioNamespace}); err != nil {
+					return fmt.Errorf("initialized failed to start: %v", err)
+				}
+				infra.timings["initializer wait"] = time.Since(waitStart)
+				return nil
+			},
+		},
+		{
+			name:    "admission-webhook-secret",
+			enabled: infra.UseAdmissionWebhook,
+			deploy:  infra.createAdmissionWebhookSecret,
+		},
+		{
+			name:      "pilot",
+			dependsOn: []string{"initializer", "admission-webhook-secret"},
+			enabled:   true,
+			deploy: func() error {
+				return deploy("pilot.yaml.tmpl", infra.IstioNamespace)
+			},
+		},
+		{
+			name:      "mixer",
+			dependsOn: []string{"initializer"},
+			enabled:   infra.Mixer,
+			deploy: func() error {
+				if err := deploy("mixer.yaml.tmpl", infra.IstioNamespace); err != nil {
+					return err
+				}
+				return infra.waitForMixer()
+			},
+		},
+		{
+			name:      "eureka",
+			dependsOn: []string{"initializer"},
+			enabled:   platform.ServiceRegistry(infra.Registry) == platform.EurekaRegistry,
+			deploy: func() error {
+				return deploy("eureka.yaml.tmpl", infra.IstioNamespace)
+			},
+		},
+		{
+			name:      "ca",
+			dependsOn: []string{"initializer"},
+			enabled:   true,
+			deploy: func() error {
+				if infra.CustomCARoot != nil {
+					if err := infra.createCARootSecret(); err != nil {
+						return err
+					}
+				}
+				return deploy("ca.yaml.tmpl", infra.IstioNamespace)
+			},
+		},
+		{
+			name:      "headless",
+			dependsOn: []string{"initializer"},
+			enabled:   true,
+			deploy: func() error {
+				return deploy("headless.yaml.tmpl", infra.Namespace)
+			},
+		},
+		{
+			name:      "ingress",
+			dependsOn: []string{"initializer", "pilot"},
+			enabled:   infra.Ingress,
+			deploy: func() error {
+				if err := deploy("ingress-proxy.yaml.tmpl", infra.IstioNamespace); err != nil {
+					return err
+				}
+				// Create ingress key/cert in secret
+				key, err := ioutil.ReadFile("pilot/docker/certs/cert.key")
+				if err != nil {
+					return err
+				}
+				crt, err := ioutil.ReadFile("pilot/docker/certs/cert.crt")
+				if err != nil {
+					return err
+				}
+				_, err = client.CoreV1().Secrets(infra.IstioNamespace).Create(&v1.Secret{
+					ObjectMeta: meta_v1.ObjectMeta{Name: ingressSecretName},
+					Data: map[string][]byte{
+						"tls.key": key,
+						"tls.crt": crt,
+					},
+				})
+				return err
+			},
+		},
+		{
+			name:      "zipkin",
+			dependsOn: []string{"initializer"},
+			enabled:   infra.Zipkin,
+			deploy: func() error {
+				return deploy("zipkin.yaml", infra.IstioNamespace)
+			},
+		},
+	}
+}
+
+// topoSortDeploys orders the deploy steps after the steps they depend on, keeping
+// the declaration order otherwise. Unknown dependencies and cycles are errors.
+func topoSortDeploys(steps []deployStep) ([]deployStep, error) {
+	known := make(map[string]bool, len(steps))
+	for _, step := range steps {
+		if known[step.name] {
+			return nil, fmt.Errorf("duplicate deploy step %s", step.name)
+		}
+		known[step.name] = true
+	}
+	for _, step := range steps {
+		for _, dep := range step.dependsOn {
+			if !known[dep] {
+				return nil, fmt.Errorf("deploy step %s depends on unknown step %s", step.name, dep)
+			}
+		}
+	}
+
+	deployed := make(map[string]bool, len(steps))
+	out := make([]deployStep, 0, len(steps))
+	for len(out) < len(steps) {
+		next := -1
+		for i, step := range steps {
+			if deployed[step.name] {
+				continue
+			}
+			ready := true
+			for _, dep := range step.dependsOn {
+				ready = ready && deployed[dep]
+			}
+			if ready {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			var pending []string
+			for _, step := range steps {
+				if !deployed[step.name] {
+					pending = append(pending, step.name)
+				}
+			}
+			return nil, fmt.Errorf("cyclic dependencies between the deploy steps %v", pending)
 		}
+		deployed[steps[next].name] = true
+		out = append(out, steps[next])
+	}
+	return out, nil
+}
+
+// checkControlPlane validates that the Pilot of the existing control plane serves
+// discovery requests
+func (infra *infra) checkControlPlane() error {
+	out, err := infra.pilotRequest("/v1/registration")
+	if err != nil {
+		return fmt.Errorf("pilot is not reachable in namespace %s: %v", infra.IstioNamespace, err)
+	}
+
+	var services []interface{}
+	if err = json.Unmarshal([]byte(out), &services); err != nil {
+		return fmt.Errorf("pilot in namespace %s returned an invalid registration: %v", infra.IstioNamespace, err)
+	}
+	log.Infof("Using the control plane in namespace %s with %d services", infra.IstioNamespace, len(services))
+	return nil
+}
+
+// injectionLabel is the namespace label recording the injection policy
+const injectionLabel = "istio-injection"
+
+// injectionPolicy returns the sidecar injection policy of the namespace
+func (infra *infra) injectionPolicy(namespace string) inject.InjectionPolicy {
+	if policy, exists := infra.NamespaceInjectionPolicies[namespace]; exists {
+		return policy
 	}
+	if infra.InjectionPolicy == "" {
+		return inject.InjectionPolicyEnabled
+	}
+	return infra.InjectionPolicy
+}
 
-	if err := deploy("pilot.yaml.tmpl", infra.IstioNamespace); err != nil {
+// labelInjectionPolicy labels the namespace with its injection policy
+func (infra *infra) labelInjectionPolicy(namespace string) error {
+	ns, err := client.CoreV1().Namespaces().Get(namespace, meta_v1.GetOptions{})
+	if err != nil {
 		return err
 	}
-	if infra.Mixer {
-		if err := deploy("mixer.yaml.tmpl", infra.IstioNamespace); err != nil {
-			return err
+	if ns.Labels == nil {
+		ns.Labels = make(map[string]string)
+	}
+	ns.Labels[injectionLabel] = string(infra.injectionPolicy(namespace))
+	_, err = client.CoreV1().Namespaces().Update(ns)
+	return err
+}
+
+// appDefinition describes an app deployment known to the harness
+type appDefinition struct {
+	deployment, service         string
+	ports                       [6]int
+	version                     string
+	injectProxy, perServiceAuth bool
+	opts                        appOptions
+}
+
+// defaultApps are a healthy mix of apps, with and without proxy
+var defaultApps = []appDefinition{
+	{"t", "t", [6]int{8080, 80, 9090, 90, 7070, 70}, "unversioned", false, false, appOptions{}},
+	{"a", "a", [6]int{8080, 80, 9090, 90, 7070, 70}, "v1", true, false, appOptions{}},
+	{"b", "b", [6]int{80, 8080, 90, 9090, 70, 7070}, "unversioned", true, false, appOptions{}},
+	{"c-v1", "c", [6]int{80, 8080, 90, 9090, 70, 7070}, "v1", true, false, appOptions{}},
+	{"c-v2", "c", [6]int{80, 8080, 90, 9090, 70, 7070}, "v2", true, false, appOptions{}},
+	{"d", "d", [6]int{80, 8080, 90, 9090, 70, 7070}, "per-svc-auth", true, true, appOptions{}},
+	// Add another service without sidecar to test mTLS blacklisting (as in the e2e test
+	// environment, pilot can see only services in the test namespaces). This service
+	// will be listed in mtlsExcludedServices in the mesh config.
+	{"e", "fake-control", [6]int{80, 8080, 90, 9090, 70, 7070}, "fake-control", false, false, appOptions{}},
+}
+
+// addApp registers a custom app deployed by deployApps and deployAppSet along
+// with the default apps
+func (infra *infra) addApp(app appDefinition) error {
+	for _, known := range infra.appDefinitions() {
+		if known.deployment == app.deployment {
+			return fmt.Errorf("app deployment %q is already defined", app.deployment)
 		}
 	}
-	if platform.ServiceRegistry(infra.Registry) == platform.EurekaRegistry {
-		if err := deploy("eureka.yaml.tmpl", infra.IstioNamespace); err != nil {
+	infra.customApps = append(infra.customApps, app)
+	return nil
+}
+
+// appDefinitions returns the default apps followed by the custom apps
+func (infra *infra) appDefinitions() []appDefinition {
+	apps := make([]appDefinition, 0, len(defaultApps)+len(infra.customApps))
+	apps = append(apps, defaultApps...)
+	return append(apps, infra.customApps...)
+}
+
+// deployApps deploys all the known apps
+func (infra *infra) deployApps() error {
+	var names []string
+	for _, app := range infra.appDefinitions() {
+		names = append(names, app.deployment)
+	}
+	return infra.deployAppSet(names...)
+}
+
+// deployAppSet deploys only the named apps, in the order of their definitions.
+// A name selects the app with the deployment name or all the deployments of
+// the service, e.g. "c" selects both "c-v1" and "c-v2".
+func (infra *infra) deployAppSet(names ...string) error {
+	apps := infra.appDefinitions()
+	selected := make(map[string]bool)
+	for _, name := range names {
+		found := false
+		for _, app := range apps {
+			if app.deployment == name || app.service == name {
+				selected[app.deployment] = true
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown app %q", name)
+		}
+	}
+
+	for _, app := range apps {
+		if !selected[app.deployment] {
+			continue
+		}
+		p := app.ports
+		if err := infra.deployApp(app.deployment, app.service, p[0], p[1], p[2], p[3], p[4], p[5],
+			app.version, app.injectProxy, app.perServiceAuth, app.opts); err != nil {
 			return err
 		}
 	}
+	return nil
+}
 
-	if err := deploy("ca.yaml.tmpl", infra.IstioNamespace); err != nil {
-		return err
+// appOptions holds the optional settings of an app deployment, zero values
+// select the defaults of the app template
+type appOptions struct {
+	// livenessPath is the HTTP path of the liveness probe
+	livenessPath string
+	// readinessPath is the HTTP path of the readiness probe, the readiness
+	// probe checks the TCP health port if empty
+	readinessPath string
+	// probePort is the port serving the liveness and readiness probes
+	probePort int
+	// runAsUser is the UID of the app container, the image default if zero
+	runAsUser int64
+	// dnsNameservers replace the cluster DNS server of the pod if not empty
+	dnsNameservers []string
+	// dnsSearches are appended to the search domains of the pod
+	dnsSearches []string
+	// dnsNdots overrides the ndots resolver option of the pod if not zero
+	dnsNdots int
+	// proxyLogLevel overrides the log level of the injected proxy if not empty
+	proxyLogLevel string
+	// proxyVolumes are added to the pod and mounted into the injected proxy
+	// with proxyVolumeMounts
+	proxyVolumes      []v1.Volume
+	proxyVolumeMounts []v1.VolumeMount
+	// spreadAcrossNodes requires the replicas of the app to run on distinct nodes
+	spreadAcrossNodes bool
+	// topologySpread balances the replicas of the app across the domains of the
+	// topology key if not empty, e.g. topology.kubernetes.io/zone for locality
+	// load balancing tests. It requires the initializer for injected apps.
+	topologySpread string
+	// portNames overrides the names of the service ports, which select their
+	// protocol. An empty name renders a name without protocol prefix, leaving the
+	// protocol to the detection of Pilot.
+	portNames map[int]string
+	// holdApplicationUntilProxyStarts delays the start of the app container
+	// until the injected proxy is ready. It requires the debug images.
+	holdApplicationUntilProxyStarts bool
+	// ports are added to the app service, each named with its protocol
+	ports []appPort
+	// labels are added to the pods of the app, e.g. to match the app as a
+	// source in route rules
+	labels map[string]string
+	// proxyMemoryLimit overrides the memory limit of the injected proxy if not
+	// empty, e.g. "64Mi"
+	proxyMemoryLimit string
+}
+
+// appServicePorts are the ports of the app service
+var appServicePorts = []int{80, 8080, 90, 9090, 70, 7070}
+
+// appPortProtocols are the protocols of the additional app ports
+var appPortProtocols = []string{"http", "http2", "grpc", "tcp", "tls"}
+
+// appPort is an additional port of the app service. The app serves gRPC on the
+// target port of a grpc port and HTTP otherwise.
+type appPort struct {
+	Port int
+	// TargetPort is the port of the app container, Port if zero
+	TargetPort int
+	// Protocol is one of appPortProtocols, selecting the protocol handling of Istio
+	Protocol string
+}
+
+// Name returns the name of the service port prefixed with the protocol
+func (p appPort) Name() string {
+	return fmt.Sprintf("%s-%d", p.Protocol, p.Port)
+}
+
+// validateAppPorts checks the protocols of the additional ports and that
+// the ports do not collide, defaulting the target ports
+func validateAppPorts(ports []appPort) ([]appPort, error) {
+	out := make([]appPort, 0, len(ports))
+	seen := append([]int{}, appServicePorts...)
+	for _, port := range ports {
+		if !containsString(appPortProtocols, port.Protocol) {
+			return nil, fmt.Errorf("unknown protocol %q of port %d, expected one of %v", port.Protocol, port.Port, appPortProtocols)
+		}
+		if port.Port <= 0 || containsInt(seen, port.Port) {
+			return nil, fmt.Errorf("invalid or duplicate service port %d", port.Port)
+		}
+		seen = append(seen, port.Port)
+		if port.TargetPort == 0 {
+			port.TargetPort = port.Port
+		}
+		out = append(out, port)
 	}
-	if err := deploy("headless.yaml.tmpl", infra.Namespace); err != nil {
+	return out, nil
+}
+
+const (
+	defaultLivenessPath = "/healthz"
+	defaultProbePort    = 3333
+)
+
+func (infra *infra) deployApp(deployment, svcName string, port1, port2, port3, port4, port5, port6 int,
+	version string, injectProxy bool, perServiceAuth bool, opts appOptions) error {
+	yaml, err := infra.appYAML(deployment, svcName, port1, port2, port3, port4, port5, port6, version, injectProxy, perServiceAuth, opts)
+	if err != nil {
 		return err
 	}
-	if infra.Ingress {
-		if err := deploy("ingress-proxy.yaml.tmpl", infra.IstioNamespace); err != nil {
+	return infra.kubeApply(yaml, infra.Namespace)
+}
+
+// deployAppPair deploys an app with the proxy, suffixed -mesh, and the same app
+// without the proxy, suffixed -raw, each behind its own service, to compare the
+// latency and throughput of requests through the sidecar with direct requests.
+// Both are deleted on teardown.
+func (infra *infra) deployAppPair(name, svcName string, ports []appPort) error {
+	for _, variant := range []struct {
+		suffix      string
+		injectProxy bool
+	}{{"-mesh", true}, {"-raw", false}} {
+		deployment, service := name+variant.suffix, svcName+variant.suffix
+		yaml, err := infra.appYAML(deployment, service, 8080, 80, 9090, 90, 7070, 70, "v1",
+			variant.injectProxy, false, appOptions{ports: ports})
+		if err != nil {
 			return err
 		}
-		// Create ingress key/cert in secret
-		key, err := ioutil.ReadFile("pilot/docker/certs/cert.key")
-		if err != nil {
+		if err = infra.kubeApply(yaml, infra.Namespace); err != nil {
 			return err
 		}
-		crt, err := ioutil.ReadFile("pilot/docker/certs/cert.crt")
-		if err != nil {
+		infra.deferCleanup(func() error {
+			return infra.kubeDelete(yaml, infra.Namespace)
+		})
+	}
+	return nil
+}
+
+// deployAppRemote deploys the app to the app namespace of a remote cluster
+func (infra *infra) deployAppRemote(cluster int, deployment, svcName string, port1, port2, port3, port4, port5, port6 int,
+	version string, injectProxy bool, perServiceAuth bool, opts appOptions) error {
+	yaml, err := infra.appYAML(deployment, svcName, port1, port2, port3, port4, port5, port6, version, injectProxy, perServiceAuth, opts)
+	if err != nil {
+		return err
+	}
+	return infra.kubeApplyRemote(cluster, yaml, infra.Namespace)
+}
+
+// appHub returns the docker hub of the test app image
+func (infra *infra) appHub() string {
+	if infra.AppHub != "" {
+		return infra.AppHub
+	}
+	return infra.Hub
+}
+
+// appTag returns the docker tag of the test app image
+func (infra *infra) appTag() string {
+	if infra.AppTag != "" {
+		return infra.AppTag
+	}
+	return infra.Tag
+}
+
+// appYAML returns the app deployment with the proxy injected if requested
+func (infra *infra) appYAML(deployment, svcName string, port1, port2, port3, port4, port5, port6 int,
+	version string, injectProxy bool, perServiceAuth bool, opts appOptions) (string, error) {
+	// Eureka does not support management ports
+	healthPort := "true"
+	if platform.ServiceRegistry(infra.Registry) == platform.EurekaRegistry {
+		healthPort = "false"
+	}
+
+	livenessPath := opts.livenessPath
+	if livenessPath == "" {
+		livenessPath = defaultLivenessPath
+	}
+	probePort := opts.probePort
+	if probePort == 0 {
+		probePort = defaultProbePort
+	}
+
+	// traffic of the proxy UID is not captured by the iptables rules
+	runAsUser := ""
+	if opts.runAsUser == inject.DefaultSidecarProxyUID {
+		return "", fmt.Errorf("app %s cannot run as the proxy UID %d", deployment, inject.DefaultSidecarProxyUID)
+	} else if opts.runAsUser != 0 {
+		runAsUser = strconv.FormatInt(opts.runAsUser, 10)
+	}
+
+	if err := validateProxyVolumes(opts.proxyVolumes, opts.proxyVolumeMounts); err != nil {
+		return "", fmt.Errorf("app %s: %v", deployment, err)
+	}
+	if opts.proxyMemoryLimit != "" {
+		if _, err := resource.ParseQuantity(opts.proxyMemoryLimit); err != nil {
+			return "", fmt.Errorf("app %s: invalid proxy memory limit %q: %v", deployment, opts.proxyMemoryLimit, err)
+		}
+	}
+	// kube-inject decodes the deployment into the vendored pod spec, which has
+	// no topologySpreadConstraints, and would silently drop the constraint
+	if opts.topologySpread != "" && injectProxy && !infra.UseInitializer {
+		return "", fmt.Errorf("app %s: the topology spread is not supported with kube-inject", deployment)
+	}
+
+	ports, err := validateAppPorts(opts.ports)
+	if err != nil {
+		return "", fmt.Errorf("app %s: %v", deployment, err)
+	}
+	for key := range opts.labels {
+		if key == "app" || key == "version" {
+			return "", fmt.Errorf("app %s cannot override the label %q", deployment, key)
+		}
+	}
+
+	dnsNdots := ""
+	if opts.dnsNdots != 0 {
+		dnsNdots = strconv.Itoa(opts.dnsNdots)
+	}
+
+	data := map[string]interface{}{
+		"Hub":               infra.appHub(),
+		"Tag":               infra.appTag(),
+		"service":           svcName,
+		"perServiceAuth":    strconv.FormatBool(perServiceAuth),
+		"deployment":        deployment,
+		"port1":             strconv.Itoa(port1),
+		"port2":             strconv.Itoa(port2),
+		"port3":             strconv.Itoa(port3),
+		"port4":             strconv.Itoa(port4),
+		"port5":             strconv.Itoa(port5),
+		"port6":             strconv.Itoa(port6),
+		"version":           version,
+		"istioNamespace":    infra.IstioNamespace,
+		"injectProxy":       strconv.FormatBool(injectProxy),
+		"healthPort":        healthPort,
+		"livenessPath":      livenessPath,
+		"readinessPath":     opts.readinessPath,
+		"probePort":         strconv.Itoa(probePort),
+		"imagePullPolicy":   infra.ImagePullPolicy,
+		"runAsUser":         runAsUser,
+		"dnsNameservers":    opts.dnsNameservers,
+		"dnsSearches":       opts.dnsSearches,
+		"dnsNdots":          dnsNdots,
+		"spreadAcrossNodes": opts.spreadAcrossNodes,
+		"topologySpread":    opts.topologySpread,
+		"ports":             ports,
+		"labels":            opts.labels,
+	}
+	for port, name := range opts.portNames {
+		if !containsInt(appServicePorts, port) {
+			return "", fmt.Errorf("app %s has no service port %d", deployment, port)
+		}
+		if name == "" {
+			name = fmt.Sprintf("port-%d", port)
+		}
+		data[fmt.Sprintf("portName%d", port)] = name
+	}
+
+	w, err := fill("app.yaml.tmpl", data)
+	if err != nil {
+		return "", err
+	}
+
+	writer := new(bytes.Buffer)
+
+	if injectProxy && !infra.UseInitializer {
+		if err := inject.IntoResourceFile(infra.appInjectConfig(opts), strings.NewReader(w), writer); err != nil {
+			return "", err
+		}
+	} else {
+		if _, err := io.Copy(writer, strings.NewReader(w)); err != nil {
+			return "", err
+		}
+	}
+
+	return writer.String(), nil
+}
+
+// injectTemplate returns the content of the sidecar template override, empty if not set
+func (infra *infra) injectTemplate() (string, error) {
+	if infra.InjectTemplateOverride == "" {
+		return "", nil
+	}
+	content, err := ioutil.ReadFile(infra.InjectTemplateOverride)
+	if err != nil {
+		return "", err
+	}
+	if _, err = inject.ParseTemplate(string(content)); err != nil {
+		return "", fmt.Errorf("invalid sidecar template %s: %v", infra.InjectTemplateOverride, err)
+	}
+	if infra.ProxyImagePullPolicy != "" {
+		return "", fmt.Errorf("the sidecar template %s does not support -proxy-image-pull-policy", infra.InjectTemplateOverride)
+	}
+	return string(content), nil
+}
+
+// appInjectConfig returns the injection config with the proxy overrides of the app
+func (infra *infra) appInjectConfig(opts appOptions) *inject.Config {
+	if opts.proxyLogLevel == "" && len(opts.proxyVolumes) == 0 && len(opts.proxyVolumeMounts) == 0 &&
+		!opts.holdApplicationUntilProxyStarts && opts.proxyMemoryLimit == "" {
+		return infra.InjectConfig
+	}
+
+	config := *infra.InjectConfig
+	if opts.proxyLogLevel != "" {
+		config.Params.ProxyLogLevel = opts.proxyLogLevel
+	}
+	if opts.holdApplicationUntilProxyStarts {
+		config.Params.HoldApplicationUntilProxyStarts = true
+	}
+	if opts.proxyMemoryLimit != "" {
+		// the limit is validated by appYAML
+		config.Params.ProxyResources = &v1.ResourceRequirements{
+			Limits: v1.ResourceList{v1.ResourceMemory: resource.MustParse(opts.proxyMemoryLimit)},
+		}
+	}
+	config.Params.UserVolumes = append(append([]v1.Volume{}, config.Params.UserVolumes...), opts.proxyVolumes...)
+	config.Params.UserVolumeMounts = append(append([]v1.VolumeMount{}, config.Params.UserVolumeMounts...), opts.proxyVolumeMounts...)
+	return &config
+}
+
+// injectedProxyVolumes are the names of the volumes added by the injector
+var injectedProxyVolumes = []string{"istio-envoy", "istio-certs"}
+
+// validateProxyVolumes checks that the volume names are unique, do not collide
+// with the volumes of the injector and that the mounts refer to the volumes
+func validateProxyVolumes(volumes []v1.Volume, mounts []v1.VolumeMount) error {
+	names := make(map[string]bool, len(volumes))
+	for _, volume := range volumes {
+		if volume.Name == "" {
+			return errors.New("proxy volume without a name")
+		}
+		if containsString(injectedProxyVolumes, volume.Name) {
+			return fmt.Errorf("proxy volume %s collides with a volume of the injector", volume.Name)
+		}
+		if names[volume.Name] {
+			return fmt.Errorf("duplicate proxy volume %s", volume.Name)
+		}
+		names[volume.Name] = true
+	}
+	for _, mount := range mounts {
+		if !names[mount.Name] {
+			return fmt.Errorf("proxy volume mount %s does not refer to a proxy volume", mount.Name)
+		}
+	}
+	return nil
+}
+
+// deployTCPApp deploys an echo app with the proxy behind a service exposing
+// a single TCP port and waits for its pods to be ready
+func (infra *infra) deployTCPApp(name, svcName string, port, targetPort int) error {
+	w, err := infra.tcpAppYAML(name, svcName, port, targetPort)
+	if err != nil {
+		return err
+	}
+
+	yaml := w
+	if !infra.UseInitializer {
+		writer := new(bytes.Buffer)
+		if err = inject.IntoResourceFile(infra.InjectConfig, strings.NewReader(w), writer); err != nil {
+			return err
+		}
+		yaml = writer.String()
+	}
+	if err = infra.kubeApply(yaml, infra.Namespace); err != nil {
+		return err
+	}
+
+	pods, err := util.GetAppPods(client, kubeconfig, []string{infra.Namespace})
+	if err != nil {
+		return err
+	}
+	infra.apps[svcName] = pods[svcName]
+	return nil
+}
+
+// tcpAppYAML renders the TCP app without the proxy
+func (infra *infra) tcpAppYAML(name, svcName string, port, targetPort int) (string, error) {
+	return fill("tcp-app.yaml.tmpl", map[string]string{
+		"Hub":             infra.appHub(),
+		"Tag":             infra.appTag(),
+		"deployment":      name,
+		"service":         svcName,
+		"port":            strconv.Itoa(port),
+		"targetPort":      strconv.Itoa(targetPort),
+		"imagePullPolicy": infra.ImagePullPolicy,
+	})
+}
+
+// deployRaw fills the template and applies it to the app namespace as is,
+// without injecting the proxy
+func (infra *infra) deployRaw(inFile string, data interface{}) error {
+	yaml, err := fill(inFile, data)
+	if err != nil {
+		return err
+	}
+	return infra.kubeApply(yaml, infra.Namespace)
+}
+
+// deployExternalBackend deploys a plain backend without the proxy and an egress
+// rule declaring the address as a service outside the mesh. The address should
+// resolve to the backend (e.g. its cluster DNS name), so that egress traffic can
+// be tested end-to-end within a single cluster.
+func (infra *infra) deployExternalBackend(name, address string, port int) error {
+	if err := infra.deployRaw("external-backend.yaml.tmpl", map[string]string{
+		"Hub":  infra.appHub(),
+		"Tag":  infra.appTag(),
+		"name": name,
+		"port": strconv.Itoa(port),
+	}); err != nil {
+		return err
+	}
+
+	return infra.applyConfig("egress-rule-external-backend.yaml.tmpl", map[string]string{
+		"name":    name,
+		"address": address,
+		"port":    strconv.Itoa(port),
+	})
+}
+
+func (infra *infra) teardown() {
+	if infra.cancel != nil {
+		infra.cancel()
+	}
+
+	for i := len(infra.cleanups) - 1; i >= 0; i-- {
+		if err := infra.cleanups[i](); err != nil {
+			log.Infof("Cleanup failed: %v", err)
+		}
+	}
+	infra.cleanups = nil
+
+	// the existing control plane is left as is
+	if !infra.SkipControlPlane {
+		if yaml, err := fill("rbac-beta.yaml.tmpl", infra); err != nil {
+			log.Infof("RBAC template could could not be processed, please delete stale ClusterRoleBindings: %v",
+				err)
+		} else if err = infra.kubeDelete(yaml, infra.IstioNamespace); err != nil {
+			log.Infof("RBAC config could could not be deleted: %v", err)
+		}
+	}
+
+	if infra.UseAdmissionWebhook && !infra.SkipControlPlane {
+		if err := infra.deleteAdmissionWebhookSecret(); err != nil {
+			log.Infof("Could not delete admission webhook secret: %v", err)
+		}
+	}
+
+	if infra.namespaceCreated {
+		for _, remote := range infra.remoteClients {
+			util.DeleteNamespace(remote, infra.Namespace)
+		}
+		util.DeleteNamespace(client, infra.Namespace)
+		infra.Namespace = ""
+	}
+	if infra.istioNamespaceCreated {
+		util.DeleteNamespace(client, infra.IstioNamespace)
+		infra.IstioNamespace = ""
+	}
+
+	// InitializerConfiguration is not namespaced.
+	if infra.UseInitializer && !infra.SkipControlPlane {
+		if yaml, err := fill("initializer-config.yaml.tmpl", infra); err != nil {
+			log.Infof("Sidecar initializer configuration could not be processed, "+
+				"please delete stale InitializerConfiguration : %v", err)
+		} else if err := infra.kubeDelete(yaml, infra.IstioNamespace); err != nil {
+			log.Infof("Sidecar initializer configuration could not be deleted: %v", err)
+		}
+	}
+}
+
+// teardownPlan returns the resources that teardown would delete, without deleting
+// anything, so that a teardown on a shared cluster can be reviewed first. The
+// registered cleanups are opaque and only counted.
+func (infra *infra) teardownPlan() ([]string, error) {
+	var plan []string
+	if len(infra.cleanups) > 0 {
+		plan = append(plan, fmt.Sprintf("%d registered cleanups", len(infra.cleanups)))
+	}
+
+	if !infra.SkipControlPlane {
+		resources, err := templateResources("rbac-beta.yaml.tmpl", infra)
+		if err != nil {
+			return nil, err
+		}
+		plan = append(plan, resources...)
+	}
+
+	if infra.UseAdmissionWebhook && !infra.SkipControlPlane {
+		plan = append(plan, fmt.Sprintf("Secret %s/pilot-webhook", infra.IstioNamespace))
+	}
+
+	deleted := make(map[string]bool)
+	if infra.namespaceCreated {
+		deleted[infra.Namespace] = true
+		plan = append(plan, "Namespace "+infra.Namespace)
+		for cluster := range infra.remoteClients {
+			plan = append(plan, fmt.Sprintf("Namespace %s in remote cluster %d", infra.Namespace, cluster))
+		}
+	}
+	if infra.istioNamespaceCreated {
+		deleted[infra.IstioNamespace] = true
+		plan = append(plan, "Namespace "+infra.IstioNamespace)
+	}
+
+	// the configs created by the harness go with their namespace
+	infra.configMutex.Lock()
+	var configs []string
+	for _, meta := range infra.createdConfigs {
+		if deleted[meta.Namespace] {
+			configs = append(configs, fmt.Sprintf("%s %s/%s", meta.Type, meta.Namespace, meta.Name))
+		}
+	}
+	infra.configMutex.Unlock()
+	sort.Strings(configs)
+	plan = append(plan, configs...)
+
+	if infra.UseInitializer && !infra.SkipControlPlane {
+		resources, err := templateResources("initializer-config.yaml.tmpl", infra)
+		if err != nil {
+			return nil, err
+		}
+		plan = append(plan, resources...)
+	}
+	return plan, nil
+}
+
+// templateResources returns the kind and name of the resources of the filled template
+func templateResources(inFile string, values interface{}) ([]string, error) {
+	filled, err := fill(inFile, values)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []string
+	for _, doc := range strings.Split(filled, "\n---") {
+		var resource struct {
+			Kind     string             `json:"kind"`
+			Metadata meta_v1.ObjectMeta `json:"metadata"`
+		}
+		if err = yaml.Unmarshal([]byte(doc), &resource); err != nil {
+			return nil, fmt.Errorf("%s: %v", inFile, err)
+		}
+		if resource.Kind == "" {
+			continue
+		}
+		name := resource.Metadata.Name
+		if resource.Metadata.Namespace != "" {
+			name = resource.Metadata.Namespace + "/" + name
+		}
+		out = append(out, resource.Kind+" "+name)
+	}
+	return out, nil
+}
+
+// createAppNamespace creates the app namespace in the local cluster and in the
+// remote clusters known so far
+func (infra *infra) createAppNamespace() error {
+	namespace, err := util.CreateNamespaceWithPrefix(client, "istio-test-app-")
+	if err != nil {
+		return err
+	}
+	infra.Namespace = namespace
+	infra.namespaceCreated = true
+
+	for _, remote := range infra.remoteClients {
+		if _, err = remote.CoreV1().Namespaces().Create(&v1.Namespace{
+			ObjectMeta: meta_v1.ObjectMeta{Name: infra.Namespace},
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// teardownApps deletes the configs created by the harness and the app namespace if
+// the harness created it, but keeps the Istio namespace and the control plane so
+// that the apps can be redeployed quickly with redeployApps
+func (infra *infra) teardownApps() error {
+	if infra.UseInitializer && infra.namespaceCreated {
+		return fmt.Errorf("the sidecar initializer only injects namespace %s, which cannot be recreated",
+			infra.Namespace)
+	}
+
+	if err := infra.deleteCreatedConfigs(); err != nil {
+		return err
+	}
+
+	if infra.namespaceCreated {
+		for _, remote := range infra.remoteClients {
+			util.DeleteNamespace(remote, infra.Namespace)
+		}
+		util.DeleteNamespace(client, infra.Namespace)
+		infra.Namespace = ""
+		infra.namespaceCreated = false
+	}
+	infra.apps = make(map[string][]string)
+	return nil
+}
+
+// redeployApps recreates the app namespace removed by teardownApps, deploys the
+// apps again and waits for their pods to be ready
+func (infra *infra) redeployApps() error {
+	if infra.Namespace == "" {
+		if err := infra.createAppNamespace(); err != nil {
+			return err
+		}
+		if err := infra.labelInjectionPolicy(infra.Namespace); err != nil {
+			return err
+		}
+		if infra.InjectConfig != nil {
+			infra.InjectConfig.Policy = infra.injectionPolicy(infra.Namespace)
+		}
+		yaml, err := fill("headless.yaml.tmpl", infra)
+		if err != nil {
+			return err
+		}
+		if err = infra.kubeApply(yaml, infra.Namespace); err != nil {
+			return err
+		}
+	}
+
+	if err := infra.deployApps(); err != nil {
+		return err
+	}
+	return infra.refreshAllApps()
+}
+
+// controlPlaneComponent selects the pods and the container of a control plane component
+type controlPlaneComponent struct {
+	name, selector, container string
+}
+
+var controlPlaneComponents = []controlPlaneComponent{
+	{name: "pilot", selector: "infra=pilot", container: "discovery"},
+	{name: "mixer", selector: "app=mixer", container: "mixer"},
+	{name: "ca", selector: "app=istio-ca-app", container: "istio-ca-container"},
+	{name: "initializer", selector: "istio=sidecar-initializer", container: "sidecar-initializer"},
+}
+
+// waitForLogLine polls the logs until a line satisfies the matcher
+func (infra *infra) waitForLogLine(source string, logs func() (string, error), matcher func(line string) bool,
+	timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		out, err := logs()
+		if err != nil {
+			log.Infof("Failed to get the logs of %s: %v", source, err)
+		} else {
+			for _, line := range strings.Split(out, "\n") {
+				if matcher(line) {
+					return nil
+				}
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("no log line of %s matched within %v", source, timeout)
+		}
+		if err = infra.sleep(pollInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// waitForControlPlaneLog waits for a line of the logs of a pod of the control
+// plane component, e.g. "pilot", to satisfy the matcher. The pods are looked up
+// on each poll, so that the wait can start before the component is deployed.
+func (infra *infra) waitForControlPlaneLog(component string, matcher func(string) bool, timeout time.Duration) error {
+	var selected *controlPlaneComponent
+	for i := range controlPlaneComponents {
+		if controlPlaneComponents[i].name == component {
+			selected = &controlPlaneComponents[i]
+		}
+	}
+	if selected == nil {
+		return fmt.Errorf("unknown control plane component %q", component)
+	}
+
+	return infra.waitForLogLine(component, func() (string, error) {
+		out, err := shell(fmt.Sprintf("kubectl get pods --kubeconfig %s -n %s -l %s -o jsonpath={.items[*].metadata.name}",
+			kubeconfig, infra.IstioNamespace, selected.selector))
+		if err != nil {
+			return "", err
+		}
+		pods := strings.Fields(out)
+		if len(pods) == 0 {
+			return "", fmt.Errorf("no pods of %s", component)
+		}
+
+		var logs []string
+		for _, pod := range pods {
+			var content string
+			if content, err = shell(fmt.Sprintf("kubectl logs %s --kubeconfig %s -n %s -c %s",
+				pod, kubeconfig, infra.IstioNamespace, selected.container)); err != nil {
+				return "", err
+			}
+			logs = append(logs, content)
+		}
+		return strings.Join(logs, "\n"), nil
+	}, matcher, timeout)
+}
+
+// collectControlPlaneLogs saves the logs of the control plane pods in the error
+// logs directory, or dumps them if there is none. Components which are not
+// deployed are skipped.
+func (infra *infra) collectControlPlaneLogs() error {
+	if !infra.checkLogs {
+		log.Info("Log checking is disabled")
+		return nil
+	}
+
+	var errs error
+	for _, component := range controlPlaneComponents {
+		out, err := shell(fmt.Sprintf("kubectl get pods --kubeconfig %s -n %s -l %s -o jsonpath={.items[*].metadata.name}",
+			kubeconfig, infra.IstioNamespace, component.selector))
+		if err != nil {
+			errs = multierror.Append(errs, err)
+			continue
+		}
+		pods := strings.Fields(out)
+		if len(pods) == 0 {
+			log.Infof("Skip logs of %s, not deployed", component.name)
+			continue
+		}
+
+		for _, pod := range pods {
+			var content string
+			if content, err = shell(fmt.Sprintf("kubectl logs %s --kubeconfig %s -n %s -c %s",
+				pod, kubeconfig, infra.IstioNamespace, component.container)); err != nil {
+				errs = multierror.Append(errs, err)
+				continue
+			}
+
+			if len(infra.errorLogsDir) == 0 {
+				tlog(fmt.Sprintf("%s log", component.name), pod)
+				log.Info(content)
+				continue
+			}
+			if err = ioutil.WriteFile(filepath.Join(infra.errorLogsDir, pod+".txt"), []byte(content), 0644); err != nil {
+				errs = multierror.Append(errs, err)
+			}
+		}
+	}
+	return errs
+}
+
+func (infra *infra) kubeApply(yaml, namespace string) error {
+	return retryableKubectl("apply", yaml, namespace)
+}
+
+func (infra *infra) kubeDelete(yaml, namespace string) error {
+	return retryableKubectl("delete", yaml, namespace)
+}
+
+// kubeApplyRemote applies the yaml to the namespace of a remote cluster
+func (infra *infra) kubeApplyRemote(cluster int, yaml, namespace string) error {
+	config, err := infra.remoteKubeconfig(cluster)
+	if err != nil {
+		return err
+	}
+	return runInput(fmt.Sprintf("kubectl apply --kubeconfig %s -n %s -f -",
+		config, namespace), yaml)
+}
+
+// remoteKubeconfig returns the kube config file of a remote cluster
+func (infra *infra) remoteKubeconfig(cluster int) (string, error) {
+	if cluster < 0 || cluster >= len(infra.RemoteKubeconfigs) {
+		return "", fmt.Errorf("remote cluster %d out of range, %d remote clusters configured", cluster, len(infra.RemoteKubeconfigs))
+	}
+	return infra.RemoteKubeconfigs[cluster], nil
+}
+
+type response struct {
+	body    string
+	id      []string
+	version []string
+	port    []string
+	code    []string
+	latency []time.Duration
+	// handshake is the outcome of the TLS handshakes of https requests, "ok" or "failed"
+	handshake []string
+}
+
+const httpOk = "200"
+
+var (
+	idRex      = regexp.MustCompile("(?i)X-Request-Id=(.*)")
+	versionRex = regexp.MustCompile("ServiceVersion=(.*)")
+	portRex    = regexp.MustCompile("ServicePort=(.*)")
+	codeRex    = regexp.MustCompile("StatusCode=(.*)")
+	latencyRex = regexp.MustCompile("Latency=(.*)")
+	tlsRex     = regexp.MustCompile("TLSHandshake=(.*)")
+)
+
+func (infra *infra) clientRequest(app, url string, count int, extra string) response {
+	return infra.clientRequestFromPod(app, 0, url, count, extra)
+}
+
+// clientRequestFromPod makes a request from the pod of the app at the given index
+func (infra *infra) clientRequestFromPod(app string, podIndex int, url string, count int, extra string) response {
+	out := response{}
+	if len(infra.apps[app]) == 0 {
+		log.Errorf("missing pod names for app %q", app)
+		return out
+	}
+	if podIndex < 0 || podIndex >= len(infra.apps[app]) {
+		log.Errorf("pod index %d out of range for app %q with %d pods", podIndex, app, len(infra.apps[app]))
+		return out
+	}
+
+	pod := infra.apps[app][podIndex]
+	cmd := fmt.Sprintf("kubectl exec %s --kubeconfig %s -n %s -c app -- client -url %s -count %d %s",
+		pod, kubeconfig, infra.Namespace, url, count, extra)
+	request, err := shell(cmd)
+
+	if err != nil {
+		log.Errorf("client request error %v for %s in %s", err, url, app)
+		return out
+	}
+
+	return parseResponse(request)
+}
+
+// smokeTest checks the basic connectivity of the mesh with a request between a
+// few pairs of apps, so that a broken environment fails before the tests run
+func (infra *infra) smokeTest() error {
+	for _, pair := range []struct{ src, dst string }{
+		{"a", "b"},
+		{"a", "c"},
+		{"t", "a"},
+	} {
+		url := fmt.Sprintf("http://%s/%s", pair.dst, pair.src)
+		resp := infra.clientRequest(pair.src, url, 1, "")
+		if len(resp.code) == 0 || resp.code[0] != httpOk {
+			return fmt.Errorf("smoke test failed, request from %s to %s => Got %v", pair.src, url, resp.code)
+		}
+	}
+	return nil
+}
+
+// maxMatrixRequests bounds the requests of a connectivity matrix in flight
+const maxMatrixRequests = 8
+
+// connectivityMatrix sends a request between every ordered pair of distinct apps on
+// the port, the default HTTP port if empty, and records whether the destination
+// answered with 200, indexed by source then destination
+func (infra *infra) connectivityMatrix(apps []string, port string) map[string]map[string]bool {
+	type pair struct{ src, dst string }
+	pairs := make(chan pair)
+	matrix := make(map[string]map[string]bool, len(apps))
+	for _, src := range apps {
+		matrix[src] = make(map[string]bool, len(apps))
+	}
+
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	for i := 0; i < maxMatrixRequests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range pairs {
+				host := p.dst
+				if port != "" {
+					host += ":" + port
+				}
+				resp := infra.clientRequest(p.src, fmt.Sprintf("http://%s/%s", host, p.src), 1, "")
+				mu.Lock()
+				matrix[p.src][p.dst] = len(resp.code) > 0 && resp.code[0] == httpOk
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, src := range apps {
+		for _, dst := range apps {
+			if src != dst {
+				pairs <- pair{src, dst}
+			}
+		}
+	}
+	close(pairs)
+	wg.Wait()
+	return matrix
+}
+
+// clientLocalhost makes a request from the app pod to a port on the loopback
+// interface. Loopback traffic is not redirected to the proxy, so the request
+// reaches the app or the inbound listener directly.
+func (infra *infra) clientLocalhost(app string, port int, path string, count int) response {
+	return infra.clientRequest(app, localhostURL(port, path), count, "")
+}
+
+// localhostURL returns the URL of the path on a loopback port
+func localhostURL(port int, path string) string {
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return fmt.Sprintf("http://127.0.0.1:%d%s", port, path)
+}
+
+const (
+	// plaintextClientApp is the app deployed without a sidecar, its requests
+	// leave the pod in plaintext
+	plaintextClientApp = "t"
+
+	// plaintextRequestTimeout bounds the plaintext requests of assertPlaintextRejected
+	plaintextRequestTimeout = 10 * time.Second
+)
+
+// plaintextRejectionRex matches the error of the client whose connection is reset
+// or refused, as by a proxy requiring mutual TLS on a plaintext connection
+var plaintextRejectionRex = regexp.MustCompile(`Error .*(connection reset by peer|connection refused|EOF)`)
+
+// assertPlaintextRejected sends a plaintext request from the app without a
+// sidecar directly to the pod IP of the app, bypassing any outbound proxy, and
+// checks that the sidecar of the app, in STRICT mutual TLS mode, resets or
+// refuses the connection. The port is the target port of the app container.
+func (infra *infra) assertPlaintextRejected(toApp string, port int) error {
+	if len(infra.apps[plaintextClientApp]) == 0 {
+		return fmt.Errorf("missing pod names for app %q", plaintextClientApp)
+	}
+	if len(infra.apps[toApp]) == 0 {
+		return fmt.Errorf("missing pod names for app %q", toApp)
+	}
+	ip, err := infra.podIP(infra.apps[toApp][0])
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("http://%s:%d/", ip, port)
+	out, err := shell(fmt.Sprintf("kubectl exec %s --kubeconfig %s -n %s -c app -- client -url %s -count 1 -timeout %v",
+		infra.apps[plaintextClientApp][0], kubeconfig, infra.Namespace, url, plaintextRequestTimeout))
+	if err == nil {
+		return fmt.Errorf("plaintext request to %s of %s was accepted: %v", url, toApp, parseResponse(out).code)
+	}
+	reason, rejected := plaintextRejection(err.Error())
+	if !rejected {
+		return fmt.Errorf("plaintext request to %s of %s failed without a reset or refused connection: %v", url, toApp, err)
+	}
+	log.Infof("Plaintext request to %s of %s was rejected: %s", url, toApp, reason)
+	return nil
+}
+
+// plaintextRejection returns how the connection of a failed client request was
+// rejected, and whether it was reset or refused
+func plaintextRejection(output string) (string, bool) {
+	match := plaintextRejectionRex.FindStringSubmatch(output)
+	if match == nil {
+		return "", false
+	}
+	return match[1], true
+}
+
+// parseResponse parses the output of the client
+func parseResponse(request string) response {
+	out := response{}
+	out.body = request
+
+	ids := idRex.FindAllStringSubmatch(request, -1)
+	for _, id := range ids {
+		out.id = append(out.id, id[1])
+	}
+
+	versions := versionRex.FindAllStringSubmatch(request, -1)
+	for _, version := range versions {
+		out.version = append(out.version, version[1])
+	}
+
+	ports := portRex.FindAllStringSubmatch(request, -1)
+	for _, port := range ports {
+		out.port = append(out.port, port[1])
+	}
+
+	codes := codeRex.FindAllStringSubmatch(request, -1)
+	for _, code := range codes {
+		out.code = append(out.code, code[1])
+	}
+
+	handshakes := tlsRex.FindAllStringSubmatch(request, -1)
+	for _, handshake := range handshakes {
+		out.handshake = append(out.handshake, handshake[1])
+	}
+
+	latencies := latencyRex.FindAllStringSubmatch(request, -1)
+	for _, latency := range latencies {
+		if d, err := time.ParseDuration(latency[1]); err == nil {
+			out.latency = append(out.latency, d)
+		}
+	}
+
+	return out
+}
+
+const (
+	// appCertFile and appKeyFile are the certificate and key baked into the app image
+	appCertFile = "/cert.crt"
+	appKeyFile  = "/cert.key"
+)
+
+// clientRequestOpts are the optional settings of client requests
+type clientRequestOpts struct {
+	// clientCert and clientKey are the files, in the app container, of the
+	// certificate presented by the client in TLS handshakes
+	clientCert, clientKey string
+}
+
+// args returns the flags of the client for the options
+func (opts clientRequestOpts) args() (string, error) {
+	if (opts.clientCert == "") != (opts.clientKey == "") {
+		return "", errors.New("the client cert and key must be set together")
+	}
+	if opts.clientCert == "" {
+		return "", nil
+	}
+	return fmt.Sprintf("-cert %s -cert-key %s", opts.clientCert, opts.clientKey), nil
+}
+
+// clientRequestWithOpts makes a request from the app with the options, the
+// outcome of the TLS handshakes is reported in the handshake of the response
+func (infra *infra) clientRequestWithOpts(app, url string, count int, opts clientRequestOpts) response {
+	args, err := opts.args()
+	if err != nil {
+		log.Errorf("invalid request options for app %q: %v", app, err)
+		return response{}
+	}
+	return infra.clientRequest(app, url, count, args)
+}
+
+// requestWithJWT sends requests from the app carrying the JWT as a bearer token
+// in the Authorization header
+func (infra *infra) requestWithJWT(app, url, token string, count int) response {
+	if token == "" || strings.ContainsAny(token, " \t\r\n") {
+		log.Errorf("invalid token %q for app %q", token, app)
+		return response{}
+	}
+	return infra.clientRequest(app, url, count, "-token "+token)
+}
+
+// requestWithHeader sends requests carrying the header from the app. The client
+// is not run through a shell, so the header is passed verbatim and must not
+// contain whitespace.
+func (infra *infra) requestWithHeader(app, url, headerKey, headerValue string, count int) response {
+	if headerKey == "" || strings.ContainsAny(headerKey, " \t\r\n") || strings.ContainsAny(headerValue, " \t\r\n") {
+		log.Errorf("invalid header %q: %q for app %q", headerKey, headerValue, app)
+		return response{}
+	}
+	return infra.clientRequest(app, url, count, fmt.Sprintf("-key %s -val %s", headerKey, headerValue))
+}
+
+func (infra *infra) applyConfig(inFile string, data map[string]string) error {
+	if err := infra.createOrUpdateConfig(inFile, data); err != nil {
+		return err
+	}
+
+	return infra.waitForConfigPropagation()
+}
+
+// applyConfigFiltered applies the configs of the template with one of the types,
+// e.g. "destination-rule", or all configs if no type is given
+func (infra *infra) applyConfigFiltered(inFile string, data map[string]string, types ...string) error {
+	for _, typ := range types {
+		if _, exists := infra.config.ConfigDescriptor().GetByType(typ); !exists {
+			return fmt.Errorf("unknown config type %q", typ)
+		}
+	}
+
+	if err := infra.createOrUpdateConfig(inFile, data, types...); err != nil {
+		return err
+	}
+
+	return infra.waitForConfigPropagation()
+}
+
+// configAnalyzer reports the warnings of the configs applied by
+// applyConfigCheckWarnings, tests replace it with a stub
+var configAnalyzer = analyzeConfigs
+
+// applyConfigCheckWarnings applies the configs of the template and returns the
+// warnings of the analysis of the applied configs, e.g. routes to subsets which
+// are not defined. The configs are applied even if there are warnings.
+func (infra *infra) applyConfigCheckWarnings(inFile string, data map[string]string) ([]string, error) {
+	config, err := fill(inFile, data)
+	if err != nil {
+		return nil, err
+	}
+	vs, _, err := crd.ParseInputs(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = infra.applyConfig(inFile, data); err != nil {
+		return nil, err
+	}
+
+	metas := make([]model.ConfigMeta, 0, len(vs))
+	for _, v := range vs {
+		v.Namespace = infra.Namespace
+		metas = append(metas, v.ConfigMeta)
+	}
+	warnings := configAnalyzer(infra.config, metas)
+	for _, warning := range warnings {
+		log.Warnf("Config warning: %s", warning)
+	}
+	return warnings, nil
+}
+
+// analyzeConfigs checks that the subsets the v1alpha2 route rules route to are
+// defined by the destination rule of their destination
+func analyzeConfigs(store model.IstioConfigStore, metas []model.ConfigMeta) []string {
+	var warnings []string
+	for _, meta := range metas {
+		if meta.Type != model.V1alpha2RouteRule.Type {
+			continue
+		}
+		config, exists := store.Get(meta.Type, meta.Name, meta.Namespace)
+		if !exists {
+			warnings = append(warnings, fmt.Sprintf("%s: not found after apply", meta.Key()))
+			continue
+		}
+
+		domain := meta.Namespace + ".svc.cluster.local"
+		for _, http := range config.Spec.(*routingv2.RouteRule).Http {
+			for _, route := range http.Route {
+				if route.Destination == nil || route.Destination.Subset == "" {
+					continue
+				}
+				name, subset := route.Destination.Name, route.Destination.Subset
+				rule := store.DestinationRule(name, domain)
+				if rule == nil {
+					warnings = append(warnings, fmt.Sprintf("%s: subset %s of %s has no destination rule", meta.Key(), subset, name))
+					continue
+				}
+				if !definesSubset(rule.Spec.(*routingv2.DestinationRule), subset) {
+					warnings = append(warnings, fmt.Sprintf("%s: subset %s is not defined by destination rule %s",
+						meta.Key(), subset, rule.Name))
+				}
+			}
+		}
+	}
+	return warnings
+}
+
+// definesSubset checks whether the destination rule defines the subset
+func definesSubset(rule *routingv2.DestinationRule, subset string) bool {
+	for _, s := range rule.Subsets {
+		if s.Name == subset {
+			return true
+		}
+	}
+	return false
+}
+
+// applyConfigDir fills every "*.yaml.tmpl" template in dir (relative to the
+// testdata directory) and applies them in lexical order, so that numeric file
+// name prefixes control the ordering. It waits once for propagation at the end.
+func (infra *infra) applyConfigDir(dir string, data map[string]string) error {
+	files, err := ioutil.ReadDir(testDataDir + dir)
+	if err != nil {
+		return err
+	}
+
+	// ReadDir returns the entries sorted by file name
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".yaml.tmpl") {
+			continue
+		}
+		if err = infra.createOrUpdateConfig(filepath.Join(dir, file.Name()), data); err != nil {
+			return fmt.Errorf("failed to apply %s: %v", file.Name(), err)
+		}
+	}
+
+	return infra.waitForConfigPropagation()
+}
+
+// createOrUpdateConfig fills the template and writes the configs into the store
+// without waiting for them to propagate. Only the configs with one of the types
+// are written if any type is given.
+func (infra *infra) createOrUpdateConfig(inFile string, data map[string]string, types ...string) error {
+	config, err := fill(inFile, data)
+	if err != nil {
+		return err
+	}
+
+	vs, _, err := crd.ParseInputs(config)
+	if err != nil {
+		return err
+	}
+
+	infra.configMutex.Lock()
+	defer infra.configMutex.Unlock()
+
+	for _, v := range vs {
+		if len(types) > 0 && !containsString(types, v.Type) {
+			log.Infof("Skip config %s", v.Key())
+			continue
+		}
+
+		// fill up namespace for the config
+		v.Namespace = infra.Namespace
+
+		var revision string
+		old, exists := infra.config.Get(v.Type, v.Name, v.Namespace)
+		if exists {
+			v.ResourceVersion = old.ResourceVersion
+			revision, err = infra.config.Update(v)
+		} else {
+			revision, err = infra.config.Create(v)
+			if err == nil {
+				infra.trackConfig(v.ConfigMeta)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		infra.recordGeneration(v.ConfigMeta, revision)
+	}
+	return nil
+}
+
+// configKey identifies a config object
+type configKey struct {
+	typ, name, namespace string
+}
+
+func (key configKey) String() string {
+	return model.Key(key.typ, key.name, key.namespace)
+}
+
+// configGeneration maps a resource version to a generation. Kubernetes resource
+// versions are opaque but increasing integers for a given object.
+func configGeneration(resourceVersion string) (int64, error) {
+	return strconv.ParseInt(resourceVersion, 10, 64)
+}
+
+// recordGeneration records the generation of an applied config, revisions which
+// do not map to a generation are ignored. The caller holds configMutex.
+func (infra *infra) recordGeneration(meta model.ConfigMeta, revision string) {
+	gen, err := configGeneration(revision)
+	if err != nil {
+		return
+	}
+	if infra.configGenerations == nil {
+		infra.configGenerations = make(map[string]int64)
+	}
+	infra.configGenerations[meta.Key()] = gen
+}
+
+// lastGeneration returns the generation of the config last applied by the
+// harness, or zero if unknown
+func (infra *infra) lastGeneration(key configKey) int64 {
+	infra.configMutex.Lock()
+	defer infra.configMutex.Unlock()
+	return infra.configGenerations[key.String()]
+}
+
+// waitForConfigGeneration polls the config store until the config has at least
+// the generation
+func (infra *infra) waitForConfigGeneration(key configKey, gen int64, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		var observed int64
+		if config, exists := infra.config.Get(key.typ, key.name, key.namespace); exists {
+			current, err := configGeneration(config.ResourceVersion)
+			if err != nil {
+				return fmt.Errorf("config %s has resource version %q without a generation", key, config.ResourceVersion)
+			}
+			if current >= gen {
+				log.Infof("Config %s has generation %d", key, current)
+				return nil
+			}
+			observed = current
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %v waiting for config %s generation %d, observed %d", timeout, key, gen, observed)
+		}
+		if err := infra.sleep(pollInterval); err != nil {
 			return err
 		}
-		_, err = client.CoreV1().Secrets(infra.IstioNamespace).Create(&v1.Secret{
-			ObjectMeta: meta_v1.ObjectMeta{Name: ingressSecretName},
-			Data: map[string][]byte{
-				"tls.key": key,
-				"tls.crt": crt,
-			},
-		})
-		if err != nil {
-			return err
+	}
+}
+
+// containsInt checks whether the slice contains the integer
+func containsInt(slice []int, n int) bool {
+	for _, e := range slice {
+		if e == n {
+			return true
 		}
 	}
-	if infra.Zipkin {
-		if err := deploy("zipkin.yaml", infra.IstioNamespace); err != nil {
-			return err
+	return false
+}
+
+// containsString checks whether the slice contains the string
+func containsString(slice []string, s string) bool {
+	for _, e := range slice {
+		if e == s {
+			return true
 		}
 	}
+	return false
+}
+
+// trackConfig records a config created by the harness. The caller holds configMutex.
+func (infra *infra) trackConfig(meta model.ConfigMeta) {
+	if infra.createdConfigs == nil {
+		infra.createdConfigs = make(map[string]model.ConfigMeta)
+	}
+	infra.createdConfigs[meta.Key()] = meta
+}
+
+// untrackConfig forgets a deleted config. The caller holds configMutex.
+func (infra *infra) untrackConfig(meta model.ConfigMeta) {
+	delete(infra.createdConfigs, meta.Key())
+}
+
+// admissionDenialRex matches the error returned by the API server when an admission
+// webhook denies a request
+var admissionDenialRex = regexp.MustCompile(`admission webhook "[^"]*" denied the request`)
 
+// applyConfigExpectReject applies the config and succeeds only if the admission
+// webhook rejects it
+func (infra *infra) applyConfigExpectReject(inFile string, data map[string]string) error {
+	err := infra.createOrUpdateConfig(inFile, data)
+	if err == nil {
+		return fmt.Errorf("config %s should have been rejected", inFile)
+	}
+	if !admissionDenialRex.MatchString(err.Error()) {
+		return fmt.Errorf("config %s failed without an admission denial: %v", inFile, err)
+	}
+	log.Infof("Config %s rejected: %v", inFile, err)
 	return nil
 }
 
-func (infra *infra) deployApps() error {
-	// deploy a healthy mix of apps, with and without proxy
-	if err := infra.deployApp("t", "t", 8080, 80, 9090, 90, 7070, 70, "unversioned", false, false); err != nil {
+// assertRollbackOnReject applies the template with the valid data, updates it
+// with the invalid data, which must be rejected, and checks that the store still
+// holds the valid version of the config with the type and name unchanged
+func (infra *infra) assertRollbackOnReject(typ, name string, validData, invalidData map[string]string, inFile string) error {
+	if err := infra.createOrUpdateConfig(inFile, validData); err != nil {
 		return err
 	}
-	if err := infra.deployApp("a", "a", 8080, 80, 9090, 90, 7070, 70, "v1", true, false); err != nil {
-		return err
+	key := model.Key(typ, name, infra.Namespace)
+	valid, exists := infra.config.Get(typ, name, infra.Namespace)
+	if !exists {
+		return fmt.Errorf("config %s is missing after applying %s", key, inFile)
 	}
-	if err := infra.deployApp("b", "b", 80, 8080, 90, 9090, 70, 7070, "unversioned", true, false); err != nil {
+	validSpec, err := model.ToJSON(valid.Spec)
+	if err != nil {
 		return err
 	}
-	if err := infra.deployApp("c-v1", "c", 80, 8080, 90, 9090, 70, 7070, "v1", true, false); err != nil {
+
+	if err = infra.applyConfigExpectReject(inFile, invalidData); err != nil {
 		return err
 	}
-	if err := infra.deployApp("c-v2", "c", 80, 8080, 90, 9090, 70, 7070, "v2", true, false); err != nil {
+
+	current, exists := infra.config.Get(typ, name, infra.Namespace)
+	if !exists {
+		return fmt.Errorf("config %s was deleted by the rejected update", key)
+	}
+	currentSpec, err := model.ToJSON(current.Spec)
+	if err != nil {
 		return err
 	}
-	if err := infra.deployApp("d", "d", 80, 8080, 90, 9090, 70, 7070, "per-svc-auth", true, true); err != nil {
+	if current.ResourceVersion != valid.ResourceVersion || currentSpec != validSpec {
+		return fmt.Errorf("config %s was changed by the rejected update from version %s %s to version %s %s",
+			key, valid.ResourceVersion, validSpec, current.ResourceVersion, currentSpec)
+	}
+	return nil
+}
+
+func (infra *infra) deleteConfig(inFile string) error {
+	if err := infra.removeConfig(inFile, nil); err != nil {
 		return err
 	}
-	// Add another service without sidecar to test mTLS blacklisting (as in the e2e test
-	// environment, pilot can see only services in the test namespaces). This service
-	// will be listed in mtlsExcludedServices in the mesh config.
-	return infra.deployApp("e", "fake-control", 80, 8080, 90, 9090, 70, 7070, "fake-control", false, false)
+
+	return infra.waitForConfigPropagation()
 }
 
-func (infra *infra) deployApp(deployment, svcName string, port1, port2, port3, port4, port5, port6 int,
-	version string, injectProxy bool, perServiceAuth bool) error {
-	// Eureka does not support management ports
-	healthPort := "true"
-	if platform.ServiceRegistry(infra.Registry) == platform.EurekaRegistry {
-		healthPort = "false"
+// removeConfig fills the template and deletes the configs from the store
+// without waiting for the deletion to propagate
+func (infra *infra) removeConfig(inFile string, data map[string]string) error {
+	config, err := fill(inFile, data)
+	if err != nil {
+		return err
 	}
 
-	w, err := fill("app.yaml.tmpl", map[string]string{
-		"Hub":            infra.Hub,
-		"Tag":            infra.Tag,
-		"service":        svcName,
-		"perServiceAuth": strconv.FormatBool(perServiceAuth),
-		"deployment":     deployment,
-		"port1":          strconv.Itoa(port1),
-		"port2":          strconv.Itoa(port2),
-		"port3":          strconv.Itoa(port3),
-		"port4":          strconv.Itoa(port4),
-		"port5":          strconv.Itoa(port5),
-		"port6":          strconv.Itoa(port6),
-		"version":        version,
-		"istioNamespace": infra.IstioNamespace,
-		"injectProxy":    strconv.FormatBool(injectProxy),
-		"healthPort":     healthPort,
-	})
+	vs, _, err := crd.ParseInputs(config)
 	if err != nil {
 		return err
 	}
 
-	writer := new(bytes.Buffer)
+	infra.configMutex.Lock()
+	defer infra.configMutex.Unlock()
+	for _, v := range vs {
+		// fill up namespace for the config
+		v.Namespace = infra.Namespace
 
-	if injectProxy && !infra.UseInitializer {
-		if err := inject.IntoResourceFile(infra.InjectConfig, strings.NewReader(w), writer); err != nil {
-			return err
-		}
-	} else {
-		if _, err := io.Copy(writer, strings.NewReader(w)); err != nil {
+		log.Infof("Delete config %s", v.Key())
+		if err = infra.config.Delete(v.Type, v.Name, v.Namespace); err != nil {
 			return err
 		}
+		infra.untrackConfig(v.ConfigMeta)
 	}
-
-	return infra.kubeApply(writer.String(), infra.Namespace)
+	return nil
 }
 
-func (infra *infra) teardown() {
-	if yaml, err := fill("rbac-beta.yaml.tmpl", infra); err != nil {
-		log.Infof("RBAC template could could not be processed, please delete stale ClusterRoleBindings: %v",
-			err)
-	} else if err = infra.kubeDelete(yaml, infra.IstioNamespace); err != nil {
-		log.Infof("RBAC config could could not be deleted: %v", err)
-	}
-
-	if infra.UseAdmissionWebhook {
-		if err := infra.deleteAdmissionWebhookSecret(); err != nil {
-			log.Infof("Could not delete admission webhook secret: %v", err)
-		}
+// applyConfigWithTTL applies the config and deletes it again once the ttl
+// expires, e.g. for a transient fault injection window. The deletion is also
+// registered as a cleanup in case the harness is torn down first.
+func (infra *infra) applyConfigWithTTL(inFile string, data map[string]string, ttl time.Duration) error {
+	if err := infra.createOrUpdateConfig(inFile, data); err != nil {
+		return err
 	}
 
-	if infra.namespaceCreated {
-		util.DeleteNamespace(client, infra.Namespace)
-		infra.Namespace = ""
-	}
-	if infra.istioNamespaceCreated {
-		util.DeleteNamespace(client, infra.IstioNamespace)
-		infra.IstioNamespace = ""
+	var once sync.Once
+	expire := func() error {
+		var err error
+		once.Do(func() {
+			log.Infof("Config %s expired", inFile)
+			err = infra.removeConfig(inFile, data)
+		})
+		return err
 	}
-
-	// InitializerConfiguration is not namespaced.
-	if infra.UseInitializer {
-		if yaml, err := fill("initializer-config.yaml.tmpl", infra); err != nil {
-			log.Infof("Sidecar initializer configuration could not be processed, "+
-				"please delete stale InitializerConfiguration : %v", err)
-		} else if err := infra.kubeDelete(yaml, infra.IstioNamespace); err != nil {
-			log.Infof("Sidecar initializer configuration could not be deleted: %v", err)
+	infra.deferCleanup(expire)
+
+	ctx := infra.context()
+	go func() {
+		select {
+		case <-time.After(ttl):
+			if err := expire(); err != nil {
+				log.Errorf("Failed to delete expired config %s: %v", inFile, err)
+			}
+		case <-ctx.Done():
 		}
-	}
-}
-
-func (infra *infra) kubeApply(yaml, namespace string) error {
-	return util.RunInput(fmt.Sprintf("kubectl apply --kubeconfig %s -n %s -f -",
-		kubeconfig, namespace), yaml)
-}
-
-func (infra *infra) kubeDelete(yaml, namespace string) error {
-	return util.RunInput(fmt.Sprintf("kubectl delete --kubeconfig %s -n %s -f -",
-		kubeconfig, namespace), yaml)
-}
+	}()
 
-type response struct {
-	body    string
-	id      []string
-	version []string
-	port    []string
-	code    []string
+	return infra.waitForConfigPropagation()
 }
 
-const httpOk = "200"
-
-var (
-	idRex      = regexp.MustCompile("(?i)X-Request-Id=(.*)")
-	versionRex = regexp.MustCompile("ServiceVersion=(.*)")
-	portRex    = regexp.MustCompile("ServicePort=(.*)")
-	codeRex    = regexp.MustCompile("StatusCode=(.*)")
-)
+// patchConfig applies the patch to the config in the app namespace and writes
+// it back to the store
+func (infra *infra) patchConfig(typ, name string, patch func(*model.Config) error) error {
+	infra.configMutex.Lock()
+	defer infra.configMutex.Unlock()
 
-func (infra *infra) clientRequest(app, url string, count int, extra string) response {
-	out := response{}
-	if len(infra.apps[app]) == 0 {
-		log.Errorf("missing pod names for app %q", app)
-		return out
+	config, exists := infra.config.Get(typ, name, infra.Namespace)
+	if !exists {
+		return fmt.Errorf("missing config %s", model.Key(typ, name, infra.Namespace))
+	}
+	if err := patch(config); err != nil {
+		return err
 	}
 
-	pod := infra.apps[app][0]
-	cmd := fmt.Sprintf("kubectl exec %s --kubeconfig %s -n %s -c app -- client -url %s -count %d %s",
-		pod, kubeconfig, infra.Namespace, url, count, extra)
-	request, err := util.Shell(cmd)
-
+	log.Infof("Update config %s", config.Key())
+	revision, err := infra.config.Update(*config)
 	if err != nil {
-		log.Errorf("client request error %v for %s in %s", err, url, app)
-		return out
+		return err
 	}
+	infra.recordGeneration(config.ConfigMeta, revision)
+	return nil
+}
 
-	out.body = request
+// assertFieldPreserved checks that a field of the config in the app namespace has
+// the expected value before and after the mutation, e.g. that a controller
+// reconciling the config does not overwrite a field set by the user. The field is
+// a dotted path of JSON field names and list indices, e.g. "route.1.weight".
+func (infra *infra) assertFieldPreserved(typ, name, jsonPath, expected string, after func() error) error {
+	key := model.Key(typ, name, infra.Namespace)
+	value, err := infra.configField(typ, name, jsonPath)
+	if err != nil {
+		return err
+	}
+	if value != expected {
+		return fmt.Errorf("field %s of %s is %q before the mutation, expected %q", jsonPath, key, value, expected)
+	}
 
-	ids := idRex.FindAllStringSubmatch(request, -1)
-	for _, id := range ids {
-		out.id = append(out.id, id[1])
+	if err = after(); err != nil {
+		return err
 	}
 
-	versions := versionRex.FindAllStringSubmatch(request, -1)
-	for _, version := range versions {
-		out.version = append(out.version, version[1])
+	if value, err = infra.configField(typ, name, jsonPath); err != nil {
+		return err
+	}
+	if value != expected {
+		return fmt.Errorf("field %s of %s was overwritten with %q, expected %q", jsonPath, key, value, expected)
 	}
+	return nil
+}
 
-	ports := portRex.FindAllStringSubmatch(request, -1)
-	for _, port := range ports {
-		out.port = append(out.port, port[1])
+// configField returns the field of the config in the app namespace at the
+// dotted path, scalars in their JSON encoding without quotes
+func (infra *infra) configField(typ, name, jsonPath string) (string, error) {
+	config, exists := infra.config.Get(typ, name, infra.Namespace)
+	if !exists {
+		return "", fmt.Errorf("missing config %s", model.Key(typ, name, infra.Namespace))
+	}
+	spec, err := model.ToJSONMap(config.Spec)
+	if err != nil {
+		return "", err
 	}
 
-	codes := codeRex.FindAllStringSubmatch(request, -1)
-	for _, code := range codes {
-		out.code = append(out.code, code[1])
+	var field interface{} = spec
+	for _, elt := range strings.Split(strings.TrimPrefix(jsonPath, "."), ".") {
+		switch value := field.(type) {
+		case map[string]interface{}:
+			var exists bool
+			if field, exists = value[elt]; !exists {
+				return "", fmt.Errorf("missing field %s of %s in %s", elt, jsonPath, config.Key())
+			}
+		case []interface{}:
+			i, indexErr := strconv.Atoi(elt)
+			if indexErr != nil || i < 0 || i >= len(value) {
+				return "", fmt.Errorf("invalid index %s of %s in %s with %d elements", elt, jsonPath, config.Key(), len(value))
+			}
+			field = value[i]
+		default:
+			return "", fmt.Errorf("field %s of %s in %s is not an object or a list", elt, jsonPath, config.Key())
+		}
 	}
 
-	return out
+	if out, ok := field.(string); ok {
+		return out, nil
+	}
+	out, err := json.Marshal(field)
+	return string(out), err
 }
 
-func (infra *infra) applyConfig(inFile string, data map[string]string) error {
-	config, err := fill(inFile, data)
+// routeSourceApp is the app whose sidecar is checked for route changes
+const routeSourceApp = "a"
+
+// switchTraffic cuts all traffic of the service over from one subset to another
+// by rewriting the destinations of its v1alpha2 route rule, and waits for the
+// sidecar of the source app to route to the new subset
+func (infra *infra) switchTraffic(service, fromSubset, toSubset string) error {
+	domain := infra.Namespace + ".svc.cluster.local"
+	labels, err := infra.subsetLabels(service, toSubset, domain)
 	if err != nil {
 		return err
 	}
-
-	vs, _, err := crd.ParseInputs(config)
+	name, err := infra.routeRuleName(service, domain)
 	if err != nil {
 		return err
 	}
 
-	for _, v := range vs {
-		// fill up namespace for the config
-		v.Namespace = infra.Namespace
-
-		old, exists := infra.config.Get(v.Type, v.Name, v.Namespace)
-		if exists {
-			v.ResourceVersion = old.ResourceVersion
-			_, err = infra.config.Update(v)
-		} else {
-			_, err = infra.config.Create(v)
+	if err = infra.patchConfig(model.V1alpha2RouteRule.Type, name, func(config *model.Config) error {
+		rule := config.Spec.(*routingv2.RouteRule)
+		if !routesToSubset(rule, fromSubset) {
+			return fmt.Errorf("route rule %s does not route to subset %s", name, fromSubset)
 		}
-		if err != nil {
-			return err
+		for _, http := range rule.Http {
+			if http.Redirect == nil {
+				http.Route = []*routingv2.DestinationWeight{{
+					Destination: &routingv2.Destination{Name: service, Subset: toSubset},
+					Weight:      100,
+				}}
+			}
 		}
+		return nil
+	}); err != nil {
+		return err
 	}
 
-	sleepTime := time.Second * 3
-	log.Infof("Sleeping %v for the config to propagate", sleepTime)
-	time.Sleep(sleepTime)
-	return nil
+	// subset clusters are keyed by the subset labels
+	suffix := "|" + labels.String()
+	return infra.waitForRoute(routeSourceApp, service, "/", func(route RouteMatch) bool {
+		return len(route.Clusters) == 1 && strings.HasSuffix(route.Clusters[0], suffix)
+	}, routeTimeout)
 }
 
-func (infra *infra) deleteConfig(inFile string) error {
-	config, err := fill(inFile, nil)
-	if err != nil {
-		return err
+// subsetLabels returns the labels of the subset of the service defined by its
+// destination rule
+func (infra *infra) subsetLabels(service, subset, domain string) (model.Labels, error) {
+	config := infra.config.DestinationRule(service, domain)
+	if config == nil {
+		return nil, fmt.Errorf("missing destination rule for %s", service)
+	}
+	for _, s := range config.Spec.(*routingv2.DestinationRule).Subsets {
+		if s.Name == subset {
+			return model.Labels(s.Labels), nil
+		}
 	}
+	return nil, fmt.Errorf("destination rule %s has no subset %s", config.Name, subset)
+}
 
-	vs, _, err := crd.ParseInputs(config)
+// routeRuleName returns the name of the v1alpha2 route rule of the service
+func (infra *infra) routeRuleName(service, domain string) (string, error) {
+	configs, err := infra.config.List(model.V1alpha2RouteRule.Type, infra.Namespace)
 	if err != nil {
-		return err
+		return "", err
 	}
+	for _, config := range configs {
+		for _, host := range config.Spec.(*routingv2.RouteRule).Hosts {
+			if model.ResolveFQDN(host, domain) == model.ResolveFQDN(service, domain) {
+				return config.Name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("missing route rule for %s", service)
+}
 
-	for _, v := range vs {
-		// fill up namespace for the config
-		v.Namespace = infra.Namespace
-
-		log.Infof("Delete config %s", v.Key())
-		if err = infra.config.Delete(v.Type, v.Name, v.Namespace); err != nil {
-			return err
+// routesToSubset checks whether any HTTP route of the rule has a destination in the subset
+func routesToSubset(rule *routingv2.RouteRule, subset string) bool {
+	for _, http := range rule.Http {
+		for _, route := range http.Route {
+			if route.Destination != nil && route.Destination.Subset == subset {
+				return true
+			}
 		}
 	}
+	return false
+}
 
-	sleepTime := time.Second * 3
-	log.Infof("Sleeping %v for the config to propagate", sleepTime)
-	time.Sleep(sleepTime)
-	return nil
+// deferCleanup registers a function to run on teardown
+func (infra *infra) deferCleanup(f func() error) {
+	infra.cleanups = append(infra.cleanups, f)
+}
+
+// waitForConfigPropagation gives config changes time to reach the proxies
+func (infra *infra) waitForConfigPropagation() error {
+	log.Infof("Sleeping %v for the config to propagate", configPropagationDelay)
+	return infra.sleep(configPropagationDelay)
+}
+
+// context returns the harness context, which is cancelled on teardown
+func (infra *infra) context() context.Context {
+	if infra.ctx == nil {
+		return context.Background()
+	}
+	return infra.ctx
+}
+
+// sleep waits for the duration unless the harness context is cancelled first
+func (infra *infra) sleep(d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-infra.context().Done():
+		return infra.context().Err()
+	}
 }
 
 func (infra *infra) deleteAllConfigs() error {
+	infra.configMutex.Lock()
+	defer infra.configMutex.Unlock()
+
 	for _, desc := range infra.config.ConfigDescriptor() {
 		configs, err := infra.config.List(desc.Type, infra.Namespace)
 		if err != nil {
@@ -501,8 +2442,100 @@ func (infra *infra) deleteAllConfigs() error {
 			if err = infra.config.Delete(desc.Type, config.Name, config.Namespace); err != nil {
 				return err
 			}
+			infra.untrackConfig(config.ConfigMeta)
+		}
+	}
+	return nil
+}
+
+// reset deletes the configs created by the harness so that the next test case
+// starts from a clean state without a full teardown. The app pods are restarted
+// if requested to clear the state cached by the proxies.
+func (infra *infra) reset() error {
+	if err := infra.deleteCreatedConfigs(); err != nil {
+		return err
+	}
+
+	if infra.restartProxiesOnReset {
+		if err := infra.restartAppPods(); err != nil {
+			return err
+		}
+	}
+	return infra.waitForConfigPropagation()
+}
+
+// deleteCreatedConfigs deletes the configs created by the harness in key order
+func (infra *infra) deleteCreatedConfigs() error {
+	infra.configMutex.Lock()
+	defer infra.configMutex.Unlock()
+
+	keys := make([]string, 0, len(infra.createdConfigs))
+	for key := range infra.createdConfigs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		meta := infra.createdConfigs[key]
+		log.Infof("Delete config %s", key)
+		if err := infra.config.Delete(meta.Type, meta.Name, meta.Namespace); err != nil {
+			return err
 		}
+		infra.untrackConfig(meta)
+	}
+	return nil
+}
+
+// restartAppPods deletes the pods of the app namespace and waits for their
+// replacements to be ready
+func (infra *infra) restartAppPods() error {
+	if _, err := shell(fmt.Sprintf("kubectl delete pods --all --kubeconfig %s -n %s",
+		kubeconfig, infra.Namespace)); err != nil {
+		return err
 	}
+
+	return infra.refreshAllApps()
+}
+
+// defaultGracePeriod deletes pods with the termination grace period of their spec
+const defaultGracePeriod time.Duration = -1
+
+// deletePod deletes the pod of the app at the given index without waiting for its
+// replacement. A zero grace period kills the pod immediately, while a positive
+// one, rounded up to seconds, overrides the grace period of the pod spec.
+func (infra *infra) deletePod(app string, podIndex int, gracePeriod time.Duration) error {
+	if len(infra.apps[app]) == 0 {
+		return fmt.Errorf("missing pod names for app %q", app)
+	}
+	if podIndex < 0 || podIndex >= len(infra.apps[app]) {
+		return fmt.Errorf("pod index %d out of range for app %q with %d pods", podIndex, app, len(infra.apps[app]))
+	}
+
+	_, err := shell(fmt.Sprintf("kubectl delete pod %s --kubeconfig %s -n %s%s",
+		infra.apps[app][podIndex], kubeconfig, infra.Namespace, gracePeriodFlags(gracePeriod)))
+	return err
+}
+
+// gracePeriodFlags returns the kubectl delete flags selecting the grace period
+func gracePeriodFlags(gracePeriod time.Duration) string {
+	switch {
+	case gracePeriod < 0:
+		return ""
+	case gracePeriod == 0:
+		// kubectl requires force to skip the graceful termination
+		return " --grace-period=0 --force"
+	}
+	return fmt.Sprintf(" --grace-period=%d", int64(math.Ceil(gracePeriod.Seconds())))
+}
+
+// refreshAllApps waits for the pods of the Istio and app namespaces to be ready
+// and rebuilds the map from app to pods
+func (infra *infra) refreshAllApps() error {
+	apps, err := util.GetAppPods(client, kubeconfig, []string{infra.IstioNamespace, infra.Namespace})
+	if err != nil {
+		return err
+	}
+	infra.apps = apps
 	return nil
 }
 
@@ -587,6 +2620,43 @@ func (infra *infra) createAdmissionWebhookSecret() error {
 	return infra.kubeApply(yaml, infra.IstioNamespace)
 }
 
+// createCARootSecret stores the custom CA root in the secret mounted by the CA
+// as its signing certificate and key. The secret is deleted on teardown.
+func (infra *infra) createCARootSecret() error {
+	root := infra.CustomCARoot
+	if _, err := tls.X509KeyPair(root.CertPEM, root.KeyPEM); err != nil {
+		return fmt.Errorf("invalid custom CA root: %v", err)
+	}
+	cert, err := parseLeafCert(string(root.CertPEM))
+	if err != nil {
+		return fmt.Errorf("invalid custom CA root: %v", err)
+	}
+	if !cert.IsCA || cert.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return fmt.Errorf("custom CA root %s cannot sign certificates", cert.Subject.CommonName)
+	}
+
+	_, err = client.CoreV1().Secrets(infra.IstioNamespace).Create(&v1.Secret{
+		ObjectMeta: meta_v1.ObjectMeta{Name: caRootSecretName},
+		Data: map[string][]byte{
+			"ca-cert.pem":   root.CertPEM,
+			"ca-key.pem":    root.KeyPEM,
+			"root-cert.pem": root.CertPEM,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	infra.deferCleanup(func() error {
+		return client.CoreV1().Secrets(infra.IstioNamespace).Delete(caRootSecretName, &meta_v1.DeleteOptions{})
+	})
+	return nil
+}
+
+// CARootSecretName returns the name of the custom CA root secret for ca.yaml.tmpl
+func (infra *infra) CARootSecretName() string {
+	return caRootSecretName
+}
+
 func (infra *infra) deleteAdmissionWebhookSecret() error {
 	return util.Run(fmt.Sprintf("kubectl delete --kubeconfig %s -n %s secret pilot-webhook",
 		kubeconfig, infra.IstioNamespace))
@@ -0,0 +1,2057 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/api/core/v1"
+	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	apiextensionsfake "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/fake"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+
+	routingv1 "istio.io/api/routing/v1alpha1"
+	routingv2 "istio.io/api/routing/v1alpha2"
+	"istio.io/istio/pilot/adapter/config/crd"
+	"istio.io/istio/pilot/adapter/config/memory"
+	"istio.io/istio/pilot/model"
+	"istio.io/istio/pilot/platform/kube/inject"
+)
+
+func makeTestInfra() *infra {
+	infra := &infra{
+		Namespace:          "app",
+		IstioNamespace:     "istio-system",
+		apps:               make(map[string][]string),
+		ConfigStoreFactory: memoryConfigStore,
+		configMutex:        &sync.Mutex{},
+		metricsMutex:       &sync.Mutex{},
+	}
+	if err := infra.initConfigStore(); err != nil {
+		panic(err)
+	}
+	return infra
+}
+
+// memoryConfigStore returns an in-memory config store
+func memoryConfigStore() (model.IstioConfigStore, error) {
+	return model.MakeIstioStore(memory.Make(model.IstioConfigTypes)), nil
+}
+
+// stubClient replaces the kube client with a fake serving the objects and returns
+// a function restoring it
+func stubClient(objects ...runtime.Object) func() {
+	saved := client
+	client = fake.NewSimpleClientset(objects...)
+	return func() {
+		client = saved
+	}
+}
+
+// readyPod returns a running pod of the app with all containers ready
+func readyPod(name, namespace, app string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: meta_v1.ObjectMeta{Name: name, Namespace: namespace, Labels: map[string]string{"app": app}},
+		Status: v1.PodStatus{
+			Phase:             v1.PodRunning,
+			ContainerStatuses: []v1.ContainerStatus{{Name: "app", Ready: true}},
+		},
+	}
+}
+
+// deployTestApp deploys app "a" with a stubbed kubectl and returns the applied yaml
+func deployTestApp(t *testing.T, infra *infra, injectProxy bool, opts appOptions) string {
+	var applied string
+	defer stubRunInput(func(_, input string) error {
+		applied = input
+		return nil
+	})()
+
+	if err := infra.deployApp("a", "a", 8080, 80, 9090, 90, 7070, 70, "v1", injectProxy, false, opts); err != nil {
+		t.Fatal(err)
+	}
+	return applied
+}
+
+// deploymentPodSpec returns the pod spec of the Deployment of the rendered app
+func deploymentPodSpec(t *testing.T, rendered string) v1.PodSpec {
+	return deploymentPodTemplate(t, rendered).Spec
+}
+
+// deploymentPodTemplate returns the pod template of the Deployment of the rendered app
+func deploymentPodTemplate(t *testing.T, rendered string) v1.PodTemplateSpec {
+	var deployment struct {
+		Spec struct {
+			Template v1.PodTemplateSpec `json:"template"`
+		} `json:"spec"`
+	}
+	for _, doc := range strings.Split(rendered, "---\n") {
+		if strings.Contains(doc, "kind: Deployment") {
+			if err := yaml.Unmarshal([]byte(doc), &deployment); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return deployment.Spec.Template
+}
+
+func TestApplyDeleteConfig(t *testing.T) {
+	infra := makeTestInfra()
+	if err := infra.applyConfig("rule-default-route.yaml.tmpl", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := infra.config.Get(model.RouteRule.Type, "default-route", infra.Namespace); !exists {
+		t.Fatal("applied config is missing from the store")
+	}
+
+	if err := infra.deleteConfig("rule-default-route.yaml.tmpl"); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := infra.config.Get(model.RouteRule.Type, "default-route", infra.Namespace); exists {
+		t.Error("deleted config is still in the store")
+	}
+}
+
+func TestSwitchTraffic(t *testing.T) {
+	defer stubPilot(t, map[string]string{
+		"/v1/routes/80/a/sidecar~10.0.0.5~a-pod.app~app.svc.cluster.local": `{"virtual_hosts":[{"name":"c.app.svc.cluster.local|http",` +
+			`"domains":["c"],"routes":[{"prefix":"/","cluster":"out.c.app.svc.cluster.local|http|version=v2"}]}]}`,
+	})()
+
+	infra := makeTestInfra()
+	infra.apps["a"] = []string{"a-pod"}
+	if err := infra.applyConfig("rule-route-subsets.yaml.tmpl", map[string]string{"destination": "c"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := infra.switchTraffic("c", "v3", "v2"); err == nil {
+		t.Error("expected an error for a subset without traffic")
+	}
+	if err := infra.switchTraffic("c", "v1", "v2"); err != nil {
+		t.Fatal(err)
+	}
+
+	config, exists := infra.config.Get(model.V1alpha2RouteRule.Type, "route-c", infra.Namespace)
+	if !exists {
+		t.Fatal("route rule is missing from the store")
+	}
+	routes := config.Spec.(*routingv2.RouteRule).Http[0].Route
+	if len(routes) != 1 || routes[0].Destination.Subset != "v2" || routes[0].Weight != 100 {
+		t.Errorf("route rule does not route fully to v2: %v", routes)
+	}
+}
+
+func TestApplyConfigWithTTL(t *testing.T) {
+	infra := makeTestInfra()
+	if err := infra.applyConfigWithTTL("rule-default-route.yaml.tmpl", nil, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	exists := func() bool {
+		infra.configMutex.Lock()
+		defer infra.configMutex.Unlock()
+		_, found := infra.config.Get(model.RouteRule.Type, "default-route", infra.Namespace)
+		return found
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for exists() {
+		if time.Now().After(deadline) {
+			t.Fatal("config was not deleted after the ttl")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the cleanup is a no-op once the ttl fired
+	infra.SkipControlPlane = true
+	infra.teardown()
+}
+
+func TestApplyConfigWithTTLTeardown(t *testing.T) {
+	infra := makeTestInfra()
+	infra.SkipControlPlane = true
+	if err := infra.applyConfigWithTTL("rule-default-route.yaml.tmpl", nil, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	infra.teardown()
+	if _, exists := infra.config.Get(model.RouteRule.Type, "default-route", infra.Namespace); exists {
+		t.Error("config was not deleted on teardown")
+	}
+}
+
+func TestApplyConfigFiltered(t *testing.T) {
+	infra := makeTestInfra()
+	data := map[string]string{"destination": "c"}
+	if err := infra.applyConfigFiltered("rule-route-subsets.yaml.tmpl", data, model.V1alpha2RouteRule.Type); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, exists := infra.config.Get(model.V1alpha2RouteRule.Type, "route-c", infra.Namespace); !exists {
+		t.Error("route rule is missing from the store")
+	}
+	if _, exists := infra.config.Get(model.DestinationRule.Type, "c", infra.Namespace); exists {
+		t.Error("destination rule should have been filtered out")
+	}
+
+	if err := infra.applyConfigFiltered("rule-route-subsets.yaml.tmpl", data); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := infra.config.Get(model.DestinationRule.Type, "c", infra.Namespace); !exists {
+		t.Error("destination rule is missing from the store without a filter")
+	}
+
+	if err := infra.applyConfigFiltered("rule-route-subsets.yaml.tmpl", data, "virtual-service"); err == nil {
+		t.Error("expected an error for an unknown type")
+	}
+}
+
+// recordingStore records the names of the created configs
+type recordingStore struct {
+	model.ConfigStore
+	created []string
+}
+
+func (s *recordingStore) Create(config model.Config) (string, error) {
+	s.created = append(s.created, config.Name)
+	return s.ConfigStore.Create(config)
+}
+
+func TestApplyConfigDir(t *testing.T) {
+	infra := makeTestInfra()
+	store := &recordingStore{ConfigStore: memory.Make(model.IstioConfigTypes)}
+	infra.config = model.MakeIstioStore(store)
+	if err := infra.applyConfigDir("config-dir", map[string]string{"destination": "c"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the files are applied in the order of their names, not of the config names
+	if want := []string{"default-route", "content-route"}; !reflect.DeepEqual(store.created, want) {
+		t.Errorf("got configs created in order %v, want %v", store.created, want)
+	}
+
+	for _, name := range []string{"default-route", "content-route"} {
+		config, exists := infra.config.Get(model.RouteRule.Type, name, infra.Namespace)
+		if !exists {
+			t.Errorf("config %q is missing from the store", name)
+			continue
+		}
+		if config.Namespace != infra.Namespace {
+			t.Errorf("config %q has namespace %q, want %q", name, config.Namespace, infra.Namespace)
+		}
+	}
+}
+
+func TestApplyConfigDirMissing(t *testing.T) {
+	infra := makeTestInfra()
+	if err := infra.applyConfigDir("does-not-exist", nil); err == nil {
+		t.Error("expected an error for a missing directory")
+	}
+}
+
+func TestDeployAppProbes(t *testing.T) {
+	cases := []struct {
+		name    string
+		opts    appOptions
+		want    []string
+		notWant []string
+	}{
+		{
+			name: "defaults",
+			opts: appOptions{},
+			want: []string{
+				"path: /healthz",
+				"port: 3333",
+				"tcpSocket:",
+			},
+			notWant: []string{
+				"securityContext:",
+				"dnsPolicy:",
+			},
+		},
+		{
+			name: "custom",
+			opts: appOptions{livenessPath: "/live", readinessPath: "/ready", probePort: 4444},
+			want: []string{
+				"- \"4444\"",
+				"containerPort: 4444",
+				"path: /live",
+				"path: /ready",
+				"port: 4444",
+			},
+			notWant: []string{
+				"3333",
+				"/healthz",
+				"tcpSocket:",
+			},
+		},
+		{
+			name: "run as user",
+			opts: appOptions{runAsUser: 1000},
+			want: []string{
+				"runAsUser: 1000",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		rendered := deployTestApp(t, makeTestInfra(), false, c.opts)
+		for _, want := range c.want {
+			if !strings.Contains(rendered, want) {
+				t.Errorf("%s: rendered app is missing %q:\n%s", c.name, want, rendered)
+			}
+		}
+		for _, notWant := range c.notWant {
+			if strings.Contains(rendered, notWant) {
+				t.Errorf("%s: rendered app unexpectedly contains %q:\n%s", c.name, notWant, rendered)
+			}
+		}
+	}
+}
+
+func TestDeployAppDNSConfig(t *testing.T) {
+	rendered := deployTestApp(t, makeTestInfra(), false, appOptions{dnsSearches: []string{"example.com"}, dnsNdots: 5})
+	for _, want := range []string{
+		"dnsPolicy: ClusterFirst",
+		"- example.com",
+		"- name: ndots\n          value: \"5\"",
+	} {
+		if !strings.Contains(rendered, want) {
+			t.Errorf("rendered app is missing %q:\n%s", want, rendered)
+		}
+	}
+	if strings.Contains(rendered, "nameservers:") {
+		t.Errorf("rendered app should use the cluster DNS server:\n%s", rendered)
+	}
+
+	rendered = deployTestApp(t, makeTestInfra(), false, appOptions{dnsNameservers: []string{"10.0.0.10"}})
+	for _, want := range []string{"dnsPolicy: None", "- 10.0.0.10"} {
+		if !strings.Contains(rendered, want) {
+			t.Errorf("rendered app is missing %q:\n%s", want, rendered)
+		}
+	}
+}
+
+// testInjectConfig returns an injection config injecting all namespaces
+func testInjectConfig() *inject.Config {
+	mesh := model.DefaultMeshConfig()
+	return &inject.Config{
+		Policy:            inject.InjectionPolicyEnabled,
+		IncludeNamespaces: []string{v1.NamespaceAll},
+		Params: inject.Params{
+			InitImage:       inject.InitImageName("gcr.io/istio-testing", "test", false),
+			ProxyImage:      inject.ProxyImageName("gcr.io/istio-testing", "test", false),
+			SidecarProxyUID: inject.DefaultSidecarProxyUID,
+			Mesh:            &mesh,
+		},
+	}
+}
+
+func TestDeployAppProxyLogLevel(t *testing.T) {
+	infra := makeTestInfra()
+	infra.InjectConfig = testInjectConfig()
+
+	debugLevel := regexp.MustCompile(`- --proxyLogLevel\s+- debug\n`)
+	if rendered := deployTestApp(t, infra, true, appOptions{proxyLogLevel: "debug"}); !debugLevel.MatchString(rendered) {
+		t.Errorf("proxy of the app does not log at the debug level:\n%s", rendered)
+	}
+	if rendered := deployTestApp(t, infra, true, appOptions{}); strings.Contains(rendered, "--proxyLogLevel") {
+		t.Errorf("proxy of another app should log at the default level:\n%s", rendered)
+	}
+	if infra.InjectConfig.Params.ProxyLogLevel != "" {
+		t.Error("the log level override leaked into the shared injection config")
+	}
+}
+
+func TestDeployAppHoldApplicationUntilProxyStarts(t *testing.T) {
+	infra := makeTestInfra()
+	infra.InjectConfig = testInjectConfig()
+
+	if _, err := infra.appYAML("a", "a", 8080, 80, 9090, 90, 7070, 70, "v1", true, false,
+		appOptions{holdApplicationUntilProxyStarts: true}); err == nil {
+		t.Error("expected an error for a post start hook without the debug images")
+	}
+
+	infra.InjectConfig.Params.DebugMode = true
+	spec := deploymentPodSpec(t, deployTestApp(t, infra, true, appOptions{holdApplicationUntilProxyStarts: true}))
+	if len(spec.Containers) != 2 || spec.Containers[0].Name != inject.ProxyContainerName {
+		t.Fatalf("proxy is not the first container: %v", spec.Containers)
+	}
+	lifecycle := spec.Containers[0].Lifecycle
+	if lifecycle == nil || lifecycle.PostStart == nil || lifecycle.PostStart.Exec == nil ||
+		!strings.Contains(strings.Join(lifecycle.PostStart.Exec.Command, " "), "http://127.0.0.1:15000/listeners") {
+		t.Errorf("proxy is missing the post start hook waiting for the listeners: %v", lifecycle)
+	}
+
+	spec = deploymentPodSpec(t, deployTestApp(t, infra, true, appOptions{}))
+	if len(spec.Containers) != 2 || spec.Containers[0].Name != "app" || spec.Containers[1].Lifecycle != nil {
+		t.Errorf("proxy of another app should be injected last without a hook: %v", spec.Containers)
+	}
+}
+
+func TestDeployAppProxyVolumes(t *testing.T) {
+	infra := makeTestInfra()
+	infra.InjectConfig = testInjectConfig()
+
+	volumes := []v1.Volume{{
+		Name:         "extra-certs",
+		VolumeSource: v1.VolumeSource{Secret: &v1.SecretVolumeSource{SecretName: "extra-certs"}},
+	}}
+	mounts := []v1.VolumeMount{{Name: "extra-certs", MountPath: "/etc/extra-certs", ReadOnly: true}}
+	rendered := deployTestApp(t, infra, true, appOptions{proxyVolumes: volumes, proxyVolumeMounts: mounts})
+
+	spec := deploymentPodSpec(t, rendered)
+
+	foundVolume := false
+	for _, volume := range spec.Volumes {
+		if volume.Name == "extra-certs" && volume.Secret != nil && volume.Secret.SecretName == "extra-certs" {
+			foundVolume = true
+		}
+	}
+	if !foundVolume {
+		t.Errorf("pod is missing the custom volume: %v", spec.Volumes)
+	}
+
+	foundMount := false
+	for _, container := range spec.Containers {
+		for _, mount := range container.VolumeMounts {
+			if mount.Name == "extra-certs" {
+				if container.Name != inject.ProxyContainerName || mount.MountPath != "/etc/extra-certs" {
+					t.Errorf("unexpected mount %v in container %s", mount, container.Name)
+				}
+				foundMount = true
+			}
+		}
+	}
+	if !foundMount {
+		t.Errorf("proxy is missing the custom volume mount:\n%s", rendered)
+	}
+}
+
+func TestValidateProxyVolumes(t *testing.T) {
+	volume := v1.Volume{Name: "extra"}
+	for _, c := range []struct {
+		name    string
+		volumes []v1.Volume
+		mounts  []v1.VolumeMount
+		valid   bool
+	}{
+		{"valid", []v1.Volume{volume}, []v1.VolumeMount{{Name: "extra"}}, true},
+		{"duplicate volume", []v1.Volume{volume, volume}, nil, false},
+		{"unnamed volume", []v1.Volume{{}}, nil, false},
+		{"dangling mount", []v1.Volume{volume}, []v1.VolumeMount{{Name: "other"}}, false},
+		{"envoy volume", []v1.Volume{{Name: "istio-envoy"}}, nil, false},
+		{"certs volume", []v1.Volume{volume, {Name: "istio-certs"}}, []v1.VolumeMount{{Name: "istio-certs"}}, false},
+	} {
+		if err := validateProxyVolumes(c.volumes, c.mounts); (err == nil) != c.valid {
+			t.Errorf("%s: got error %v, want valid %t", c.name, err, c.valid)
+		}
+	}
+}
+
+func TestDeployAppSpreadAcrossNodes(t *testing.T) {
+	if rendered := deployTestApp(t, makeTestInfra(), false, appOptions{}); strings.Contains(rendered, "podAntiAffinity:") {
+		t.Errorf("app should not have an anti-affinity by default:\n%s", rendered)
+	}
+
+	rendered := deployTestApp(t, makeTestInfra(), false, appOptions{spreadAcrossNodes: true})
+	affinity := deploymentPodSpec(t, rendered).Affinity
+	if affinity == nil || affinity.PodAntiAffinity == nil ||
+		len(affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution) != 1 {
+		t.Fatalf("app is missing the required anti-affinity:\n%s", rendered)
+	}
+	term := affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution[0]
+	if term.TopologyKey != "kubernetes.io/hostname" || term.LabelSelector.MatchLabels["app"] != "a" {
+		t.Errorf("unexpected anti-affinity term %v", term)
+	}
+}
+
+func TestDeployAppTopologySpread(t *testing.T) {
+	// the vendored pod spec predates topologySpreadConstraints
+	var deployment struct {
+		Spec struct {
+			Template struct {
+				Spec struct {
+					TopologySpreadConstraints []struct {
+						MaxSkew           int    `json:"maxSkew"`
+						TopologyKey       string `json:"topologyKey"`
+						WhenUnsatisfiable string `json:"whenUnsatisfiable"`
+						LabelSelector     struct {
+							MatchLabels map[string]string `json:"matchLabels"`
+						} `json:"labelSelector"`
+					} `json:"topologySpreadConstraints"`
+				} `json:"spec"`
+			} `json:"template"`
+		} `json:"spec"`
+	}
+	if rendered := deployTestApp(t, makeTestInfra(), false, appOptions{}); strings.Contains(rendered, "topologySpreadConstraints:") {
+		t.Errorf("app should not have a topology spread by default:\n%s", rendered)
+	}
+
+	rendered := deployTestApp(t, makeTestInfra(), false, appOptions{topologySpread: "topology.kubernetes.io/zone"})
+	for _, doc := range strings.Split(rendered, "---\n") {
+		if strings.Contains(doc, "kind: Deployment") {
+			if err := yaml.Unmarshal([]byte(doc), &deployment); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	constraints := deployment.Spec.Template.Spec.TopologySpreadConstraints
+	if len(constraints) != 1 {
+		t.Fatalf("app is missing the topology spread constraint:\n%s", rendered)
+	}
+	if c := constraints[0]; c.TopologyKey != "topology.kubernetes.io/zone" || c.MaxSkew != 1 ||
+		c.WhenUnsatisfiable != "DoNotSchedule" || c.LabelSelector.MatchLabels["app"] != "a" {
+		t.Errorf("unexpected topology spread constraint %+v", c)
+	}
+
+	infra := makeTestInfra()
+	infra.InjectConfig = testInjectConfig()
+	if _, err := infra.appYAML("a", "a", 8080, 80, 9090, 90, 7070, 70, "v1", true, false,
+		appOptions{topologySpread: "topology.kubernetes.io/zone"}); err == nil {
+		t.Error("expected an error for a topology spread dropped by kube-inject")
+	}
+}
+
+func TestDeployAppPortNames(t *testing.T) {
+	rendered := deployTestApp(t, makeTestInfra(), false, appOptions{portNames: map[int]string{80: "", 90: "http-sniffed"}})
+	var svc v1.Service
+	for _, doc := range strings.Split(rendered, "---\n") {
+		if strings.Contains(doc, "kind: Service") {
+			if err := yaml.Unmarshal([]byte(doc), &svc); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	names := make(map[int32]string)
+	for _, port := range svc.Spec.Ports {
+		names[port.Port] = port.Name
+	}
+	for port, want := range map[int32]string{80: "port-80", 90: "http-sniffed", 8080: "http-two", 7070: "grpc"} {
+		if names[port] != want {
+			t.Errorf("got name %q for port %d, want %q", names[port], port, want)
+		}
+	}
+
+	infra := makeTestInfra()
+	if _, err := infra.appYAML("a", "a", 8080, 80, 9090, 90, 7070, 70, "v1", false, false,
+		appOptions{portNames: map[int]string{8000: "tcp"}}); err == nil {
+		t.Error("expected an error for an unknown service port")
+	}
+}
+
+func TestDeployAppPorts(t *testing.T) {
+	rendered := deployTestApp(t, makeTestInfra(), false, appOptions{ports: []appPort{
+		{Port: 7071, TargetPort: 71, Protocol: "grpc"},
+		{Port: 9091, Protocol: "tcp"},
+	}})
+	var svc v1.Service
+	for _, doc := range strings.Split(rendered, "---\n") {
+		if strings.Contains(doc, "kind: Service") {
+			if err := yaml.Unmarshal([]byte(doc), &svc); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	names := make(map[int32]string)
+	for _, port := range svc.Spec.Ports {
+		names[port.Port] = port.Name
+	}
+	for port, want := range map[int32]string{7071: "grpc-7071", 9091: "tcp-9091", 7070: "grpc"} {
+		if names[port] != want {
+			t.Errorf("got name %q for port %d, want %q", names[port], port, want)
+		}
+	}
+
+	args := strings.Join(deploymentPodSpec(t, rendered).Containers[0].Args, " ")
+	for _, want := range []string{"--grpc 71", "--port 9091"} {
+		if !strings.Contains(args, want) {
+			t.Errorf("app args %q do not contain %q", args, want)
+		}
+	}
+
+	infra := makeTestInfra()
+	for _, ports := range [][]appPort{
+		{{Port: 7071, Protocol: "udp"}},
+		{{Port: 80, Protocol: "http"}},
+		{{Port: 7071, Protocol: "http"}, {Port: 7071, Protocol: "tcp"}},
+	} {
+		if _, err := infra.appYAML("a", "a", 8080, 80, 9090, 90, 7070, 70, "v1", false, false,
+			appOptions{ports: ports}); err == nil {
+			t.Errorf("expected an error for ports %v", ports)
+		}
+	}
+}
+
+func TestDeployAppLabels(t *testing.T) {
+	rendered := deployTestApp(t, makeTestInfra(), false, appOptions{labels: map[string]string{"role": "frontend"}})
+	want := map[string]string{"app": "a", "version": "v1", "role": "frontend"}
+	if labels := deploymentPodTemplate(t, rendered).Labels; !reflect.DeepEqual(labels, want) {
+		t.Errorf("got pod labels %v, want %v", labels, want)
+	}
+
+	infra := makeTestInfra()
+	if _, err := infra.appYAML("a", "a", 8080, 80, 9090, 90, 7070, 70, "v1", false, false,
+		appOptions{labels: map[string]string{"version": "v2"}}); err == nil {
+		t.Error("expected an error for a label overriding the version")
+	}
+}
+
+func TestDeployAppImage(t *testing.T) {
+	infra := makeTestInfra()
+	infra.Hub, infra.Tag = "istio-hub", "istio-tag"
+	infra.InjectConfig = testInjectConfig()
+	infra.InjectConfig.Params.ProxyImage = inject.ProxyImageName(infra.Hub, infra.Tag, false)
+
+	if rendered := deployTestApp(t, infra, true, appOptions{}); !strings.Contains(rendered, "image: istio-hub/app:istio-tag") {
+		t.Errorf("app image should default to the Istio hub and tag:\n%s", rendered)
+	}
+
+	infra.AppHub, infra.AppTag = "app-hub", "app-tag"
+	rendered := deployTestApp(t, infra, true, appOptions{})
+	for _, want := range []string{"image: app-hub/app:app-tag", "image: " + inject.ProxyImageName("istio-hub", "istio-tag", false)} {
+		if !strings.Contains(rendered, want) {
+			t.Errorf("rendered app is missing %q:\n%s", want, rendered)
+		}
+	}
+}
+
+func TestDeployAppProxyUID(t *testing.T) {
+	defer stubRunInput(func(_, input string) error {
+		t.Errorf("app running as the proxy UID should not be applied:\n%s", input)
+		return nil
+	})()
+
+	infra := makeTestInfra()
+	if err := infra.deployApp("a", "a", 8080, 80, 9090, 90, 7070, 70, "v1", false, false,
+		appOptions{runAsUser: inject.DefaultSidecarProxyUID}); err == nil {
+		t.Error("expected an error for an app running as the proxy UID")
+	}
+}
+
+func TestDeployAppImagePullPolicy(t *testing.T) {
+	infra := makeTestInfra()
+	if rendered := deployTestApp(t, infra, false, appOptions{}); !strings.Contains(rendered, "imagePullPolicy: IfNotPresent") {
+		t.Errorf("rendered app is missing the default pull policy:\n%s", rendered)
+	}
+
+	infra.ImagePullPolicy = "Always"
+	if rendered := deployTestApp(t, infra, false, appOptions{}); !strings.Contains(rendered, "imagePullPolicy: Always") {
+		t.Errorf("rendered app is missing the Always pull policy:\n%s", rendered)
+	}
+}
+
+func TestDeployAppSet(t *testing.T) {
+	nameRex := regexp.MustCompile(`(?m)^  name: (\S+)$`)
+	var deployed []string
+	defer stubRunInput(func(_, input string) error {
+		for _, doc := range strings.Split(input, "---\n") {
+			if strings.Contains(doc, "kind: Deployment") {
+				deployed = append(deployed, nameRex.FindStringSubmatch(doc)[1])
+			}
+		}
+		return nil
+	})()
+
+	infra := makeTestInfra()
+	if err := infra.deployAppSet("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(deployed, want) {
+		t.Errorf("deployed %v, want %v", deployed, want)
+	}
+
+	// a service selects all its deployments
+	deployed = nil
+	if err := infra.deployAppSet("c"); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"c-v1", "c-v2"}; !reflect.DeepEqual(deployed, want) {
+		t.Errorf("deployed %v, want %v", deployed, want)
+	}
+
+	deployed = nil
+	if err := infra.deployAppSet("a", "unknown"); err == nil {
+		t.Error("expected an error for an unknown app")
+	}
+	if len(deployed) != 0 {
+		t.Errorf("no app should be deployed when an app is unknown, deployed %v", deployed)
+	}
+
+	custom := appDefinition{"f", "f", [6]int{80, 8080, 90, 9090, 70, 7070}, "v1", true, false, appOptions{}}
+	if err := infra.addApp(custom); err != nil {
+		t.Fatal(err)
+	}
+	if err := infra.addApp(custom); err == nil {
+		t.Error("expected an error for a duplicate app")
+	}
+	deployed = nil
+	if err := infra.deployApps(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"t", "a", "b", "c-v1", "c-v2", "d", "e", "f"}; !reflect.DeepEqual(deployed, want) {
+		t.Errorf("deployed %v, want %v", deployed, want)
+	}
+}
+
+func TestDeployAppPair(t *testing.T) {
+	nameRex := regexp.MustCompile(`(?m)^  name: (\S+)$`)
+	applied := make(map[string]string)
+	var deleted []string
+	defer stubRunInput(func(command, input string) error {
+		name := nameRex.FindStringSubmatch(input)[1]
+		if strings.HasPrefix(command, "kubectl delete ") {
+			deleted = append(deleted, name)
+		} else {
+			applied[name] = input
+		}
+		return nil
+	})()
+
+	infra := makeTestInfra()
+	infra.InjectConfig = testInjectConfig()
+	infra.SkipControlPlane = true
+	if err := infra.deployAppPair("f", "f", []appPort{{Port: 7071, Protocol: "grpc"}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 2 {
+		t.Fatalf("expected two apps, got %d", len(applied))
+	}
+
+	for name, injected := range map[string]bool{"f-mesh": true, "f-raw": false} {
+		rendered, exists := applied[name]
+		if !exists {
+			t.Errorf("app %s is not deployed", name)
+			continue
+		}
+		if got := strings.Contains(rendered, inject.ProxyContainerName); got != injected {
+			t.Errorf("app %s: got proxy %t, want %t", name, got, injected)
+		}
+		if !strings.Contains(rendered, "name: grpc-7071") {
+			t.Errorf("app %s is missing the grpc port:\n%s", name, rendered)
+		}
+	}
+
+	infra.teardown()
+	if want := []string{"f-raw", "f-mesh"}; !reflect.DeepEqual(deleted, want) {
+		t.Errorf("deleted %v on teardown, want %v", deleted, want)
+	}
+}
+
+func TestTCPAppYAML(t *testing.T) {
+	rendered, err := makeTestInfra().tcpAppYAML("echo-tcp", "echo", 9000, 9001)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	objects := strings.Split(rendered, "\n---\n")
+	var svc v1.Service
+	if err = yaml.Unmarshal([]byte(objects[0]), &svc); err != nil {
+		t.Fatal(err)
+	}
+	if len(svc.Spec.Ports) != 1 || !strings.HasPrefix(svc.Spec.Ports[0].Name, "tcp-") {
+		t.Errorf("expected a single port named tcp-*, got %v", svc.Spec.Ports)
+	}
+	if port := svc.Spec.Ports[0]; port.Port != 9000 || port.TargetPort.IntValue() != 9001 {
+		t.Errorf("got port %d to %s, want 9000 to 9001", port.Port, port.TargetPort.String())
+	}
+}
+
+func TestDeployExternalBackend(t *testing.T) {
+	var applied string
+	defer stubRunInput(func(_, input string) error {
+		applied = input
+		return nil
+	})()
+
+	infra := makeTestInfra()
+	if err := infra.deployExternalBackend("external", "external.app.svc.cluster.local", 8888); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"name: external", "sidecar.istio.io/inject: \"false\"", "containerPort: 8888"} {
+		if !strings.Contains(applied, want) {
+			t.Errorf("backend is missing %q:\n%s", want, applied)
+		}
+	}
+
+	config, exists := infra.config.Get(model.EgressRule.Type, "external", infra.Namespace)
+	if !exists {
+		t.Fatal("egress rule is missing from the store")
+	}
+	rule := config.Spec.(*routingv1.EgressRule)
+	if rule.Destination.Service != "external.app.svc.cluster.local" {
+		t.Errorf("got destination %q, want %q", rule.Destination.Service, "external.app.svc.cluster.local")
+	}
+	if len(rule.Ports) != 1 || rule.Ports[0].Port != 8888 || rule.Ports[0].Protocol != "http" {
+		t.Errorf("got ports %v, want http:8888", rule.Ports)
+	}
+}
+
+func TestRequestWithHeader(t *testing.T) {
+	var commands []string
+	defer stubShell(func(command string) (string, error) {
+		commands = append(commands, command)
+		return "[0] StatusCode=200\n[0 body] ServiceVersion=v2\n", nil
+	})()
+
+	infra := makeTestInfra()
+	infra.apps["a"] = []string{"a-pod"}
+
+	resp := infra.requestWithHeader("a", "http://c/a", "x-special", `v2;q="a&b*"`, 1)
+	if err := resp.expectVersion("v2"); err != nil {
+		t.Error(err)
+	}
+	if len(commands) != 1 || !strings.HasSuffix(commands[0], ` -key x-special -val v2;q="a&b*"`) {
+		t.Errorf("header is not passed verbatim to the client: %v", commands)
+	}
+
+	for _, header := range [][2]string{{"", "v2"}, {"x version", "v2"}, {"version", "v 2"}} {
+		if resp = infra.requestWithHeader("a", "http://c/a", header[0], header[1], 1); len(resp.code) != 0 {
+			t.Errorf("expected an empty response for header %q: %q", header[0], header[1])
+		}
+	}
+	if len(commands) != 1 {
+		t.Errorf("invalid headers should not be sent: %v", commands)
+	}
+}
+
+func TestClientRequestWithOpts(t *testing.T) {
+	var commands []string
+	defer stubShell(func(command string) (string, error) {
+		commands = append(commands, command)
+		return "[0] Url=https://c/a\n[0] TLSHandshake=ok\n[0] StatusCode=200\n", nil
+	})()
+
+	infra := makeTestInfra()
+	infra.apps = map[string][]string{"a": {"a-pod"}}
+	resp := infra.clientRequestWithOpts("a", "https://c/a", 1, clientRequestOpts{clientCert: appCertFile, clientKey: appKeyFile})
+	if len(commands) != 1 || !strings.HasSuffix(commands[0], " -- client -url https://c/a -count 1 -cert /cert.crt -cert-key /cert.key") {
+		t.Errorf("unexpected commands %q", commands)
+	}
+	if !resp.handshakeSucceeded() {
+		t.Errorf("expected a successful handshake, got %v", resp.handshake)
+	}
+
+	if resp = infra.clientRequestWithOpts("a", "https://c/a", 1, clientRequestOpts{clientCert: appCertFile}); len(commands) != 1 {
+		t.Errorf("expected no request without the client key, got %q", commands)
+	}
+	if resp.handshakeSucceeded() {
+		t.Error("expected no handshake without a request")
+	}
+
+	failed := parseResponse("[0] Url=https://c/a\n[0] TLSHandshake=failed\nError Get https://c/a: remote error: tls: bad certificate\n")
+	if failed.handshakeSucceeded() {
+		t.Error("expected a failed handshake")
+	}
+}
+
+func TestClientRequestFromPod(t *testing.T) {
+	var commands []string
+	defer stubShell(func(command string) (string, error) {
+		commands = append(commands, command)
+		return "[0] StatusCode=200\n", nil
+	})()
+
+	infra := makeTestInfra()
+	infra.apps["a"] = []string{"a-pod-0", "a-pod-1"}
+
+	if resp := infra.clientRequestFromPod("a", 1, "http://c/a", 1, ""); len(resp.code) != 1 {
+		t.Errorf("expected a response from the second pod: %v", resp)
+	}
+	if len(commands) != 1 || !strings.HasPrefix(commands[0], "kubectl exec a-pod-1 ") {
+		t.Errorf("request is not made from the second pod: %v", commands)
+	}
+
+	for _, index := range []int{-1, 2} {
+		if resp := infra.clientRequestFromPod("a", index, "http://c/a", 1, ""); len(resp.code) != 0 {
+			t.Errorf("expected an empty response for pod index %d", index)
+		}
+	}
+	if len(commands) != 1 {
+		t.Errorf("out of range pod indices should not be requested: %v", commands)
+	}
+}
+
+func TestSmokeTest(t *testing.T) {
+	infra := makeTestInfra()
+	for _, app := range []string{"a", "b", "c", "t"} {
+		infra.apps[app] = []string{app + "-pod"}
+	}
+
+	var commands []string
+	restore := stubShell(func(command string) (string, error) {
+		commands = append(commands, command)
+		return "[0] StatusCode=200\n", nil
+	})
+	err := infra.smokeTest()
+	restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commands) != 3 {
+		t.Errorf("got %d requests, want 3: %v", len(commands), commands)
+	}
+
+	defer stubShell(func(command string) (string, error) {
+		if strings.Contains(command, "-url http://c/a ") {
+			return "[0] StatusCode=503\n", nil
+		}
+		return "[0] StatusCode=200\n", nil
+	})()
+	if err = infra.smokeTest(); err == nil || !strings.Contains(err.Error(), "http://c/a") {
+		t.Errorf("expected the request to c to fail the smoke test, got %v", err)
+	}
+}
+
+func TestConnectivityMatrix(t *testing.T) {
+	infra := makeTestInfra()
+	apps := []string{"a", "b", "t", "e"}
+	for _, app := range apps {
+		infra.apps[app] = []string{app + "-pod"}
+	}
+
+	var mu sync.Mutex
+	requests := 0
+	defer stubShell(func(command string) (string, error) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		switch {
+		case !strings.Contains(command, " -url http://") || !strings.Contains(command, ":8080/"):
+			return "", fmt.Errorf("unexpected command %q", command)
+		case strings.HasPrefix(command, "kubectl exec t-pod "):
+			// the app without proxy cannot reach the apps requiring mTLS
+			if strings.Contains(command, "http://e:") {
+				return "[0] StatusCode=200\n", nil
+			}
+			return "", errors.New("connection reset by peer")
+		case strings.Contains(command, "http://e:"):
+			return "[0] StatusCode=503\n", nil
+		}
+		return "[0] StatusCode=200\n", nil
+	})()
+
+	got := infra.connectivityMatrix(apps, "8080")
+	want := map[string]map[string]bool{
+		"a": {"b": true, "t": true, "e": false},
+		"b": {"a": true, "t": true, "e": false},
+		"t": {"a": false, "b": false, "e": true},
+		"e": {"a": true, "b": true, "t": true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got matrix %v, want %v", got, want)
+	}
+	if requests != 12 {
+		t.Errorf("got %d requests, want 12", requests)
+	}
+}
+
+func TestCollectControlPlaneLogs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var commands []string
+	defer stubShell(func(command string) (string, error) {
+		commands = append(commands, command)
+		switch {
+		case strings.Contains(command, "-l infra=pilot "):
+			return "istio-pilot-1", nil
+		case strings.Contains(command, "-l app=istio-ca-app "):
+			return "istio-ca-1", nil
+		case strings.Contains(command, "-l istio=sidecar-initializer "):
+			return "istio-sidecar-initializer-1", nil
+		case strings.HasPrefix(command, "kubectl get pods "):
+			return "", nil
+		case strings.HasPrefix(command, "kubectl logs "):
+			return "log of " + strings.Fields(command)[2], nil
+		}
+		return "", fmt.Errorf("unexpected command %q", command)
+	})()
+
+	infra := makeTestInfra()
+	infra.errorLogsDir = dir
+	if err = infra.collectControlPlaneLogs(); err != nil {
+		t.Fatal(err)
+	}
+	if len(commands) != 0 {
+		t.Errorf("logs should not be collected if log checking is disabled: %v", commands)
+	}
+
+	infra.checkLogs = true
+	if err = infra.collectControlPlaneLogs(); err != nil {
+		t.Fatal(err)
+	}
+	for _, pod := range []string{"istio-pilot-1", "istio-ca-1", "istio-sidecar-initializer-1"} {
+		content, readErr := ioutil.ReadFile(filepath.Join(dir, pod+".txt"))
+		if readErr != nil {
+			t.Errorf("missing log of %s: %v", pod, readErr)
+		} else if string(content) != "log of "+pod {
+			t.Errorf("got log %q for %s", content, pod)
+		}
+	}
+	for _, command := range commands {
+		if strings.HasPrefix(command, "kubectl logs ") && strings.Contains(command, "mixer") {
+			t.Errorf("logs of the missing mixer should not be fetched: %s", command)
+		}
+	}
+}
+
+func TestWaitForControlPlaneLog(t *testing.T) {
+	stream := []string{
+		"2018-01-29T18:50:01.104Z\tinfo\tVersion root@71a9470ea93c-docker.io/istio-5f0adbe4",
+		"2018-01-29T18:50:01.317Z\tinfo\tMonitoring server listening on :9093",
+		"2018-01-29T18:50:01.852Z\tinfo\tStarting discovery service at http=:8080 grpc=:15003",
+		"2018-01-29T18:50:02.011Z\tinfo\tstarting gRPC server on :15010",
+	}
+	var polls int
+	defer stubShell(func(command string) (string, error) {
+		switch {
+		case strings.Contains(command, "-l infra=pilot "):
+			// the pod is created on the second poll
+			if polls == 0 {
+				polls++
+				return "", nil
+			}
+			return "istio-pilot-1", nil
+		case strings.HasPrefix(command, "kubectl logs istio-pilot-1 ") && strings.HasSuffix(command, " -c discovery"):
+			polls++
+			if polls > len(stream) {
+				polls = len(stream)
+			}
+			return strings.Join(stream[:polls], "\n"), nil
+		}
+		return "", fmt.Errorf("unexpected command %q", command)
+	})()
+
+	infra := makeTestInfra()
+	grpc := func(line string) bool {
+		return strings.Contains(line, "starting gRPC server")
+	}
+	if err := infra.waitForControlPlaneLog("pilot", grpc, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if polls != len(stream) {
+		t.Errorf("expected the line on poll %d, got %d polls", len(stream), polls)
+	}
+
+	if err := infra.waitForControlPlaneLog("pilot", func(line string) bool {
+		return strings.Contains(line, "panic")
+	}, 0); err == nil {
+		t.Error("expected an error for a missing line")
+	}
+	if err := infra.waitForControlPlaneLog("galley", grpc, time.Second); err == nil {
+		t.Error("expected an error for an unknown component")
+	}
+}
+
+func TestKubeApplyRemote(t *testing.T) {
+	var commands []string
+	defer stubRunInput(func(command, _ string) error {
+		commands = append(commands, command)
+		return nil
+	})()
+
+	infra := makeTestInfra()
+	infra.RemoteKubeconfigs = []string{"/tmp/remote-0", "/tmp/remote-1"}
+
+	if err := infra.kubeApplyRemote(1, "kind: Service", "app"); err != nil {
+		t.Fatal(err)
+	}
+	if len(commands) != 1 || commands[0] != "kubectl apply --kubeconfig /tmp/remote-1 -n app -f -" {
+		t.Errorf("unexpected remote apply commands %v", commands)
+	}
+
+	if err := infra.kubeApplyRemote(2, "kind: Service", "app"); err == nil {
+		t.Error("expected an error for an unknown remote cluster")
+	}
+	if len(commands) != 1 {
+		t.Errorf("unknown remote clusters should not be applied to: %v", commands)
+	}
+}
+
+// failingStore fails all config creations with the error
+type failingStore struct {
+	model.ConfigStore
+	err error
+}
+
+func (s failingStore) Create(model.Config) (string, error) {
+	return "", s.err
+}
+
+func TestApplyConfigExpectReject(t *testing.T) {
+	infra := makeTestInfra()
+
+	infra.config = model.MakeIstioStore(failingStore{
+		ConfigStore: memory.Make(model.IstioConfigTypes),
+		err: errors.New(`admission webhook "pilot.validation.istio.io" denied the request: ` +
+			`configuration is invalid: route weights must sum to 100`),
+	})
+	if err := infra.applyConfigExpectReject("rule-default-route.yaml.tmpl", nil); err != nil {
+		t.Errorf("expected the admission denial to be accepted: %v", err)
+	}
+
+	infra.config = model.MakeIstioStore(failingStore{
+		ConfigStore: memory.Make(model.IstioConfigTypes),
+		err:         errors.New("connection refused"),
+	})
+	if err := infra.applyConfigExpectReject("rule-default-route.yaml.tmpl", nil); err == nil {
+		t.Error("expected an error for a failure other than an admission denial")
+	}
+
+	infra.config = model.MakeIstioStore(memory.Make(model.IstioConfigTypes))
+	if err := infra.applyConfigExpectReject("rule-default-route.yaml.tmpl", nil); err == nil {
+		t.Error("expected an error for an accepted config")
+	}
+}
+
+// rejectingStore rejects all updates of existing configs
+type rejectingStore struct {
+	model.ConfigStore
+	err error
+}
+
+func (s rejectingStore) Update(model.Config) (string, error) {
+	return "", s.err
+}
+
+func TestAssertRollbackOnReject(t *testing.T) {
+	valid := map[string]string{"v1": "75", "v2": "25"}
+	invalid := map[string]string{"v1": "75", "v2": "75"}
+
+	infra := makeTestInfra()
+	infra.config = model.MakeIstioStore(rejectingStore{
+		ConfigStore: memory.Make(model.IstioConfigTypes),
+		err: errors.New(`admission webhook "pilot.validation.istio.io" denied the request: ` +
+			`configuration is invalid: route weights must sum to 100`),
+	})
+	if err := infra.assertRollbackOnReject(model.RouteRule.Type, "default-route", valid, invalid,
+		"rule-weighted-route-data.yaml.tmpl"); err != nil {
+		t.Fatal(err)
+	}
+	config, _ := infra.config.Get(model.RouteRule.Type, "default-route", infra.Namespace)
+	if weight := config.Spec.(*routingv1.RouteRule).Route[1].Weight; weight != 25 {
+		t.Errorf("got weight %d of v2 after the rejected update, want 25", weight)
+	}
+
+	// the memory store accepts the invalid update
+	infra = makeTestInfra()
+	if err := infra.assertRollbackOnReject(model.RouteRule.Type, "default-route", valid, invalid,
+		"rule-weighted-route-data.yaml.tmpl"); err == nil {
+		t.Error("expected an error for an accepted update")
+	}
+}
+
+func TestAssertFieldPreserved(t *testing.T) {
+	infra := makeTestInfra()
+	if err := infra.createOrUpdateConfig("rule-weighted-route.yaml.tmpl", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// a no-op mutation rewriting the rule
+	noop := func() error {
+		return infra.patchConfig(model.RouteRule.Type, "default-route", func(*model.Config) error { return nil })
+	}
+	for path, want := range map[string]string{
+		"route.1.weight":         "25",
+		".destination.name":      "c",
+		"route.0.labels.version": "v1",
+		"route.0.labels":         `{"version":"v1"}`,
+	} {
+		if err := infra.assertFieldPreserved(model.RouteRule.Type, "default-route", path, want, noop); err != nil {
+			t.Errorf("%s: %v", path, err)
+		}
+	}
+
+	clobber := func() error {
+		return infra.patchConfig(model.RouteRule.Type, "default-route", func(config *model.Config) error {
+			config.Spec.(*routingv1.RouteRule).Route[1].Weight = 50
+			return nil
+		})
+	}
+	if err := infra.assertFieldPreserved(model.RouteRule.Type, "default-route", "route.1.weight", "25", clobber); err == nil ||
+		!strings.Contains(err.Error(), "overwritten") {
+		t.Errorf("expected an error for an overwritten field, got %v", err)
+	}
+
+	for _, path := range []string{"route.2.weight", "route.weight", "destination.name.first", "timeout"} {
+		if err := infra.assertFieldPreserved(model.RouteRule.Type, "default-route", path, "", noop); err == nil {
+			t.Errorf("expected an error for the invalid path %s", path)
+		}
+	}
+	if err := infra.assertFieldPreserved(model.RouteRule.Type, "missing", "precedence", "1", noop); err == nil {
+		t.Error("expected an error for a missing config")
+	}
+}
+
+func TestReset(t *testing.T) {
+	infra := makeTestInfra()
+	if err := infra.applyConfigDir("config-dir", map[string]string{"destination": "c"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// configs not created by the harness are left alone
+	external := model.Config{
+		ConfigMeta: model.ConfigMeta{
+			Type:      model.RouteRule.Type,
+			Name:      "external-route",
+			Namespace: infra.Namespace,
+		},
+		Spec: &routingv1.RouteRule{Destination: &routingv1.IstioService{Name: "c"}},
+	}
+	if _, err := infra.config.Create(external); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(infra.createdConfigs) != 2 {
+		t.Errorf("expected two tracked configs, got %v", infra.createdConfigs)
+	}
+	if err := infra.reset(); err != nil {
+		t.Fatal(err)
+	}
+	if len(infra.createdConfigs) != 0 {
+		t.Errorf("tracked configs are not cleared: %v", infra.createdConfigs)
+	}
+
+	configs, err := infra.config.List(model.RouteRule.Type, infra.Namespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) != 1 || configs[0].Name != external.Name {
+		t.Errorf("expected only %s to remain, got %v", external.Name, configs)
+	}
+}
+
+func TestClientLocalhost(t *testing.T) {
+	for _, c := range []struct {
+		port int
+		path string
+		want string
+	}{
+		{8080, "/healthz", "http://127.0.0.1:8080/healthz"},
+		{15000, "stats", "http://127.0.0.1:15000/stats"},
+		{80, "", "http://127.0.0.1:80/"},
+	} {
+		if got := localhostURL(c.port, c.path); got != c.want {
+			t.Errorf("localhostURL(%d, %q) => got %q, want %q", c.port, c.path, got, c.want)
+		}
+	}
+
+	var commands []string
+	defer stubShell(func(command string) (string, error) {
+		commands = append(commands, command)
+		return "[0] StatusCode=200\n", nil
+	})()
+
+	infra := makeTestInfra()
+	infra.apps["a"] = []string{"a-pod"}
+	if resp := infra.clientLocalhost("a", 8080, "/healthz", 1); len(resp.code) != 1 {
+		t.Errorf("expected a response, got %v", resp)
+	}
+	if len(commands) != 1 || !strings.Contains(commands[0], " -- client -url http://127.0.0.1:8080/healthz -count 1") {
+		t.Errorf("unexpected client commands %v", commands)
+	}
+}
+
+func TestPlaintextRejection(t *testing.T) {
+	for _, c := range []struct {
+		fixture, reason string
+		rejected        bool
+	}{
+		{"client-connection-refused.txt", "connection refused", true},
+		{"client-connection-reset.txt", "connection reset by peer", true},
+		{"client-timeout.txt", "", false},
+	} {
+		reason, rejected := plaintextRejection(readTestData(t, c.fixture))
+		if reason != c.reason || rejected != c.rejected {
+			t.Errorf("%s: got %q (%t), want %q (%t)", c.fixture, reason, rejected, c.reason, c.rejected)
+		}
+	}
+}
+
+func TestAssertPlaintextRejected(t *testing.T) {
+	var output string
+	var accepted bool
+	defer stubShell(func(command string) (string, error) {
+		switch {
+		case strings.HasPrefix(command, "kubectl get pod d-pod ") && strings.HasSuffix(command, " -o jsonpath={.status.podIP}"):
+			return "10.0.0.7\n", nil
+		case strings.HasPrefix(command, "kubectl exec t-pod ") && strings.Contains(command, " -c app -- client -url http://10.0.0.7:8080/ -count 1 "):
+			if accepted {
+				return "[0] StatusCode=200\n", nil
+			}
+			return "", fmt.Errorf("command %q failed: %q exit status 1", command, output)
+		}
+		return "", fmt.Errorf("unexpected command %q", command)
+	})()
+
+	infra := makeTestInfra()
+	infra.apps["d"] = []string{"d-pod"}
+	if err := infra.assertPlaintextRejected("d", 8080); err == nil {
+		t.Error("expected an error without the pod of the plaintext client")
+	}
+
+	infra.apps["t"] = []string{"t-pod"}
+	output = readTestData(t, "client-connection-reset.txt")
+	if err := infra.assertPlaintextRejected("d", 8080); err != nil {
+		t.Error(err)
+	}
+	output = readTestData(t, "client-timeout.txt")
+	if err := infra.assertPlaintextRejected("d", 8080); err == nil || !strings.Contains(err.Error(), "without a reset or refused connection") {
+		t.Errorf("expected a timeout not to count as a rejection, got %v", err)
+	}
+	accepted = true
+	if err := infra.assertPlaintextRejected("d", 8080); err == nil || !strings.Contains(err.Error(), "was accepted: [200]") {
+		t.Errorf("expected the accepted request to fail the assertion, got %v", err)
+	}
+}
+
+// generationStore bumps the resource version of the configs on every read
+type generationStore struct {
+	model.ConfigStore
+	gets int
+}
+
+func (s *generationStore) Get(typ, name, namespace string) (*model.Config, bool) {
+	config, exists := s.ConfigStore.Get(typ, name, namespace)
+	if exists {
+		s.gets++
+		config.ResourceVersion = strconv.Itoa(s.gets)
+	}
+	return config, exists
+}
+
+func (s *generationStore) Create(config model.Config) (string, error) {
+	if _, err := s.ConfigStore.Create(config); err != nil {
+		return "", err
+	}
+	return "3", nil
+}
+
+func TestWaitForConfigGeneration(t *testing.T) {
+	infra := makeTestInfra()
+	store := &generationStore{ConfigStore: memory.Make(model.IstioConfigTypes)}
+	infra.config = model.MakeIstioStore(store)
+
+	if err := infra.createOrUpdateConfig("rule-default-route.yaml.tmpl", nil); err != nil {
+		t.Fatal(err)
+	}
+	key := configKey{typ: model.RouteRule.Type, name: "default-route", namespace: infra.Namespace}
+	gen := infra.lastGeneration(key)
+	if gen != 3 {
+		t.Fatalf("got generation %d for the applied config, want 3", gen)
+	}
+
+	store.gets = 0
+	if err := infra.waitForConfigGeneration(key, gen, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if store.gets != 3 {
+		t.Errorf("expected generation %d on the third poll, got %d polls", gen, store.gets)
+	}
+
+	if err := infra.waitForConfigGeneration(key, 100, 10*time.Millisecond); err == nil {
+		t.Error("expected a timeout for a generation never observed")
+	}
+}
+
+func TestSetupSkipControlPlane(t *testing.T) {
+	defer stubClient(
+		&v1.Namespace{ObjectMeta: meta_v1.ObjectMeta{Name: "app"}},
+		&v1.Namespace{ObjectMeta: meta_v1.ObjectMeta{Name: "istio-system"}},
+		&v1.ConfigMap{
+			ObjectMeta: meta_v1.ObjectMeta{Name: "istio", Namespace: "istio-system"},
+			Data:       map[string]string{inject.ConfigMapKey: "authPolicy: NONE"},
+		},
+	)()
+
+	var applied []string
+	defer stubRunInput(func(command, _ string) error {
+		applied = append(applied, command)
+		return nil
+	})()
+	defer stubShell(func(command string) (string, error) {
+		if strings.Contains(command, "-l infra=pilot") {
+			return "istio-pilot-pod", nil
+		}
+		if strings.HasSuffix(command, "/v1/registration") {
+			return "[]", nil
+		}
+		return "", fmt.Errorf("unexpected command %q", command)
+	})()
+
+	infra := makeTestInfra()
+	infra.SkipControlPlane = true
+	if err := infra.setup(); err != nil {
+		t.Fatal(err)
+	}
+	defer infra.cancel()
+
+	// only the headless service is deployed to the app namespace
+	if len(applied) != 1 || !strings.Contains(applied[0], " -n app ") {
+		t.Errorf("expected no control plane deploys, got %v", applied)
+	}
+	if infra.InjectConfig == nil || infra.InjectConfig.Params.Mesh == nil {
+		t.Error("the injection config is not built from the existing mesh config")
+	}
+
+	infra.IstioNamespace = ""
+	if err := infra.setup(); err == nil {
+		t.Error("expected an error without the namespace of the control plane")
+	}
+}
+
+func TestSetupPauseAfterStep(t *testing.T) {
+	defer stubClient(
+		&v1.Namespace{ObjectMeta: meta_v1.ObjectMeta{Name: "app"}},
+		&v1.Namespace{ObjectMeta: meta_v1.ObjectMeta{Name: "istio-system"}},
+		&v1.ConfigMap{
+			ObjectMeta: meta_v1.ObjectMeta{Name: "istio", Namespace: "istio-system"},
+			Data:       map[string]string{inject.ConfigMapKey: "authPolicy: NONE"},
+		},
+	)()
+	defer stubRunInput(func(_, _ string) error { return nil })()
+
+	infra := makeTestInfra()
+	var steps []string
+	infra.PauseAfterStep = func(step string) error {
+		steps = append(steps, step)
+		return nil
+	}
+	if err := infra.setup(); err != nil {
+		t.Fatal(err)
+	}
+	defer infra.cancel()
+	want := []string{"rbac-beta.yaml.tmpl", "config.yaml.tmpl", "pilot.yaml.tmpl", "ca.yaml.tmpl", "headless.yaml.tmpl"}
+	if !reflect.DeepEqual(steps, want) {
+		t.Errorf("got steps %v, want %v", steps, want)
+	}
+
+	// an error aborts the setup
+	steps = nil
+	infra.PauseAfterStep = func(step string) error {
+		steps = append(steps, step)
+		return errors.New("aborted")
+	}
+	if err := infra.setup(); err == nil || err.Error() != "aborted" {
+		t.Errorf("expected the setup to be aborted, got %v", err)
+	}
+	if len(steps) != 1 {
+		t.Errorf("expected the setup to stop after the first step, got steps %v", steps)
+	}
+}
+
+func TestSetupTimings(t *testing.T) {
+	defer stubClient(
+		&v1.Namespace{ObjectMeta: meta_v1.ObjectMeta{Name: "app"}},
+		&v1.Namespace{ObjectMeta: meta_v1.ObjectMeta{Name: "istio-system"}},
+		&v1.ConfigMap{
+			ObjectMeta: meta_v1.ObjectMeta{Name: "istio", Namespace: "istio-system"},
+			Data:       map[string]string{inject.ConfigMapKey: "authPolicy: NONE"},
+		},
+	)()
+	// rbac-beta, config, pilot, ca and headless are applied in order
+	delays := []time.Duration{0, 0, 40 * time.Millisecond, 10 * time.Millisecond, 0}
+	defer stubRunInput(func(_, _ string) error {
+		time.Sleep(delays[0])
+		delays = delays[1:]
+		return nil
+	})()
+
+	infra := makeTestInfra()
+	if err := infra.setup(); err != nil {
+		t.Fatal(err)
+	}
+	defer infra.cancel()
+
+	timings := infra.setupTimings()
+	for _, phase := range []string{"crd", "namespace", "deploy rbac-beta.yaml.tmpl", "deploy headless.yaml.tmpl"} {
+		if _, exists := timings[phase]; !exists {
+			t.Errorf("missing timing of %q in %v", phase, timings)
+		}
+	}
+	if _, exists := timings["initializer wait"]; exists {
+		t.Error("the initializer is not waited for without the initializer")
+	}
+	pilot, ca := timings["deploy pilot.yaml.tmpl"], timings["deploy ca.yaml.tmpl"]
+	if pilot < 40*time.Millisecond || ca < 10*time.Millisecond {
+		t.Errorf("got pilot %v and ca %v, want at least the stubbed delays", pilot, ca)
+	}
+	if pilot <= ca {
+		t.Errorf("expected the pilot deploy (%v) to dominate the ca deploy (%v)", pilot, ca)
+	}
+
+	// the timings are a copy
+	timings["crd"] = time.Hour
+	if infra.setupTimings()["crd"] == time.Hour {
+		t.Error("setupTimings should not expose the recorded timings")
+	}
+}
+
+func TestTopoSortDeploys(t *testing.T) {
+	names := func(steps []deployStep) []string {
+		var out []string
+		for _, step := range steps {
+			out = append(out, step.name)
+		}
+		return out
+	}
+
+	sorted, err := topoSortDeploys([]deployStep{
+		{name: "apps", dependsOn: []string{"initializer", "ca"}},
+		{name: "galley"},
+		{name: "pilot", dependsOn: []string{"galley"}},
+		{name: "ca"},
+		{name: "initializer"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"galley", "pilot", "ca", "initializer", "apps"}; !reflect.DeepEqual(names(sorted), want) {
+		t.Errorf("got order %v, want %v", names(sorted), want)
+	}
+
+	// the control plane is deployed in declaration order
+	infra := makeTestInfra()
+	steps := infra.controlPlaneSteps(func(_, _ string) error { return nil })
+	if sorted, err = topoSortDeploys(steps); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names(sorted), names(steps)) {
+		t.Errorf("got order %v, want %v", names(sorted), names(steps))
+	}
+
+	for name, steps := range map[string][]deployStep{
+		"cycle": {
+			{name: "pilot", dependsOn: []string{"mixer"}},
+			{name: "mixer", dependsOn: []string{"ca"}},
+			{name: "ca", dependsOn: []string{"pilot"}},
+			{name: "zipkin"},
+		},
+		"self":      {{name: "pilot", dependsOn: []string{"pilot"}}},
+		"unknown":   {{name: "pilot", dependsOn: []string{"galley"}}},
+		"duplicate": {{name: "pilot"}, {name: "pilot"}},
+	} {
+		if _, err = topoSortDeploys(steps); err == nil {
+			t.Errorf("%s: expected an error", name)
+		} else if name == "cycle" && !strings.Contains(err.Error(), "[pilot mixer ca]") {
+			t.Errorf("expected the steps of the cycle in the error, got %v", err)
+		}
+	}
+}
+
+func TestRefreshAllApps(t *testing.T) {
+	// a pod of the previous replica set still terminating after a restart
+	terminating := readyPod("a-old-pod", "app", "a")
+	deleted := meta_v1.Now()
+	terminating.DeletionTimestamp = &deleted
+
+	defer stubClient(
+		terminating,
+		readyPod("a-pod", "app", "a"),
+		readyPod("b-pod", "app", "b"),
+		readyPod("c-v1-pod", "app", "c"),
+		readyPod("c-v2-pod", "app", "c"),
+		readyPod("mixer-pod", "istio-system", "mixer"),
+	)()
+
+	infra := makeTestInfra()
+	infra.apps["stale"] = []string{"stale-pod"}
+	if err := infra.refreshAllApps(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]string{
+		"a":     {"a-pod"},
+		"b":     {"b-pod"},
+		"c":     {"c-v1-pod", "c-v2-pod"},
+		"mixer": {"mixer-pod"},
+	}
+	if !reflect.DeepEqual(infra.apps, want) {
+		t.Errorf("got apps %v, want %v", infra.apps, want)
+	}
+}
+
+func TestInjectionPolicy(t *testing.T) {
+	defer stubClient(&v1.Namespace{ObjectMeta: meta_v1.ObjectMeta{Name: "app"}})()
+
+	infra := makeTestInfra()
+	infra.InjectionPolicy = inject.InjectionPolicyDisabled
+	infra.NamespaceInjectionPolicies = map[string]inject.InjectionPolicy{"opt-out": inject.InjectionPolicyEnabled}
+
+	if got := infra.injectionPolicy("app"); got != inject.InjectionPolicyDisabled {
+		t.Errorf("got policy %q for the app namespace, want %q", got, inject.InjectionPolicyDisabled)
+	}
+	if got := infra.injectionPolicy("opt-out"); got != inject.InjectionPolicyEnabled {
+		t.Errorf("got policy %q for the overridden namespace, want %q", got, inject.InjectionPolicyEnabled)
+	}
+
+	if err := infra.labelInjectionPolicy("app"); err != nil {
+		t.Fatal(err)
+	}
+	ns, err := client.CoreV1().Namespaces().Get("app", meta_v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ns.Labels[injectionLabel]; got != string(inject.InjectionPolicyDisabled) {
+		t.Errorf("got namespace label %q, want %q", got, inject.InjectionPolicyDisabled)
+	}
+
+	// apps are not injected in a disabled namespace unless they opt in
+	infra.InjectConfig = &inject.Config{
+		Policy:            infra.injectionPolicy("app"),
+		IncludeNamespaces: []string{v1.NamespaceAll},
+	}
+	if rendered := deployTestApp(t, infra, true, appOptions{}); strings.Contains(rendered, inject.ProxyContainerName) {
+		t.Errorf("app in a disabled namespace has a sidecar:\n%s", rendered)
+	}
+}
+
+// establishedCRD returns the CRD of the config type, established if requested
+func establishedCRD(schema model.ProtoSchema, established bool) *apiextensionsv1beta1.CustomResourceDefinition {
+	definition := &apiextensionsv1beta1.CustomResourceDefinition{
+		ObjectMeta: meta_v1.ObjectMeta{Name: crd.ResourceName(schema.Plural) + "." + model.IstioAPIGroup},
+	}
+	if established {
+		definition.Status.Conditions = []apiextensionsv1beta1.CustomResourceDefinitionCondition{{
+			Type:   apiextensionsv1beta1.Established,
+			Status: apiextensionsv1beta1.ConditionTrue,
+		}}
+	}
+	return definition
+}
+
+func TestWaitForCRDsEstablished(t *testing.T) {
+	infra := makeTestInfra()
+	fakeClient := apiextensionsfake.NewSimpleClientset()
+	for _, schema := range infra.config.ConfigDescriptor() {
+		if _, err := fakeClient.ApiextensionsV1beta1().CustomResourceDefinitions().Create(establishedCRD(schema, false)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	saved := crdClient
+	crdClient = fakeClient
+	defer func() {
+		crdClient = saved
+	}()
+
+	if err := infra.waitForCRDsEstablished(10 * time.Millisecond); err == nil {
+		t.Error("expected a timeout for CRDs which are not established")
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		for _, schema := range infra.config.ConfigDescriptor() {
+			if _, err := fakeClient.ApiextensionsV1beta1().CustomResourceDefinitions().Update(establishedCRD(schema, true)); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	if err := infra.waitForCRDsEstablished(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWaitForConfigPropagationCancelled(t *testing.T) {
+	saved := configPropagationDelay
+	configPropagationDelay = time.Minute
+	defer func() {
+		configPropagationDelay = saved
+	}()
+
+	infra := makeTestInfra()
+	infra.ctx, infra.cancel = context.WithCancel(context.Background())
+
+	done := make(chan error)
+	go func() {
+		done <- infra.waitForConfigPropagation()
+	}()
+	infra.cancel()
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("got error %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelling the context did not abort the wait")
+	}
+}
+
+func TestRetriesCancelled(t *testing.T) {
+	infra := makeTestInfra()
+	infra.ctx, infra.cancel = context.WithCancel(context.Background())
+	infra.cancel()
+
+	var attempts int
+	err := infra.repeat(func() error {
+		attempts++
+		return errors.New("not yet")
+	}, 3, time.Minute)
+	if err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) || attempts != 1 {
+		t.Errorf("expected the cancellation after the first attempt, got %v after %d attempts", err, attempts)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- infra.parallel(map[string]func() status{
+			"again": func() status { return errAgain },
+		})
+	}()
+	select {
+	case err = <-done:
+		if err != context.Canceled {
+			t.Errorf("got error %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelling the context did not abort the retries")
+	}
+}
+
+func TestInjectTemplateOverride(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inject-template")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	sidecarTemplate := `containers:
+- name: istio-proxy
+  image: "{{.ProxyImage}}"
+  args: ["proxy", "sidecar", "--experimental"]
+`
+	path := filepath.Join(dir, "sidecar.yaml.tmpl")
+	if err = ioutil.WriteFile(path, []byte(sidecarTemplate), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	infra := makeTestInfra()
+	if got, _ := infra.injectTemplate(); got != "" {
+		t.Errorf("expected no template without an override, got %q", got)
+	}
+
+	infra.InjectTemplateOverride = path
+	config := testInjectConfig()
+	if config.Template, err = infra.injectTemplate(); err != nil {
+		t.Fatal(err)
+	}
+	rendered, err := fill("initializer-configmap.yaml.tmpl", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var configMap v1.ConfigMap
+	if err = yaml.Unmarshal([]byte(rendered), &configMap); err != nil {
+		t.Fatal(err)
+	}
+	var initializerConfig inject.Config
+	if err = yaml.Unmarshal([]byte(configMap.Data[inject.InitializerConfigMapKey]), &initializerConfig); err != nil {
+		t.Fatal(err)
+	}
+	if initializerConfig.Template != sidecarTemplate {
+		t.Errorf("got template %q in the initializer configmap, want %q", initializerConfig.Template, sidecarTemplate)
+	}
+
+	// the proxy overrides are only honored by the built-in sidecar
+	infra.InjectConfig = config
+	if _, err = infra.appYAML("a", "a", 8080, 80, 9090, 90, 7070, 70, "v1", true, false,
+		appOptions{proxyLogLevel: "debug"}); err == nil || !strings.Contains(err.Error(), "proxyLogLevel") {
+		t.Errorf("expected an error for a proxy log level ignored by the template, got %v", err)
+	}
+	infra.ProxyImagePullPolicy = "Always"
+	if _, err = infra.injectTemplate(); err == nil {
+		t.Error("expected an error for a proxy pull policy ignored by the template")
+	}
+	infra.ProxyImagePullPolicy = ""
+
+	if err = ioutil.WriteFile(path, []byte("{{.ProxyImage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = infra.injectTemplate(); err == nil {
+		t.Error("expected an error for an invalid template")
+	}
+	infra.InjectTemplateOverride = filepath.Join(dir, "missing.yaml.tmpl")
+	if _, err = infra.injectTemplate(); err == nil {
+		t.Error("expected an error for a missing template")
+	}
+}
+
+func TestTeardownApps(t *testing.T) {
+	defer stubClient(
+		&v1.Namespace{ObjectMeta: meta_v1.ObjectMeta{Name: "app"}},
+		&v1.Namespace{ObjectMeta: meta_v1.ObjectMeta{Name: "istio-system"}},
+	)()
+
+	infra := makeTestInfra()
+	infra.namespaceCreated = true
+	infra.apps["a"] = []string{"a-pod"}
+	if err := infra.createOrUpdateConfig("rule-default-route.yaml.tmpl", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := infra.teardownApps(); err != nil {
+		t.Fatal(err)
+	}
+	if len(infra.createdConfigs) != 0 {
+		t.Errorf("tracked configs are not deleted: %v", infra.createdConfigs)
+	}
+	if configs, err := infra.config.List(model.RouteRule.Type, "app"); err != nil || len(configs) != 0 {
+		t.Errorf("expected the configs of the app namespace to be deleted, got %v (%v)", configs, err)
+	}
+	if len(infra.apps) != 0 {
+		t.Errorf("expected no apps, got %v", infra.apps)
+	}
+	if _, err := client.CoreV1().Namespaces().Get("app", meta_v1.GetOptions{}); err == nil {
+		t.Error("expected the app namespace to be deleted")
+	}
+	if infra.Namespace != "" || infra.namespaceCreated {
+		t.Errorf("app namespace %q is still recorded", infra.Namespace)
+	}
+
+	// the control plane is left as is
+	if infra.IstioNamespace != "istio-system" {
+		t.Errorf("got Istio namespace %q, want istio-system", infra.IstioNamespace)
+	}
+	if _, err := client.CoreV1().Namespaces().Get("istio-system", meta_v1.GetOptions{}); err != nil {
+		t.Errorf("expected the Istio namespace to be kept: %v", err)
+	}
+}
+
+func TestRunIDResourceNames(t *testing.T) {
+	infra := makeTestInfra()
+	infra.RunID = "3f2a9c1e"
+	resources, err := templateResources("rbac-beta.yaml.tmpl", infra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "ClusterRoleBinding istio-pilot-admin-role-binding-istio-system-3f2a9c1e"
+	if !containsString(resources, want) {
+		t.Errorf("resources %v do not contain %q", resources, want)
+	}
+	for _, resource := range resources {
+		if !strings.HasSuffix(resource, "-3f2a9c1e") {
+			t.Errorf("cluster-scoped resource %s is missing the run ID", resource)
+		}
+	}
+
+	rendered, err := fill("rbac-beta.yaml.tmpl", infra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(rendered, "  name: istio-pilot-istio-system-3f2a9c1e\n  apiGroup:") {
+		t.Errorf("role binding does not refer to the role of the run:\n%s", rendered)
+	}
+
+	if resources, err = templateResources("initializer-config.yaml.tmpl", infra); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"InitializerConfiguration istio-sidecar-3f2a9c1e"}; !reflect.DeepEqual(resources, want) {
+		t.Errorf("got resources %v, want %v", resources, want)
+	}
+
+	infra.UseAdmissionWebhook = true
+	if rendered, err = fill("pilot.yaml.tmpl", infra); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(rendered, "- --admission-webhook-name=pilot-webhook-3f2a9c1e.istio.io\n") {
+		t.Errorf("admission webhook of pilot is missing the run ID:\n%s", rendered)
+	}
+
+	id, err := newRunID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other, _ := newRunID(); id == "" || id == other {
+		t.Errorf("expected distinct run IDs, got %q twice", id)
+	}
+}
+
+func TestTeardownPlan(t *testing.T) {
+	defer stubRunInput(func(command, _ string) error {
+		return fmt.Errorf("unexpected command %q", command)
+	})()
+
+	infra := makeTestInfra()
+	infra.istioNamespaceCreated = true
+	if err := infra.createOrUpdateConfig("rule-default-route.yaml.tmpl", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the app namespace was not created by the harness
+	plan, err := infra.teardownPlan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Namespace istio-system", "ClusterRoleBinding istio-pilot-admin-role-binding-istio-system"} {
+		if !containsString(plan, want) {
+			t.Errorf("plan %v does not contain %q", plan, want)
+		}
+	}
+	for _, unwanted := range []string{"Namespace app", "route-rule app/default-route"} {
+		if containsString(plan, unwanted) {
+			t.Errorf("plan %v contains %q of the pre-existing namespace", plan, unwanted)
+		}
+	}
+
+	infra.namespaceCreated = true
+	if plan, err = infra.teardownPlan(); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Namespace app", "route-rule app/default-route"} {
+		if !containsString(plan, want) {
+			t.Errorf("plan %v does not contain %q", plan, want)
+		}
+	}
+
+	// nothing is deleted
+	if _, exists := infra.config.Get(model.RouteRule.Type, "default-route", infra.Namespace); !exists {
+		t.Error("config was deleted by the plan")
+	}
+}
+
+func TestCustomCARoot(t *testing.T) {
+	defer stubClient()()
+	certPEM := []byte(readTestData(t, "custom-ca-cert.pem"))
+	keyPEM := []byte(readTestData(t, "custom-ca-key.pem"))
+	_, serverCertPEM, serverKeyPEM, err := createWebhookCerts("istio-ca", "istio-system")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	infra := makeTestInfra()
+	infra.CustomCARoot = &CARoot{CertPEM: certPEM, KeyPEM: serverKeyPEM}
+	if err = infra.createCARootSecret(); err == nil {
+		t.Error("expected an error for a key not matching the certificate")
+	}
+	infra.CustomCARoot = &CARoot{CertPEM: serverCertPEM, KeyPEM: serverKeyPEM}
+	if err = infra.createCARootSecret(); err == nil || !strings.Contains(err.Error(), "cannot sign certificates") {
+		t.Errorf("expected an error for a server certificate, got %v", err)
+	}
+
+	infra.CustomCARoot = &CARoot{CertPEM: certPEM, KeyPEM: keyPEM}
+	if err = infra.createCARootSecret(); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := client.CoreV1().Secrets("istio-system").Get(caRootSecretName, meta_v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(secret.Data["ca-cert.pem"]) != string(certPEM) || string(secret.Data["ca-key.pem"]) != string(keyPEM) {
+		t.Errorf("secret does not hold the custom root: %v", secret.Data)
+	}
+
+	rendered, err := fill("ca.yaml.tmpl", infra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := deploymentPodSpec(t, rendered)
+	if len(spec.Volumes) != 1 || spec.Volumes[0].Secret == nil || spec.Volumes[0].Secret.SecretName != caRootSecretName {
+		t.Errorf("expected the CA to mount the secret %s, got volumes %v", caRootSecretName, spec.Volumes)
+	}
+	if args := strings.Join(spec.Containers[0].Args, " "); !strings.Contains(args, "--signing-cert=/etc/cacerts/ca-cert.pem") {
+		t.Errorf("expected the CA to sign with the custom root, got args %q", args)
+	}
+
+	infra.SkipControlPlane = true
+	infra.teardown()
+	if _, err = client.CoreV1().Secrets("istio-system").Get(caRootSecretName, meta_v1.GetOptions{}); err == nil {
+		t.Error("expected the secret to be deleted on teardown")
+	}
+
+	infra = makeTestInfra()
+	if rendered, err = fill("ca.yaml.tmpl", infra); err != nil {
+		t.Fatal(err)
+	}
+	if spec = deploymentPodSpec(t, rendered); len(spec.Volumes) != 0 || len(spec.Containers[0].Command) != 0 {
+		t.Errorf("expected the self-signed CA without a custom root, got %v", spec)
+	}
+}
+
+func TestApplyConfigCheckWarnings(t *testing.T) {
+	infra := makeTestInfra()
+	data := map[string]string{"destination": "c"}
+
+	warnings, err := infra.applyConfigCheckWarnings("rule-route-subsets.yaml.tmpl", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("expected no warnings for valid subsets, got %v", warnings)
+	}
+
+	var analyzed []string
+	defer func(saved func(model.IstioConfigStore, []model.ConfigMeta) []string) { configAnalyzer = saved }(configAnalyzer)
+	configAnalyzer = func(_ model.IstioConfigStore, metas []model.ConfigMeta) []string {
+		for _, meta := range metas {
+			analyzed = append(analyzed, meta.Key())
+		}
+		return []string{"route-c: deprecated field"}
+	}
+	if warnings, err = infra.applyConfigCheckWarnings("rule-route-subsets.yaml.tmpl", data); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"route-c: deprecated field"}; !reflect.DeepEqual(warnings, want) {
+		t.Errorf("got warnings %v, want %v", warnings, want)
+	}
+	if len(analyzed) != 2 {
+		t.Errorf("expected the route rule and the destination rule to be analyzed, got %v", analyzed)
+	}
+}
+
+func TestAnalyzeConfigs(t *testing.T) {
+	infra := makeTestInfra()
+	if err := infra.applyConfig("rule-route-subsets.yaml.tmpl", map[string]string{"destination": "c"}); err != nil {
+		t.Fatal(err)
+	}
+
+	rule := model.Config{
+		ConfigMeta: model.ConfigMeta{Type: model.V1alpha2RouteRule.Type, Name: "route-v3", Namespace: infra.Namespace},
+		Spec: &routingv2.RouteRule{
+			Hosts: []string{"c"},
+			Http: []*routingv2.HTTPRoute{{Route: []*routingv2.DestinationWeight{
+				{Destination: &routingv2.Destination{Name: "c", Subset: "v1"}, Weight: 50},
+				{Destination: &routingv2.Destination{Name: "c", Subset: "v3"}, Weight: 50},
+				{Destination: &routingv2.Destination{Name: "d", Subset: "v1"}},
+			}}},
+		},
+	}
+	if _, err := infra.config.Create(rule); err != nil {
+		t.Fatal(err)
+	}
+
+	warnings := analyzeConfigs(infra.config, []model.ConfigMeta{rule.ConfigMeta})
+	if len(warnings) != 2 || !strings.Contains(warnings[0], "subset v3") || !strings.Contains(warnings[1], "subset v1 of d") {
+		t.Errorf("expected warnings for subset v3 of c and for d, got %v", warnings)
+	}
+}
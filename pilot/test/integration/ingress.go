@@ -17,6 +17,7 @@ package main
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	// TODO(nmittler): Remove this
 	_ "github.com/golang/glog"
@@ -33,6 +34,9 @@ type ingress struct {
 
 const (
 	ingressServiceName = "istio-ingress"
+
+	// gatewayAddressTimeout bounds the wait for a load balancer to be provisioned
+	gatewayAddressTimeout = 5 * time.Minute
 )
 
 func (t *ingress) String() string {
@@ -121,12 +125,49 @@ func (t *ingress) run() error {
 		})(req.dst, req.url, req.host)
 	}
 
-	if err := parallel(funcs); err != nil {
+	if err := t.parallel(funcs); err != nil {
 		return err
 	}
 	return t.logs.check(t.infra)
 }
 
+// gatewayRequest sends requests from "t" to the external address of the ingress
+// service with the Host header set to the gateway host, so that the requests are
+// routed by the host based rules of the gateway. The client sends a single header,
+// extra flags setting another one are rejected.
+func (infra *infra) gatewayRequest(gatewayHost, path string, count int, extra string) response {
+	if gatewayHost == "" || strings.ContainsAny(gatewayHost, " \t\r\n") {
+		log.Errorf("invalid gateway host %q", gatewayHost)
+		return response{}
+	}
+	if setsHeader(extra) {
+		log.Errorf("extra client flags %q override the Host header of the gateway", extra)
+		return response{}
+	}
+
+	address, err := infra.waitForGatewayAddress(ingressServiceName, gatewayAddressTimeout)
+	if err != nil {
+		log.Errorf("ingress address is not ready: %v", err)
+		return response{}
+	}
+	return infra.clientRequest("t", fmt.Sprintf("http://%s%s", address, path), count,
+		strings.TrimSpace(fmt.Sprintf("-key Host -val %s %s", gatewayHost, extra)))
+}
+
+// setsHeader returns whether the client flags set the header of the requests
+func setsHeader(flags string) bool {
+	for _, flag := range strings.Fields(flags) {
+		if !strings.HasPrefix(flag, "-") {
+			continue
+		}
+		name := strings.SplitN(strings.TrimLeft(flag, "-"), "=", 2)[0]
+		if name == "key" || name == "val" {
+			return true
+		}
+	}
+	return false
+}
+
 // checkRouteRule verifies that version splitting is applied to ingress paths
 func (t *ingress) checkRouteRule() status {
 	url := fmt.Sprintf("http://%s.%s/c", ingressServiceName, t.IstioNamespace)
@@ -0,0 +1,221 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"k8s.io/api/core/v1"
+
+	"istio.io/istio/pilot/test/util"
+	"istio.io/istio/pkg/log"
+)
+
+// kubectl based helpers
+
+var (
+	// shell and runInput run the kubectl commands, tests replace them with stubs
+	shell    = util.Shell
+	runInput = util.RunInput
+
+	// pollInterval is the delay between two attempts of the polling helpers
+	pollInterval = time.Second
+
+	// kubectlAttempts and kubectlBackoff bound the retries of the kubectl commands
+	// failing on transient errors, the backoff doubles after each attempt
+	kubectlAttempts = 5
+	kubectlBackoff  = time.Second
+
+	// transientKubectlErrors are the outputs of kubectl failing on an unavailable
+	// or overloaded API server
+	transientKubectlErrors = []string{
+		"connection refused",
+		"connection reset by peer",
+		"TLS handshake timeout",
+		"i/o timeout",
+		"Too Many Requests",
+		"the server has received too many requests",
+		"the server is currently unable to handle the request",
+	}
+
+	// rejectedKubectlErrors are the outputs of kubectl failing on the resources
+	// themselves, retrying them does not help
+	rejectedKubectlErrors = []string{
+		"error validating",
+		"is invalid",
+		"denied the request",
+	}
+)
+
+// retryableKubectl runs the kubectl command, e.g. "apply", with the yaml input in
+// the namespace, retrying with backoff while it fails on transient errors. Retried
+// deletes ignore the resources already deleted by a failed attempt.
+func retryableKubectl(args, input, namespace string) error {
+	command := fmt.Sprintf("kubectl %s --kubeconfig %s -n %s -f -", args, kubeconfig, namespace)
+	attempt := command
+	return util.Retry(kubectlAttempts, kubectlBackoff, func() (bool, error) {
+		err := runInput(attempt, input)
+		if args == "delete" {
+			attempt = command + " --ignore-not-found"
+		}
+		return err != nil && isTransientKubectlError(err), err
+	})
+}
+
+// isTransientKubectlError returns whether the kubectl command failed on the API
+// server rather than on the resources, validation errors are never transient
+func isTransientKubectlError(err error) bool {
+	for _, pattern := range rejectedKubectlErrors {
+		if strings.Contains(err.Error(), pattern) {
+			return false
+		}
+	}
+	for _, pattern := range transientKubectlErrors {
+		if strings.Contains(err.Error(), pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// podIP returns the IP of the pod in the app namespace
+func (infra *infra) podIP(pod string) (string, error) {
+	ip, err := shell(fmt.Sprintf("kubectl get pod %s --kubeconfig %s -n %s -o jsonpath={.status.podIP}",
+		pod, kubeconfig, infra.Namespace))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(ip), nil
+}
+
+// waitForGatewayAddress polls the service in the Istio namespace until a load
+// balancer IP or hostname is assigned and returns it. NodePort services fall
+// back to the address of a node and the node port.
+func (infra *infra) waitForGatewayAddress(service string, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		address, err := infra.gatewayAddress(service)
+		if err != nil {
+			log.Infof("Failed to get the address of service %s: %v", service, err)
+		} else if address != "" {
+			log.Infof("Service %s has address %s", service, address)
+			return address, nil
+		}
+
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("timed out after %v waiting for the address of service %s", timeout, service)
+		}
+		if err = infra.sleep(pollInterval); err != nil {
+			return "", err
+		}
+	}
+}
+
+// gatewayAddress returns the external address of the service or an empty string
+// if none is assigned yet
+func (infra *infra) gatewayAddress(service string) (string, error) {
+	out, err := shell(fmt.Sprintf("kubectl get svc %s --kubeconfig %s -n %s -o json",
+		service, kubeconfig, infra.IstioNamespace))
+	if err != nil {
+		return "", err
+	}
+
+	var svc v1.Service
+	if err = json.Unmarshal([]byte(out), &svc); err != nil {
+		return "", err
+	}
+
+	for _, ingress := range svc.Status.LoadBalancer.Ingress {
+		if ingress.IP != "" {
+			return ingress.IP, nil
+		}
+		if ingress.Hostname != "" {
+			return ingress.Hostname, nil
+		}
+	}
+
+	if svc.Spec.Type == v1.ServiceTypeNodePort {
+		return infra.nodePortAddress(svc)
+	}
+	return "", nil
+}
+
+// nodePortAddress returns "host:port" of the first node port of the service
+func (infra *infra) nodePortAddress(svc v1.Service) (string, error) {
+	var nodePort int32
+	for _, port := range svc.Spec.Ports {
+		if port.NodePort != 0 {
+			nodePort = port.NodePort
+			break
+		}
+	}
+	if nodePort == 0 {
+		return "", nil
+	}
+
+	out, err := shell(fmt.Sprintf("kubectl get nodes --kubeconfig %s -o json", kubeconfig))
+	if err != nil {
+		return "", err
+	}
+
+	var nodes v1.NodeList
+	if err = json.Unmarshal([]byte(out), &nodes); err != nil {
+		return "", err
+	}
+
+	// prefer external addresses over internal ones
+	for _, addressType := range []v1.NodeAddressType{v1.NodeExternalIP, v1.NodeInternalIP} {
+		for _, node := range nodes.Items {
+			for _, address := range node.Status.Addresses {
+				if address.Type == addressType && address.Address != "" {
+					return fmt.Sprintf("%s:%d", address.Address, nodePort), nil
+				}
+			}
+		}
+	}
+	return "", nil
+}
+
+// blockEgressFromApp applies a NetworkPolicy denying egress from the pods of the
+// app to the CIDR, simulating a partial network partition. The returned restore
+// function deletes the policy.
+func (infra *infra) blockEgressFromApp(app, destCIDR string) (restore func() error, err error) {
+	if _, _, err = net.ParseCIDR(destCIDR); err != nil {
+		return nil, err
+	}
+
+	yaml, err := fill("network-policy-block-egress.yaml.tmpl", map[string]string{
+		"name": "block-egress-" + app,
+		"app":  app,
+		"cidr": destCIDR,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = infra.kubeApply(yaml, infra.Namespace); err != nil {
+		return nil, err
+	}
+	log.Infof("Blocked egress from %s to %s", app, destCIDR)
+
+	return func() error {
+		log.Infof("Restoring egress from %s to %s", app, destCIDR)
+		return infra.kubeDelete(yaml, infra.Namespace)
+	}, nil
+}
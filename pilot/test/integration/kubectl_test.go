@@ -0,0 +1,319 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ghodss/yaml"
+	networking "k8s.io/api/networking/v1"
+)
+
+// stubShell replaces the shell with a stub and returns a function restoring it
+func stubShell(f func(command string) (string, error)) func() {
+	saved := shell
+	shell = f
+	return func() {
+		shell = saved
+	}
+}
+
+// stubRunInput replaces runInput with a stub and returns a function restoring it
+func stubRunInput(f func(command, input string) error) func() {
+	saved := runInput
+	runInput = f
+	return func() {
+		runInput = saved
+	}
+}
+
+const (
+	pendingServiceJSON = `{"spec": {"type": "LoadBalancer"}, "status": {"loadBalancer": {}}}`
+	readyServiceJSON   = `{"spec": {"type": "LoadBalancer"}, "status": {"loadBalancer": {"ingress": [{"ip": "35.1.2.3"}]}}}`
+)
+
+func TestWaitForGatewayAddress(t *testing.T) {
+	polls := 0
+	defer stubShell(func(command string) (string, error) {
+		if !strings.HasPrefix(command, "kubectl get svc istio-ingress ") {
+			return "", fmt.Errorf("unexpected command %q", command)
+		}
+		polls++
+		if polls <= 2 {
+			return pendingServiceJSON, nil
+		}
+		return readyServiceJSON, nil
+	})()
+
+	infra := makeTestInfra()
+	address, err := infra.waitForGatewayAddress("istio-ingress", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address != "35.1.2.3" {
+		t.Errorf("got address %q, want %q", address, "35.1.2.3")
+	}
+	if polls != 3 {
+		t.Errorf("got %d polls, want 3", polls)
+	}
+}
+
+func TestWaitForGatewayAddressTimeout(t *testing.T) {
+	defer stubShell(func(string) (string, error) {
+		return pendingServiceJSON, nil
+	})()
+
+	infra := makeTestInfra()
+	if _, err := infra.waitForGatewayAddress("istio-ingress", 10*time.Millisecond); err == nil {
+		t.Error("expected a timeout error")
+	}
+}
+
+func TestWaitForGatewayAddressNodePort(t *testing.T) {
+	defer stubShell(func(command string) (string, error) {
+		if strings.HasPrefix(command, "kubectl get nodes") {
+			return `{"items": [{"status": {"addresses": [
+				{"type": "InternalIP", "address": "10.0.0.4"},
+				{"type": "ExternalIP", "address": "104.1.2.3"}]}}]}`, nil
+		}
+		return `{"spec": {"type": "NodePort", "ports": [{"name": "http", "port": 80, "nodePort": 31380}]}}`, nil
+	})()
+
+	infra := makeTestInfra()
+	address, err := infra.waitForGatewayAddress("istio-ingress", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address != "104.1.2.3:31380" {
+		t.Errorf("got address %q, want %q", address, "104.1.2.3:31380")
+	}
+}
+
+func TestGatewayRequest(t *testing.T) {
+	var request string
+	defer stubShell(func(command string) (string, error) {
+		if strings.HasPrefix(command, "kubectl get svc") {
+			return readyServiceJSON, nil
+		}
+		request = command
+		return "StatusCode=200\n", nil
+	})()
+
+	infra := makeTestInfra()
+	infra.apps["t"] = []string{"t-pod"}
+	resp := infra.gatewayRequest("foo.bar.com", "/foo", 1, "")
+	if len(resp.code) != 1 || resp.code[0] != httpOk {
+		t.Errorf("got codes %v, want [%s]", resp.code, httpOk)
+	}
+	if !strings.HasSuffix(request, "-url http://35.1.2.3/foo -count 1 -key Host -val foo.bar.com") {
+		t.Errorf("request %q does not target the gateway with the host override", request)
+	}
+
+	request = ""
+	if resp = infra.gatewayRequest("foo bar", "/foo", 1, ""); len(resp.code) != 0 || request != "" {
+		t.Errorf("expected an empty response without a request for an invalid host, got %v", request)
+	}
+
+	if resp = infra.gatewayRequest("foo.bar.com", "/foo", 1, "-cert-key /etc/key.pem"); len(resp.code) != 1 {
+		t.Errorf("expected a response for extra flags without a header, got %v", request)
+	}
+	for _, extra := range []string{"-key Host -val other.com", "--val=other.com", "-qps 10 -key x-user"} {
+		request = ""
+		if resp = infra.gatewayRequest("foo.bar.com", "/foo", 1, extra); len(resp.code) != 0 || request != "" {
+			t.Errorf("%s: expected an empty response without a request for a header override, got %v", extra, request)
+		}
+	}
+}
+
+func TestBlockEgressFromApp(t *testing.T) {
+	var commands, inputs []string
+	defer stubRunInput(func(command, input string) error {
+		commands = append(commands, command)
+		inputs = append(inputs, input)
+		return nil
+	})()
+
+	infra := makeTestInfra()
+	restore, err := infra.blockEgressFromApp("c", "10.20.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commands) != 1 || !strings.HasPrefix(commands[0], "kubectl apply ") ||
+		!strings.Contains(commands[0], "-n "+infra.Namespace+" ") {
+		t.Fatalf("unexpected commands %v", commands)
+	}
+
+	var policy networking.NetworkPolicy
+	if err = yaml.Unmarshal([]byte(inputs[0]), &policy); err != nil {
+		t.Fatal(err)
+	}
+	if policy.Name != "block-egress-c" {
+		t.Errorf("got policy name %q, want %q", policy.Name, "block-egress-c")
+	}
+	if got := policy.Spec.PodSelector.MatchLabels["app"]; got != "c" {
+		t.Errorf("got pod selector app=%q, want app=c", got)
+	}
+	if len(policy.Spec.PolicyTypes) != 1 || policy.Spec.PolicyTypes[0] != networking.PolicyTypeEgress {
+		t.Errorf("got policy types %v, want [Egress]", policy.Spec.PolicyTypes)
+	}
+	if len(policy.Spec.Egress) != 1 || len(policy.Spec.Egress[0].To) != 1 || policy.Spec.Egress[0].To[0].IPBlock == nil {
+		t.Fatalf("got egress rules %v, want a single ipBlock", policy.Spec.Egress)
+	}
+	if except := policy.Spec.Egress[0].To[0].IPBlock.Except; len(except) != 1 || except[0] != "10.20.0.0/16" {
+		t.Errorf("got excepted CIDRs %v, want [10.20.0.0/16]", except)
+	}
+
+	if err = restore(); err != nil {
+		t.Fatal(err)
+	}
+	if len(commands) != 2 || !strings.HasPrefix(commands[1], "kubectl delete ") || inputs[1] != inputs[0] {
+		t.Errorf("restore did not delete the policy: %v", commands)
+	}
+}
+
+func TestBlockEgressFromAppInvalidCIDR(t *testing.T) {
+	defer stubRunInput(func(string, string) error {
+		t.Error("no policy should be applied")
+		return nil
+	})()
+
+	infra := makeTestInfra()
+	if _, err := infra.blockEgressFromApp("c", "10.20.0.0"); err == nil {
+		t.Error("expected an error for an invalid CIDR")
+	}
+}
+
+func TestDeletePod(t *testing.T) {
+	var command string
+	defer stubShell(func(c string) (string, error) {
+		command = c
+		return "", nil
+	})()
+
+	infra := makeTestInfra()
+	if err := infra.deletePod("a", 0, defaultGracePeriod); err == nil {
+		t.Error("expected an error for an app without pods")
+	}
+
+	infra.apps["a"] = []string{"a-pod-1", "a-pod-2"}
+	for _, c := range []struct {
+		gracePeriod time.Duration
+		want        string
+	}{
+		{defaultGracePeriod, "kubectl delete pod a-pod-2 --kubeconfig " + kubeconfig + " -n app"},
+		{0, "kubectl delete pod a-pod-2 --kubeconfig " + kubeconfig + " -n app --grace-period=0 --force"},
+		{90 * time.Second, "kubectl delete pod a-pod-2 --kubeconfig " + kubeconfig + " -n app --grace-period=90"},
+		{1500 * time.Millisecond, "kubectl delete pod a-pod-2 --kubeconfig " + kubeconfig + " -n app --grace-period=2"},
+	} {
+		if err := infra.deletePod("a", 1, c.gracePeriod); err != nil {
+			t.Fatal(err)
+		}
+		if command != c.want {
+			t.Errorf("grace period %v: got command %q, want %q", c.gracePeriod, command, c.want)
+		}
+	}
+
+	if err := infra.deletePod("a", 2, 0); err == nil {
+		t.Error("expected an error for a pod index out of range")
+	}
+}
+
+func TestRetryableKubectlTransient(t *testing.T) {
+	var commands []string
+	failures := 2
+	defer stubRunInput(func(command, input string) error {
+		commands = append(commands, command)
+		if failures > 0 {
+			failures--
+			return fmt.Errorf("command %q failed: %q exit status 1", command,
+				"Unable to connect to the server: net/http: TLS handshake timeout")
+		}
+		return nil
+	})()
+
+	infra := makeTestInfra()
+	if err := infra.kubeApply("kind: Service", "app"); err != nil {
+		t.Fatal(err)
+	}
+	want := "kubectl apply --kubeconfig " + kubeconfig + " -n app -f -"
+	if len(commands) != 3 || commands[2] != want {
+		t.Errorf("expected 3 attempts of %q, got %q", want, commands)
+	}
+
+	// the attempts are bounded
+	commands = nil
+	failures = kubectlAttempts + 1
+	if err := infra.kubeDelete("kind: Service", "app"); err == nil || !strings.Contains(err.Error(), "TLS handshake timeout") {
+		t.Errorf("expected the last transient error, got %v", err)
+	}
+	if len(commands) != kubectlAttempts {
+		t.Errorf("got %d attempts, want %d", len(commands), kubectlAttempts)
+	}
+
+	// the failed attempt may have deleted some of the resources
+	commands = nil
+	failures = 1
+	if err := infra.kubeDelete("kind: Service", "app"); err != nil {
+		t.Fatal(err)
+	}
+	want = "kubectl delete --kubeconfig " + kubeconfig + " -n app -f -"
+	if expected := []string{want, want + " --ignore-not-found"}; !reflect.DeepEqual(commands, expected) {
+		t.Errorf("got commands %q, want %q", commands, expected)
+	}
+}
+
+func TestIsTransientKubectlError(t *testing.T) {
+	for _, c := range []struct {
+		output string
+		want   bool
+	}{
+		{`Internal error occurred: failed calling admission webhook "pilot.validation.istio.io": ` +
+			`Post https://istio-pilot.istio-system:443/admitpilot: dial tcp 10.0.0.1:443: connect: connection refused`, true},
+		{`Error from server: admission webhook "pilot.validation.istio.io" denied the request: i/o timeout`, false},
+		{`Error from server (NotFound): services "a" not found`, false},
+	} {
+		if got := isTransientKubectlError(fmt.Errorf("exit status 1: %s", c.output)); got != c.want {
+			t.Errorf("%s: got transient %t, want %t", c.output, got, c.want)
+		}
+	}
+}
+
+func TestRetryableKubectlValidationError(t *testing.T) {
+	var output string
+	attempts := 0
+	defer stubRunInput(func(command, _ string) error {
+		attempts++
+		return fmt.Errorf("command %q failed: %q exit status 1", command, output)
+	})()
+
+	for _, output = range []string{
+		`error: error validating "STDIN": error validating data: unknown field "replica"`,
+		`The Deployment "a" is invalid: spec.template.metadata.labels: Invalid value`,
+		`Error from server: admission webhook "pilot.validation.istio.io" denied the request: i/o timeout`,
+		`Error from server (NotFound): services "a" not found`,
+	} {
+		attempts = 0
+		if err := retryableKubectl("apply", "kind: Service", "app"); err == nil {
+			t.Errorf("%s: expected an error", output)
+		}
+		if attempts != 1 {
+			t.Errorf("%s: got %d attempts, want no retry", output, attempts)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// metrics collected by the harness and exported for CI dashboards
+
+// metricsFileRex matches the runs of characters replaced in the metrics file names
+var metricsFileRex = regexp.MustCompile(`[^a-z0-9]+`)
+
+// metricsPercentiles are the exported percentiles of the request latencies
+var metricsPercentiles = []float64{50, 90, 99}
+
+// metricsReport is the JSON document written by exportMetrics. CI dashboards
+// trend it across runs, so fields may be added but not renamed or removed.
+type metricsReport struct {
+	// Name of the infrastructure
+	Name string `json:"name"`
+	// Timestamp of the export
+	Timestamp time.Time `json:"timestamp"`
+	// SetupSeconds are the durations of the setup steps keyed by step
+	SetupSeconds map[string]float64 `json:"setupSeconds"`
+	// Readiness is the readiness timeline of the app pods
+	Readiness []podReadiness `json:"readiness"`
+	// LatencyMillis are the latency percentiles keyed by request and percentile, e.g. "p99"
+	LatencyMillis map[string]map[string]float64 `json:"latencyMillis"`
+	// ProxyStats are the last stats read from the app sidecars keyed by app
+	ProxyStats map[string]map[string]int `json:"proxyStats"`
+}
+
+// podReadiness is the time a pod took from its creation to become ready
+type podReadiness struct {
+	Pod          string  `json:"pod"`
+	App          string  `json:"app"`
+	ReadySeconds float64 `json:"readySeconds"`
+}
+
+// recordSetupDuration records the duration of a setup step
+func (infra *infra) recordSetupDuration(step string, d time.Duration) {
+	infra.metricsMutex.Lock()
+	defer infra.metricsMutex.Unlock()
+	if infra.metrics.SetupSeconds == nil {
+		infra.metrics.SetupSeconds = make(map[string]float64)
+	}
+	infra.metrics.SetupSeconds[step] = d.Seconds()
+}
+
+// recordLatencies records the latency percentiles of the requests
+func (infra *infra) recordLatencies(name string, rs responses) {
+	percentiles := make(map[string]float64)
+	for p, d := range rs.latencyPercentiles(metricsPercentiles...) {
+		percentiles[fmt.Sprintf("p%g", p)] = float64(d) / float64(time.Millisecond)
+	}
+
+	infra.metricsMutex.Lock()
+	defer infra.metricsMutex.Unlock()
+	if infra.metrics.LatencyMillis == nil {
+		infra.metrics.LatencyMillis = make(map[string]map[string]float64)
+	}
+	infra.metrics.LatencyMillis[name] = percentiles
+}
+
+// recordProxyStats records the stats read from the app sidecar
+func (infra *infra) recordProxyStats(app string, stats map[string]int) {
+	infra.metricsMutex.Lock()
+	defer infra.metricsMutex.Unlock()
+	if infra.metrics.ProxyStats == nil {
+		infra.metrics.ProxyStats = make(map[string]map[string]int)
+	}
+	infra.metrics.ProxyStats[app] = stats
+}
+
+// recordReadiness records the readiness timeline of the pods in the app namespace
+func (infra *infra) recordReadiness() error {
+	pods, err := client.CoreV1().Pods(infra.Namespace).List(meta_v1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	infra.metricsMutex.Lock()
+	defer infra.metricsMutex.Unlock()
+	infra.metrics.Readiness = readinessTimeline(pods.Items)
+	return nil
+}
+
+// readinessTimeline returns the readiness of the ready pods in the order they
+// became ready
+func readinessTimeline(pods []v1.Pod) []podReadiness {
+	var out []podReadiness
+	for _, pod := range pods {
+		for _, cond := range pod.Status.Conditions {
+			if cond.Type != v1.PodReady || cond.Status != v1.ConditionTrue {
+				continue
+			}
+			out = append(out, podReadiness{
+				Pod:          pod.Name,
+				App:          pod.Labels["app"],
+				ReadySeconds: cond.LastTransitionTime.Sub(pod.CreationTimestamp.Time).Seconds(),
+			})
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].ReadySeconds < out[j].ReadySeconds })
+	return out
+}
+
+// exportMetrics writes the metrics collected so far as a JSON document
+func (infra *infra) exportMetrics(path string) error {
+	// the sections share their maps with the recorders, so marshal under the lock
+	infra.metricsMutex.Lock()
+	report := infra.metrics
+	report.Name = infra.Name
+	report.Timestamp = time.Now().UTC()
+	// empty sections are exported as such rather than null
+	if report.SetupSeconds == nil {
+		report.SetupSeconds = map[string]float64{}
+	}
+	if report.Readiness == nil {
+		report.Readiness = []podReadiness{}
+	}
+	if report.LatencyMillis == nil {
+		report.LatencyMillis = map[string]map[string]float64{}
+	}
+	if report.ProxyStats == nil {
+		report.ProxyStats = map[string]map[string]int{}
+	}
+
+	out, err := json.MarshalIndent(report, "", "  ")
+	infra.metricsMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, out, 0644)
+}
+
+// metricsFileName returns the name of the metrics file of the infrastructure,
+// e.g. "default-infra-metrics.json" for "(default infra)"
+func metricsFileName(name string) string {
+	return strings.Trim(metricsFileRex.ReplaceAllString(strings.ToLower(name), "-"), "-") + "-metrics.json"
+}
@@ -0,0 +1,123 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// readyPodAfter returns a pod of the app which became ready after the delay
+func readyPodAfter(name, app string, delay time.Duration) *v1.Pod {
+	created := time.Date(2018, 1, 29, 18, 0, 0, 0, time.UTC)
+	pod := readyPod(name, "app", app)
+	pod.CreationTimestamp = meta_v1.NewTime(created)
+	pod.Status.Conditions = []v1.PodCondition{
+		{Type: v1.PodScheduled, Status: v1.ConditionTrue, LastTransitionTime: meta_v1.NewTime(created)},
+		{Type: v1.PodReady, Status: v1.ConditionTrue, LastTransitionTime: meta_v1.NewTime(created.Add(delay))},
+	}
+	return pod
+}
+
+func TestExportMetrics(t *testing.T) {
+	defer stubClient(
+		readyPodAfter("b-pod", "b", 20*time.Second),
+		readyPodAfter("a-pod", "a", 12*time.Second),
+		readyPod("c-pod", "app", "c"),
+	)()
+
+	infra := makeTestInfra()
+	infra.Name = "(default infra)"
+	infra.recordSetupDuration("setup", 90*time.Second)
+	infra.recordLatencies("ramp a http://c", responses{parseResponse("[0] Latency=10ms\n[1] Latency=30ms\n")})
+	infra.recordProxyStats("a", parseStats("cluster_manager.cds.update_success: 3\n"))
+	if err := infra.recordReadiness(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, metricsFileName(infra.Name))
+	if err = infra.exportMetrics(path); err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Base(path) != "default-infra-metrics.json" {
+		t.Errorf("got metrics file %s", filepath.Base(path))
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report metricsReport
+	if err = json.Unmarshal(data, &report); err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Name != "(default infra)" || report.Timestamp.IsZero() {
+		t.Errorf("got name %q and timestamp %v", report.Name, report.Timestamp)
+	}
+	if want := map[string]float64{"setup": 90}; !reflect.DeepEqual(report.SetupSeconds, want) {
+		t.Errorf("got setup durations %v, want %v", report.SetupSeconds, want)
+	}
+	wantReadiness := []podReadiness{{Pod: "a-pod", App: "a", ReadySeconds: 12}, {Pod: "b-pod", App: "b", ReadySeconds: 20}}
+	if !reflect.DeepEqual(report.Readiness, wantReadiness) {
+		t.Errorf("got readiness %v, want %v", report.Readiness, wantReadiness)
+	}
+	if want := map[string]float64{"p50": 10, "p90": 30, "p99": 30}; !reflect.DeepEqual(report.LatencyMillis["ramp a http://c"], want) {
+		t.Errorf("got latencies %v, want %v", report.LatencyMillis, want)
+	}
+	if got := report.ProxyStats["a"]["cluster_manager.cds.update_success"]; got != 3 {
+		t.Errorf("got proxy stats %v", report.ProxyStats)
+	}
+}
+
+func TestExportMetricsEmpty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "metrics.json")
+	if err = makeTestInfra().exportMetrics(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// the sections of the schema are present even without metrics
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sections map[string]json.RawMessage
+	if err = json.Unmarshal(data, &sections); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"setupSeconds", "readiness", "latencyMillis", "proxyStats"} {
+		if raw, ok := sections[name]; !ok || string(raw) == "null" {
+			t.Errorf("section %s is missing in %s", name, data)
+		}
+	}
+}
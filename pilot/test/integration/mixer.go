@@ -0,0 +1,300 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"istio.io/istio/pilot/platform/kube/inject"
+	"istio.io/istio/pkg/log"
+)
+
+// utilities managing the configuration of Mixer
+
+const (
+	// mixerMonitoringPort is the port of the self-monitoring endpoints of Mixer
+	mixerMonitoringPort = 9093
+
+	// mixerPrometheusPort is the port where the Prometheus adapter of Mixer exposes
+	// the telemetry metrics
+	mixerPrometheusPort = 42422
+)
+
+var (
+	// mixerReadyTimeout bounds the wait for Mixer to serve after its deployment
+	mixerReadyTimeout = 2 * time.Minute
+
+	// mixerConfigTimeout bounds the wait for Mixer to load applied adapter configs
+	mixerConfigTimeout = time.Minute
+
+	// mixerSnapshotRex matches the log of Mixer publishing a new config snapshot
+	mixerSnapshotRex = regexp.MustCompile(`Published snapshot\[(\d+)\]`)
+
+	// mixerMetricsTimeout bounds the wait for the telemetry of the requests to be
+	// reported to Mixer
+	mixerMetricsTimeout = time.Minute
+)
+
+// deployMixerAdapter applies the adapter, handler, instance and rule configs of
+// the template into the Istio namespace, where Mixer reads them, and waits for
+// Mixer to publish a config snapshot including them. The adapter CRDs must be
+// installed in the cluster. The configs are deleted on teardown.
+func (infra *infra) deployMixerAdapter(inFile string, data map[string]string) error {
+	if !infra.Mixer {
+		return fmt.Errorf("cannot deploy %s without Mixer", inFile)
+	}
+	yaml, err := fill(inFile, data)
+	if err != nil {
+		return err
+	}
+
+	before, err := infra.mixerSnapshot()
+	if err != nil {
+		return err
+	}
+	if err = infra.kubeApply(yaml, infra.IstioNamespace); err != nil {
+		return err
+	}
+	infra.deferCleanup(func() error {
+		return infra.kubeDelete(yaml, infra.IstioNamespace)
+	})
+	return infra.waitForMixerSnapshot(before, mixerConfigTimeout)
+}
+
+// mixerPod returns the name of the Mixer pod
+func (infra *infra) mixerPod() (string, error) {
+	pod, err := shell(fmt.Sprintf("kubectl get pods --kubeconfig %s -n %s -l app=mixer -o jsonpath={.items[0].metadata.name}",
+		kubeconfig, infra.IstioNamespace))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(pod), nil
+}
+
+// mixerRequest fetches a path from the self-monitoring endpoints of Mixer. The
+// request is issued from the proxy container of the Mixer pod, which shares its
+// network, and fails on an error status.
+func (infra *infra) mixerRequest(path string) (string, error) {
+	return infra.mixerPortRequest(mixerMonitoringPort, path)
+}
+
+// mixerPortRequest fetches a path from a port of the Mixer pod
+func (infra *infra) mixerPortRequest(port int, path string) (string, error) {
+	pod, err := infra.mixerPod()
+	if err != nil {
+		return "", err
+	}
+	return shell(fmt.Sprintf("kubectl exec %s --kubeconfig %s -n %s -c %s -- curl -sf http://localhost:%d%s",
+		pod, kubeconfig, infra.IstioNamespace, inject.ProxyContainerName, port, path))
+}
+
+// waitForMixer polls the version endpoint of Mixer until it serves, so that
+// telemetry assertions do not race against the startup of Mixer
+func (infra *infra) waitForMixer() error {
+	timeout := mixerReadyTimeout
+	deadline := time.Now().Add(timeout)
+	for {
+		version, err := infra.mixerRequest("/version")
+		if err == nil && strings.TrimSpace(version) != "" {
+			log.Infof("Mixer is ready: %s", strings.TrimSpace(version))
+			return nil
+		}
+		log.Infof("Mixer is not ready yet: %v", err)
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("mixer in namespace %s not ready after %v, last error: %v", infra.IstioNamespace, timeout, err)
+		}
+		if err = infra.sleep(pollInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// mixerSnapshot returns the id of the last config snapshot published by Mixer,
+// or -1 if none is published yet
+func (infra *infra) mixerSnapshot() (int, error) {
+	pod, err := infra.mixerPod()
+	if err != nil {
+		return 0, err
+	}
+	logs, err := shell(fmt.Sprintf("kubectl logs %s --kubeconfig %s -n %s -c mixer",
+		pod, kubeconfig, infra.IstioNamespace))
+	if err != nil {
+		return 0, err
+	}
+	return parseMixerSnapshot(logs), nil
+}
+
+// parseMixerSnapshot returns the highest config snapshot id in the Mixer logs, -1 if none
+func parseMixerSnapshot(logs string) int {
+	last := -1
+	for _, match := range mixerSnapshotRex.FindAllStringSubmatch(logs, -1) {
+		if id, err := strconv.Atoi(match[1]); err == nil && id > last {
+			last = id
+		}
+	}
+	return last
+}
+
+// waitForMixerSnapshot polls the Mixer logs until a config snapshot newer than
+// the given one is published
+func (infra *infra) waitForMixerSnapshot(after int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		snapshot, err := infra.mixerSnapshot()
+		if err != nil {
+			log.Infof("Failed to get the Mixer config snapshot: %v", err)
+		} else if snapshot > after {
+			log.Infof("Mixer published config snapshot %d", snapshot)
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %v waiting for Mixer to publish a config snapshot after %d", timeout, after)
+		}
+		if err = infra.sleep(pollInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// assertMetricLabels polls the metrics exposed by the Prometheus adapter of Mixer
+// until a sample of the metric, e.g. istio_request_count, carries the labels, e.g.
+// source_service, destination_service and response_code. The error details the
+// labels of the closest sample.
+func (infra *infra) assertMetricLabels(metricName string, wantLabels map[string]string) error {
+	timeout := mixerMetricsTimeout
+	deadline := time.Now().Add(timeout)
+	for {
+		metrics, err := infra.mixerPortRequest(mixerPrometheusPort, "/metrics")
+		if err == nil {
+			if err = checkMetricLabels(parseMetricSamples(metrics, metricName), metricName, wantLabels); err == nil {
+				return nil
+			}
+		}
+		log.Infof("Metric %s does not carry the labels yet: %v", metricName, err)
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %v waiting for the labels of metric %s: %v", timeout, metricName, err)
+		}
+		if err = infra.sleep(pollInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// parseMetricSamples returns the label sets of the samples of the metric in the
+// Prometheus text exposition format
+func parseMetricSamples(metrics, metricName string) []map[string]string {
+	var samples []map[string]string
+	for _, line := range strings.Split(metrics, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		end := strings.IndexAny(line, "{ ")
+		if end < 0 || line[:end] != metricName {
+			continue
+		}
+		labels := map[string]string{}
+		if line[end] == '{' {
+			var ok bool
+			if labels, ok = parseMetricLabels(line[end+1:]); !ok {
+				log.Infof("Skipping malformed sample %q", line)
+				continue
+			}
+		}
+		samples = append(samples, labels)
+	}
+	return samples
+}
+
+// parseMetricLabels parses the labels of a sample up to the closing brace, e.g.
+// `code="200",path="/a\"b"} 3`, unescaping the label values
+func parseMetricLabels(in string) (map[string]string, bool) {
+	labels := make(map[string]string)
+	for {
+		in = strings.TrimLeft(in, " ,")
+		if strings.HasPrefix(in, "}") {
+			return labels, true
+		}
+		eq := strings.Index(in, "=\"")
+		if eq < 0 {
+			return nil, false
+		}
+		name := strings.TrimSpace(in[:eq])
+		in = in[eq+2:]
+
+		var value bytes.Buffer
+		closed := false
+		for i := 0; i < len(in); i++ {
+			switch c := in[i]; {
+			case c == '\\' && i+1 < len(in):
+				i++
+				if in[i] == 'n' {
+					value.WriteByte('\n')
+				} else {
+					value.WriteByte(in[i])
+				}
+			case c == '"':
+				in, closed = in[i+1:], true
+			default:
+				value.WriteByte(c)
+			}
+			if closed {
+				break
+			}
+		}
+		if !closed {
+			return nil, false
+		}
+		labels[name] = value.String()
+	}
+}
+
+// checkMetricLabels checks that one of the samples of the metric carries the
+// labels, or details the mismatches of the sample matching most labels
+func checkMetricLabels(samples []map[string]string, metricName string, wantLabels map[string]string) error {
+	if len(samples) == 0 {
+		return fmt.Errorf("metric %s not found", metricName)
+	}
+
+	var closest []string
+	for _, labels := range samples {
+		var mismatches []string
+		for name, want := range wantLabels {
+			if got, exists := labels[name]; !exists {
+				mismatches = append(mismatches, fmt.Sprintf("missing label %s", name))
+			} else if got != want {
+				mismatches = append(mismatches, fmt.Sprintf("label %s is %q, want %q", name, got, want))
+			}
+		}
+		if len(mismatches) == 0 {
+			return nil
+		}
+		if closest == nil || len(mismatches) < len(closest) {
+			closest = mismatches
+		}
+	}
+	sort.Strings(closest)
+	return fmt.Errorf("none of the %d samples of metric %s carries the labels, closest sample: %s",
+		len(samples), metricName, strings.Join(closest, ", "))
+}
@@ -0,0 +1,186 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+const mixerLogs = `2018-01-16T10:21:43.512Z	info	Config controller has started with 12 config elements
+2018-01-16T10:21:43.513Z	info	Published snapshot[2] with 3 rules, 4 handlers, previously 0 rules
+2018-01-16T10:24:02.171Z	info	Publishing 2 events
+2018-01-16T10:24:02.172Z	info	Published snapshot[3] with 4 rules, 5 handlers, previously 3 rules
+`
+
+func TestParseMixerSnapshot(t *testing.T) {
+	if got := parseMixerSnapshot(mixerLogs); got != 3 {
+		t.Errorf("got snapshot %d, want 3", got)
+	}
+	if got := parseMixerSnapshot("Config controller has started with 0 config elements"); got != -1 {
+		t.Errorf("got snapshot %d without a published snapshot, want -1", got)
+	}
+}
+
+func TestDeployMixerAdapter(t *testing.T) {
+	logs := mixerLogs
+	defer stubShell(func(command string) (string, error) {
+		switch {
+		case strings.Contains(command, " -n istio-system -l app=mixer "):
+			return "istio-mixer-pod", nil
+		case strings.HasPrefix(command, "kubectl logs istio-mixer-pod ") && strings.Contains(command, " -n istio-system -c mixer"):
+			return logs, nil
+		}
+		return "", fmt.Errorf("unexpected command %q", command)
+	})()
+
+	var applied []string
+	defer stubRunInput(func(command, input string) error {
+		applied = append(applied, command)
+		// Mixer loads the configs on the next poll
+		logs += "2018-01-16T10:30:00.000Z	info	Published snapshot[4] with 5 rules, 6 handlers, previously 4 rules\n"
+		return nil
+	})()
+
+	infra := makeTestInfra()
+	data := map[string]string{"destination": "c", "namespace": infra.Namespace}
+	if err := infra.deployMixerAdapter("mixer-denier.yaml.tmpl", data); err == nil {
+		t.Error("expected an error without Mixer")
+	}
+
+	infra.Mixer = true
+	if err := infra.deployMixerAdapter("mixer-denier.yaml.tmpl", data); err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 1 || !strings.HasPrefix(applied[0], "kubectl apply ") || !strings.Contains(applied[0], " -n istio-system ") {
+		t.Fatalf("expected the adapter config to be applied into the Istio namespace, got %q", applied)
+	}
+	if strings.Contains(applied[0], " -n app ") {
+		t.Errorf("adapter config should not be applied into the app namespace: %q", applied[0])
+	}
+
+	infra.SkipControlPlane = true
+	infra.teardown()
+	if len(applied) != 2 || !strings.HasPrefix(applied[1], "kubectl delete ") || !strings.Contains(applied[1], " -n istio-system ") {
+		t.Errorf("expected the adapter config to be deleted from the Istio namespace on teardown, got %q", applied)
+	}
+}
+
+func TestWaitForMixer(t *testing.T) {
+	polls := 0
+	defer stubShell(func(command string) (string, error) {
+		switch {
+		case strings.Contains(command, " -l app=mixer "):
+			return "istio-mixer-pod", nil
+		case strings.HasPrefix(command, "kubectl exec istio-mixer-pod ") && strings.HasSuffix(command, ":9093/version"):
+			polls++
+			if polls <= 2 {
+				return "", errors.New("exit status 7")
+			}
+			return "0.5.0-b6f9c7a9", nil
+		}
+		return "", fmt.Errorf("unexpected command %q", command)
+	})()
+
+	infra := makeTestInfra()
+	if err := infra.waitForMixer(); err != nil {
+		t.Fatal(err)
+	}
+	if polls != 3 {
+		t.Errorf("got %d polls, want 3", polls)
+	}
+}
+
+func TestWaitForMixerTimeout(t *testing.T) {
+	defer stubShell(func(command string) (string, error) {
+		return "", errors.New("exit status 7")
+	})()
+	timeout := mixerReadyTimeout
+	mixerReadyTimeout = 10 * time.Millisecond
+	defer func() { mixerReadyTimeout = timeout }()
+
+	err := makeTestInfra().waitForMixer()
+	if err == nil || !strings.Contains(err.Error(), "not ready after") {
+		t.Errorf("expected a timeout error, got %v", err)
+	}
+}
+
+func TestParseMetricSamples(t *testing.T) {
+	metrics := readTestData(t, "mixer-metrics.txt")
+	samples := parseMetricSamples(metrics, "istio_request_count")
+	if len(samples) != 3 {
+		t.Fatalf("got %d samples, want 3: %v", len(samples), samples)
+	}
+	if samples[1]["response_code"] != "503" || samples[1]["destination_version"] != "v2" {
+		t.Errorf("unexpected labels %v", samples[1])
+	}
+	if got := parseMetricSamples(metrics, "istio_request_duration"); len(got) != 0 {
+		t.Errorf("expected no samples of the histogram name, got %v", got)
+	}
+	if got := parseMetricSamples(metrics, "istio_tcp_bytes_sent"); len(got) != 1 || got[0]["note"] != `a "quoted"\path` {
+		t.Errorf("label values are not unescaped: %v", got)
+	}
+
+	want := map[string]string{
+		"source_service":      "a.app.svc.cluster.local",
+		"destination_service": "c.app.svc.cluster.local",
+		"response_code":       "503",
+	}
+	if err := checkMetricLabels(samples, "istio_request_count", want); err != nil {
+		t.Error(err)
+	}
+	want["response_code"] = "200"
+	want["destination_version"] = "v2"
+	err := checkMetricLabels(samples, "istio_request_count", want)
+	if err == nil || !strings.HasSuffix(err.Error(), `closest sample: label response_code is "503", want "200"`) {
+		t.Errorf("expected the mismatches of the closest sample, got %v", err)
+	}
+	if err = checkMetricLabels(nil, "istio_request_count", want); err == nil || err.Error() != "metric istio_request_count not found" {
+		t.Errorf("expected a missing metric, got %v", err)
+	}
+}
+
+func TestAssertMetricLabels(t *testing.T) {
+	metrics := ""
+	defer stubShell(func(command string) (string, error) {
+		switch {
+		case strings.Contains(command, " -n istio-system -l app=mixer "):
+			return "istio-mixer-pod", nil
+		case strings.HasPrefix(command, "kubectl exec istio-mixer-pod ") && strings.HasSuffix(command, " -- curl -sf http://localhost:42422/metrics"):
+			// the requests are reported on the next scrape
+			scraped := metrics
+			metrics = readTestData(t, "mixer-metrics.txt")
+			return scraped, nil
+		}
+		return "", fmt.Errorf("unexpected command %q", command)
+	})()
+
+	infra := makeTestInfra()
+	want := map[string]string{"source_service": "a.app.svc.cluster.local", "response_code": "200"}
+	if err := infra.assertMetricLabels("istio_request_count", want); err != nil {
+		t.Error(err)
+	}
+
+	saved := mixerMetricsTimeout
+	mixerMetricsTimeout = 0
+	defer func() { mixerMetricsTimeout = saved }()
+	want["response_code"] = "201"
+	if err := infra.assertMetricLabels("istio_request_count", want); err == nil || !strings.Contains(err.Error(), `label response_code is "200", want "201"`) {
+		t.Errorf("expected a mismatched response code, got %v", err)
+	}
+}
@@ -0,0 +1,671 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	meshconfig "istio.io/api/mesh/v1alpha1"
+	"istio.io/istio/pilot/model"
+	"istio.io/istio/pilot/platform/kube/inject"
+	"istio.io/istio/pilot/proxy/envoy"
+	"istio.io/istio/pkg/log"
+)
+
+// utilities inspecting the configuration served by Pilot
+
+const (
+	// pilotDiscoveryPort is the plain text port of the Pilot discovery service
+	pilotDiscoveryPort = 8080
+)
+
+// TLS modes of the clusters
+var (
+	tlsModeDisable = "DISABLE"
+	tlsModeSimple  = "SIMPLE"
+	tlsModeMutual  = meshconfig.MeshConfig_MUTUAL_TLS.String()
+)
+
+// ClusterSummary describes a cluster served to a sidecar
+type ClusterSummary struct {
+	Name     string
+	Type     string
+	LbPolicy string
+	TLSMode  string
+}
+
+// pilotRequest fetches a path from the Pilot discovery service. The request is
+// issued from the proxy container of the Pilot pod, which shares its network.
+func (infra *infra) pilotRequest(path string) (string, error) {
+	pod, err := shell(fmt.Sprintf("kubectl get pods --kubeconfig %s -n %s -l infra=pilot -o jsonpath={.items[0].metadata.name}",
+		kubeconfig, infra.IstioNamespace))
+	if err != nil {
+		return "", err
+	}
+
+	return shell(fmt.Sprintf("kubectl exec %s --kubeconfig %s -n %s -c %s -- curl -s http://localhost:%d%s",
+		strings.TrimSpace(pod), kubeconfig, infra.IstioNamespace, inject.ProxyContainerName, pilotDiscoveryPort, path))
+}
+
+// proxyNode returns the service cluster and the service node identifying the
+// sidecar of the first app pod in discovery requests
+func (infra *infra) proxyNode(app string) (cluster, node string, err error) {
+	if len(infra.apps[app]) == 0 {
+		return "", "", fmt.Errorf("missing pod names for app %q", app)
+	}
+	return infra.podNode(app, infra.apps[app][0])
+}
+
+// podNode returns the service cluster and the service node identifying the
+// sidecar of the app pod in discovery requests
+func (infra *infra) podNode(app, pod string) (cluster, node string, err error) {
+	ip, err := infra.podIP(pod)
+	if err != nil {
+		return "", "", err
+	}
+
+	// the injected proxy uses the app label as the service cluster
+	node = model.Node{
+		Type:      model.Sidecar,
+		IPAddress: ip,
+		ID:        pod + "." + infra.Namespace,
+		Domain:    infra.Namespace + ".svc.cluster.local",
+	}.ServiceNode()
+	return app, node, nil
+}
+
+// proxyClusters returns the summaries of the clusters (CDS) served to the app
+// sidecar sorted by name
+func (infra *infra) proxyClusters(app string) ([]ClusterSummary, error) {
+	cluster, node, err := infra.proxyNode(app)
+	if err != nil {
+		return nil, err
+	}
+
+	cds, err := infra.pilotRequest(fmt.Sprintf("/v1/clusters/%s/%s", cluster, node))
+	if err != nil {
+		return nil, err
+	}
+	return parseClusters(cds)
+}
+
+// parseClusters parses a CDS response into cluster summaries sorted by name
+func parseClusters(cds string) ([]ClusterSummary, error) {
+	var resp struct {
+		Clusters []struct {
+			Name       string `json:"name"`
+			Type       string `json:"type"`
+			LbType     string `json:"lb_type"`
+			SSLContext *struct {
+				CertChainFile string `json:"cert_chain_file"`
+			} `json:"ssl_context"`
+		} `json:"clusters"`
+	}
+	if err := json.Unmarshal([]byte(cds), &resp); err != nil {
+		return nil, fmt.Errorf("cannot parse clusters: %v", err)
+	}
+
+	out := make([]ClusterSummary, 0, len(resp.Clusters))
+	for _, cluster := range resp.Clusters {
+		mode := tlsModeDisable
+		if cluster.SSLContext != nil {
+			mode = tlsModeSimple
+			if cluster.SSLContext.CertChainFile != "" {
+				mode = tlsModeMutual
+			}
+		}
+		out = append(out, ClusterSummary{
+			Name:     cluster.Name,
+			Type:     cluster.Type,
+			LbPolicy: cluster.LbType,
+			TLSMode:  mode,
+		})
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// assertClusterTLSMode checks the TLS mode of a cluster served to the app sidecar
+func (infra *infra) assertClusterTLSMode(app, clusterName, wantMode string) error {
+	clusters, err := infra.proxyClusters(app)
+	if err != nil {
+		return err
+	}
+
+	for _, cluster := range clusters {
+		if cluster.Name == clusterName {
+			if cluster.TLSMode != wantMode {
+				return fmt.Errorf("cluster %s of %s has TLS mode %s, want %s", clusterName, app, cluster.TLSMode, wantMode)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("missing cluster %s for %s", clusterName, app)
+}
+
+// waitForProxySync polls Pilot and the sidecars of the apps until every proxy
+// serves the listeners, clusters and route tables Pilot computes for it. Envoy
+// only lists them on its admin interface once it applied the update carrying
+// them. The v1 discovery API of Pilot tracks no acks, there is no sync status
+// endpoint to query. The endpoints (EDS) are not compared.
+func (infra *infra) waitForProxySync(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		stale, err := infra.staleProxies()
+		if err != nil {
+			log.Infof("Failed to get the proxy sync status: %v", err)
+		} else if len(stale) == 0 {
+			log.Info("All proxies are synced")
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			if err != nil {
+				return fmt.Errorf("timed out after %v waiting for proxy sync: %v", timeout, err)
+			}
+			return fmt.Errorf("timed out after %v waiting for proxy sync, stale proxies: %s", timeout, strings.Join(stale, "; "))
+		}
+		if err = infra.sleep(pollInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// sidecarApps returns the sorted apps with pods in the app namespace whose
+// deployments all inject the proxy
+func (infra *infra) sidecarApps() []string {
+	injected := make(map[string]bool)
+	for _, app := range infra.appDefinitions() {
+		if sidecar, exists := injected[app.service]; !exists || sidecar {
+			injected[app.service] = app.injectProxy
+		}
+	}
+
+	var apps []string
+	for app, sidecar := range injected {
+		if sidecar && len(infra.apps[app]) > 0 {
+			apps = append(apps, app)
+		}
+	}
+	sort.Strings(apps)
+	return apps
+}
+
+// staleProxies returns the sorted list of sidecar pods whose config differs from
+// the config served by Pilot, e.g. "b-pod (missing listener 10.0.0.5:90)"
+func (infra *infra) staleProxies() ([]string, error) {
+	var stale []string
+	for _, app := range infra.sidecarApps() {
+		for _, pod := range infra.apps[app] {
+			diffs, err := infra.podSyncDiff(app, pod)
+			if err != nil {
+				return nil, err
+			}
+			if len(diffs) > 0 {
+				stale = append(stale, fmt.Sprintf("%s (%s)", pod, strings.Join(diffs, ", ")))
+			}
+		}
+	}
+	sort.Strings(stale)
+	return stale, nil
+}
+
+// podSyncDiff compares the listeners, clusters and route tables Pilot serves to
+// the sidecar of the app pod with the ones the sidecar reports on its admin
+// interface
+func (infra *infra) podSyncDiff(app, pod string) ([]string, error) {
+	cluster, node, err := infra.podNode(app, pod)
+	if err != nil {
+		return nil, err
+	}
+	lds, err := infra.pilotRequest(fmt.Sprintf("/v1/listeners/%s/%s", cluster, node))
+	if err != nil {
+		return nil, err
+	}
+	listeners, routes, err := parseListenerAddresses(lds)
+	if err != nil {
+		return nil, err
+	}
+	cds, err := infra.pilotRequest(fmt.Sprintf("/v1/clusters/%s/%s", cluster, node))
+	if err != nil {
+		return nil, err
+	}
+	summaries, err := parseClusters(cds)
+	if err != nil {
+		return nil, err
+	}
+	clusters := make(map[string]string, len(summaries))
+	for _, summary := range summaries {
+		clusters[summary.Name] = ""
+	}
+
+	var diffs []string
+	for _, section := range []struct {
+		kind, path string
+		want       map[string]string
+		parse      func(string) (map[string]string, error)
+		// the sidecar also has the static clusters of its bootstrap config
+		strict bool
+	}{
+		{"listener", "/listeners", listeners, parseAdminListeners, true},
+		{"cluster", "/clusters", clusters, parseAdminClusters, false},
+		{"route table", "/routes", routes, parseAdminRoutes, true},
+	} {
+		var out string
+		if out, err = infra.proxyExecPod(pod, infra.adminRequest(section.path)); err != nil {
+			return nil, err
+		}
+		var got map[string]string
+		if got, err = section.parse(out); err != nil {
+			return nil, fmt.Errorf("cannot parse %s of %s: %v", section.path, pod, err)
+		}
+		diffs = append(diffs, syncDiff(section.kind, section.want, got, section.strict)...)
+	}
+	return diffs, nil
+}
+
+// parseListenerAddresses returns the addresses of the listeners in an LDS response
+// in the form used by the Envoy admin interface, e.g. "10.0.0.5:80", and the names
+// of the route tables the HTTP listeners fetch with RDS
+func parseListenerAddresses(lds string) (addresses, routes map[string]string, err error) {
+	var resp struct {
+		Listeners []struct {
+			Address string `json:"address"`
+			Filters []struct {
+				Config struct {
+					RDS *struct {
+						RouteConfigName string `json:"route_config_name"`
+					} `json:"rds"`
+				} `json:"config"`
+			} `json:"filters"`
+		} `json:"listeners"`
+	}
+	if err = json.Unmarshal([]byte(lds), &resp); err != nil {
+		return nil, nil, fmt.Errorf("cannot parse listeners: %v", err)
+	}
+
+	addresses = make(map[string]string, len(resp.Listeners))
+	routes = make(map[string]string)
+	for _, listener := range resp.Listeners {
+		addresses[strings.TrimPrefix(listener.Address, "tcp://")] = ""
+		for _, filter := range listener.Filters {
+			if filter.Config.RDS != nil {
+				routes[filter.Config.RDS.RouteConfigName] = ""
+			}
+		}
+	}
+	return addresses, routes, nil
+}
+
+// syncDiff returns the sorted names served by Pilot but missing in the sidecar and,
+// if strict, the ones the sidecar still serves after Pilot removed them
+func syncDiff(kind string, want, got map[string]string, strict bool) []string {
+	var out []string
+	for name := range want {
+		if _, ok := got[name]; !ok {
+			out = append(out, fmt.Sprintf("missing %s %s", kind, name))
+		}
+	}
+	if strict {
+		for name := range got {
+			if _, ok := want[name]; !ok {
+				out = append(out, fmt.Sprintf("unexpected %s %s", kind, name))
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// RouteMatch describes the route selected for a request
+type RouteMatch struct {
+	VirtualHost string
+	// Route is the path condition of the route, e.g. "prefix /api"
+	Route string
+	// Clusters are the destination clusters, more than one for weighted routes
+	Clusters []string
+}
+
+// resolveRoute computes the route of the app sidecar matching a request with the
+// authority and the path without sending it
+func (infra *infra) resolveRoute(app, authority, path string) (RouteMatch, error) {
+	cluster, node, err := infra.proxyNode(app)
+	if err != nil {
+		return RouteMatch{}, err
+	}
+
+	// routes are served per port, the default HTTP port if the authority has none
+	port := "80"
+	if _, authorityPort, splitErr := net.SplitHostPort(authority); splitErr == nil {
+		port = authorityPort
+	}
+	rds, err := infra.pilotRequest(fmt.Sprintf("/v1/routes/%s/%s/%s", port, cluster, node))
+	if err != nil {
+		return RouteMatch{}, err
+	}
+	return matchRoute(rds, authority, path)
+}
+
+// waitForRoute polls the route of the app sidecar matching a request with the
+// authority and the path until it satisfies the condition
+func (infra *infra) waitForRoute(app, authority, path string, cond func(RouteMatch) bool, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		route, err := infra.resolveRoute(app, authority, path)
+		if err != nil {
+			log.Infof("Failed to resolve the route of %s for %s%s: %v", app, authority, path, err)
+		} else if cond(route) {
+			log.Infof("Route of %s for %s%s is %v", app, authority, path, route.Clusters)
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			if err != nil {
+				return fmt.Errorf("timed out after %v waiting for the route of %s for %s%s: %v", timeout, app, authority, path, err)
+			}
+			return fmt.Errorf("timed out after %v waiting for the route of %s for %s%s, last route %v",
+				timeout, app, authority, path, route.Clusters)
+		}
+		if err = infra.sleep(pollInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// matchRoute selects the route of the RDS response matching the authority and the
+// path. Exact path routes take precedence over prefix routes, which take precedence
+// over regex routes; the first route in order wins within each kind. Routes with
+// header conditions never match.
+func matchRoute(rds, authority, path string) (RouteMatch, error) {
+	var config envoy.HTTPRouteConfig
+	if err := json.Unmarshal([]byte(rds), &config); err != nil {
+		return RouteMatch{}, fmt.Errorf("cannot parse routes: %v", err)
+	}
+
+	host := matchVirtualHost(config.VirtualHosts, authority)
+	if host == nil {
+		return RouteMatch{}, fmt.Errorf("no virtual host for authority %s", authority)
+	}
+
+	var exact, prefix, regex *envoy.HTTPRoute
+	for _, route := range host.Routes {
+		if len(route.Headers) > 0 {
+			continue
+		}
+		switch {
+		case route.Path != "":
+			if exact == nil && route.Path == path {
+				exact = route
+			}
+		case route.Regex != "":
+			if regex == nil {
+				if re, err := regexp.Compile("^(?:" + route.Regex + ")$"); err == nil && re.MatchString(path) {
+					regex = route
+				}
+			}
+		default:
+			if prefix == nil && strings.HasPrefix(path, route.Prefix) {
+				prefix = route
+			}
+		}
+	}
+
+	match := RouteMatch{VirtualHost: host.Name}
+	switch {
+	case exact != nil:
+		match.Route = "path " + exact.Path
+		match.Clusters = routeClusters(exact)
+	case prefix != nil:
+		match.Route = "prefix " + prefix.Prefix
+		match.Clusters = routeClusters(prefix)
+	case regex != nil:
+		match.Route = "regex " + regex.Regex
+		match.Clusters = routeClusters(regex)
+	default:
+		return RouteMatch{}, fmt.Errorf("no route of virtual host %s matches path %s", host.Name, path)
+	}
+	return match, nil
+}
+
+// matchVirtualHost returns the virtual host with the authority as a domain, or
+// the wildcard virtual host
+func matchVirtualHost(hosts []*envoy.VirtualHost, authority string) *envoy.VirtualHost {
+	var wildcard *envoy.VirtualHost
+	for _, host := range hosts {
+		for _, domain := range host.Domains {
+			if domain == authority {
+				return host
+			}
+			if domain == "*" {
+				wildcard = host
+			}
+		}
+	}
+	return wildcard
+}
+
+// routeClusters returns the destination clusters of the route
+func routeClusters(route *envoy.HTTPRoute) []string {
+	if route.WeightedClusters == nil {
+		return []string{route.Cluster}
+	}
+	out := make([]string, 0, len(route.WeightedClusters.Clusters))
+	for _, cluster := range route.WeightedClusters.Clusters {
+		out = append(out, cluster.Name)
+	}
+	return out
+}
+
+// registration is an entry of the endpoints registered with Pilot (SDS)
+type registration struct {
+	Key   string `json:"service-key"`
+	Hosts []struct {
+		Address string `json:"ip_address"`
+		Port    int    `json:"port"`
+	} `json:"hosts"`
+}
+
+// serviceEntryEndpoints returns the endpoints Pilot resolved for the hostname of
+// a service declared by a registry, as sorted host:port pairs over all its ports
+func (infra *infra) serviceEntryEndpoints(host string) ([]string, error) {
+	out, err := infra.pilotRequest("/v1/registration")
+	if err != nil {
+		return nil, err
+	}
+	return parseRegistration(out, host)
+}
+
+// parseRegistration returns the sorted endpoints of the hostname in the Pilot
+// registration, or an error if the hostname is not registered
+func parseRegistration(body, host string) ([]string, error) {
+	var registrations []registration
+	if err := json.Unmarshal([]byte(body), &registrations); err != nil {
+		return nil, fmt.Errorf("cannot parse registration: %v", err)
+	}
+
+	found := false
+	endpoints := make(map[string]bool)
+	for _, r := range registrations {
+		if hostname, _, _ := model.ParseServiceKey(r.Key); hostname != host {
+			continue
+		}
+		found = true
+		for _, h := range r.Hosts {
+			endpoints[net.JoinHostPort(h.Address, strconv.Itoa(h.Port))] = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("unknown host %s", host)
+	}
+
+	out := make([]string, 0, len(endpoints))
+	for endpoint := range endpoints {
+		out = append(out, endpoint)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// subsetEndpoints returns the sorted addresses of the endpoints Pilot selects for
+// the http port of the subset of the service defined by its destination rule
+func (infra *infra) subsetEndpoints(service, subset string) ([]string, error) {
+	domain := infra.Namespace + ".svc.cluster.local"
+	labels, err := infra.subsetLabels(service, subset, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	key := model.ServiceKey(model.ResolveFQDN(service, domain), model.PortList{{Name: "http"}},
+		model.LabelsCollection{labels})
+	out, err := infra.pilotRequest("/v1/registration/" + url.PathEscape(key))
+	if err != nil {
+		return nil, err
+	}
+	return parseSubsetEndpoints(out)
+}
+
+// parseSubsetEndpoints returns the sorted unique addresses of the hosts in the
+// service discovery response of Pilot
+func parseSubsetEndpoints(body string) ([]string, error) {
+	var r registration
+	if err := json.Unmarshal([]byte(body), &r); err != nil {
+		return nil, fmt.Errorf("cannot parse endpoints: %v", err)
+	}
+
+	addresses := make(map[string]bool)
+	for _, h := range r.Hosts {
+		addresses[h.Address] = true
+	}
+	out := make([]string, 0, len(addresses))
+	for address := range addresses {
+		out = append(out, address)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// detectedProtocol returns the protocol Pilot configured for the inbound listener
+// of the port in the app sidecar, i.e. the protocol selected by the service port
+// name or TCP for a name without protocol prefix
+func (infra *infra) detectedProtocol(app string, port int) (string, error) {
+	cluster, node, err := infra.proxyNode(app)
+	if err != nil {
+		return "", err
+	}
+	svcNode, err := model.ParseServiceNode(node)
+	if err != nil {
+		return "", err
+	}
+
+	lds, err := infra.pilotRequest(fmt.Sprintf("/v1/listeners/%s/%s", cluster, node))
+	if err != nil {
+		return "", err
+	}
+	return parseListenerProtocol(lds, fmt.Sprintf("tcp://%s:%d", svcNode.IPAddress, port))
+}
+
+// parseListenerProtocol returns the protocol served by the network filter of the
+// listener with the address in an LDS response
+func parseListenerProtocol(lds, address string) (string, error) {
+	var resp struct {
+		Listeners []struct {
+			Address string `json:"address"`
+			Filters []struct {
+				Name string `json:"name"`
+			} `json:"filters"`
+		} `json:"listeners"`
+	}
+	if err := json.Unmarshal([]byte(lds), &resp); err != nil {
+		return "", fmt.Errorf("cannot parse listeners: %v", err)
+	}
+
+	for _, listener := range resp.Listeners {
+		if listener.Address != address {
+			continue
+		}
+		for _, filter := range listener.Filters {
+			switch filter.Name {
+			case envoy.HTTPConnectionManager:
+				return string(model.ProtocolHTTP), nil
+			case envoy.TCPProxyFilter:
+				return string(model.ProtocolTCP), nil
+			case envoy.MongoProxyFilter:
+				return string(model.ProtocolMongo), nil
+			case envoy.RedisProxyFilter:
+				return string(model.ProtocolRedis), nil
+			}
+		}
+		return "", fmt.Errorf("listener %s has no known network filter", address)
+	}
+	return "", fmt.Errorf("missing listener %s", address)
+}
+
+// assertNoListenerConflicts checks that no two listeners Pilot configured for the
+// app sidecar bind the same address, e.g. for services colliding on a port
+func (infra *infra) assertNoListenerConflicts(app string) error {
+	cluster, node, err := infra.proxyNode(app)
+	if err != nil {
+		return err
+	}
+	lds, err := infra.pilotRequest(fmt.Sprintf("/v1/listeners/%s/%s", cluster, node))
+	if err != nil {
+		return err
+	}
+
+	conflicts, err := listenerConflicts(lds)
+	if err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("conflicting listeners in the sidecar of %s: %s", app, strings.Join(conflicts, "; "))
+	}
+	return nil
+}
+
+// listenerConflicts returns the addresses bound by more than one listener in an
+// LDS response along with the names of the listeners, sorted by address
+func listenerConflicts(lds string) ([]string, error) {
+	var resp struct {
+		Listeners []struct {
+			Address string `json:"address"`
+			Name    string `json:"name"`
+		} `json:"listeners"`
+	}
+	if err := json.Unmarshal([]byte(lds), &resp); err != nil {
+		return nil, fmt.Errorf("cannot parse listeners: %v", err)
+	}
+
+	names := make(map[string][]string)
+	for _, listener := range resp.Listeners {
+		names[listener.Address] = append(names[listener.Address], listener.Name)
+	}
+	var out []string
+	for address, bound := range names {
+		if len(bound) > 1 {
+			out = append(out, fmt.Sprintf("%s bound by %s", address, strings.Join(bound, ", ")))
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
@@ -0,0 +1,383 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"istio.io/istio/pilot/platform/kube/inject"
+)
+
+// stubPilot stubs the shell to answer the discovery requests of app "a" with the responses
+// keyed by the request path
+func stubPilot(t *testing.T, responses map[string]string) func() {
+	return stubShell(func(command string) (string, error) {
+		switch {
+		case strings.Contains(command, "-l infra=pilot"):
+			return "istio-pilot-pod", nil
+		case strings.Contains(command, "jsonpath={.status.podIP}"):
+			return "10.0.0.5", nil
+		case strings.HasPrefix(command, "kubectl exec istio-pilot-pod "):
+			for path, resp := range responses {
+				if strings.HasSuffix(command, path) {
+					return resp, nil
+				}
+			}
+		}
+		return "", fmt.Errorf("unexpected command %q", command)
+	})
+}
+
+func TestParseClusters(t *testing.T) {
+	clusters, err := parseClusters(readTestData(t, "cds.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []ClusterSummary{
+		{Name: "in.8080", Type: "static", LbPolicy: "round_robin", TLSMode: tlsModeDisable},
+		{Name: "out.*.google.com|external-HTTPS-443", Type: "original_dst", LbPolicy: "original_dst_lb", TLSMode: tlsModeSimple},
+		{Name: "out.c.app.svc.cluster.local|http", Type: "sds", LbPolicy: "round_robin", TLSMode: tlsModeMutual},
+		{Name: "out.fake-control.app.svc.cluster.local|http", Type: "sds", LbPolicy: "least_request", TLSMode: tlsModeDisable},
+	}
+	if !reflect.DeepEqual(clusters, want) {
+		t.Errorf("got clusters\n%v\nwant\n%v", clusters, want)
+	}
+}
+
+func TestAssertClusterTLSMode(t *testing.T) {
+	defer stubPilot(t, map[string]string{
+		"/v1/clusters/a/sidecar~10.0.0.5~a-pod.app~app.svc.cluster.local": readTestData(t, "cds.json"),
+	})()
+
+	infra := makeTestInfra()
+	infra.apps["a"] = []string{"a-pod"}
+
+	if err := infra.assertClusterTLSMode("a", "out.c.app.svc.cluster.local|http", tlsModeMutual); err != nil {
+		t.Error(err)
+	}
+	if err := infra.assertClusterTLSMode("a", "out.fake-control.app.svc.cluster.local|http", tlsModeMutual); err == nil {
+		t.Error("expected an error for a plain text cluster")
+	}
+	if err := infra.assertClusterTLSMode("a", "out.missing.app.svc.cluster.local|http", tlsModeDisable); err == nil {
+		t.Error("expected an error for a missing cluster")
+	}
+}
+
+func TestSyncDiff(t *testing.T) {
+	want, routes, err := parseListenerAddresses(readTestData(t, "lds.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]string{"80": ""}; !reflect.DeepEqual(routes, expected) {
+		t.Errorf("got route tables %v, want %v", routes, expected)
+	}
+	got, err := parseAdminListeners(`["10.0.0.5:80","10.0.0.5:90","10.0.0.5:27017","0.0.0.0:80","10.0.0.5:70"]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffs := syncDiff("listener", want, got, true); len(diffs) != 0 {
+		t.Errorf("expected synced listeners, got %v", diffs)
+	}
+
+	got, err = parseAdminListeners(`["10.0.0.5:80","0.0.0.0:80","10.0.0.5:70","0.0.0.0:8080"]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"missing listener 10.0.0.5:27017", "missing listener 10.0.0.5:90", "unexpected listener 0.0.0.0:8080"}
+	if diffs := syncDiff("listener", want, got, true); !reflect.DeepEqual(diffs, expected) {
+		t.Errorf("got %v, want %v", diffs, expected)
+	}
+	expected = []string{"missing listener 10.0.0.5:27017", "missing listener 10.0.0.5:90"}
+	if diffs := syncDiff("listener", want, got, false); !reflect.DeepEqual(diffs, expected) {
+		t.Errorf("got %v, want %v without the unexpected names", diffs, expected)
+	}
+
+	if _, _, err = parseListenerAddresses("no such cluster"); err == nil {
+		t.Error("expected an error for an invalid response")
+	}
+}
+
+// adminClusters returns the output of the clusters admin endpoint listing the clusters
+func adminClusters(names ...string) string {
+	var out []string
+	for _, name := range names {
+		out = append(out, name+"::default_priority::max_connections::1024")
+	}
+	return strings.Join(out, "\n")
+}
+
+func TestWaitForProxySync(t *testing.T) {
+	const (
+		allListeners = `["10.0.0.5:80","10.0.0.5:90","10.0.0.5:27017","0.0.0.0:80","10.0.0.5:70"]`
+		routes       = `[{"route_config_name":"80","route_table_dump":{"virtual_hosts":[]}}]`
+	)
+	clusters := []string{"rds", "in.8080", "out.c.app.svc.cluster.local|http",
+		"out.fake-control.app.svc.cluster.local|http", "out.*.google.com|external-HTTPS-443"}
+	admin := map[string]map[string]string{
+		"a-pod": {"/listeners": allListeners, "/clusters": adminClusters(clusters...), "/routes": routes},
+		"b-pod": {
+			"/listeners": `["10.0.0.5:80","0.0.0.0:80","10.0.0.5:70"]`,
+			"/clusters":  adminClusters(clusters[:3]...),
+			"/routes":    "[]",
+		},
+	}
+	lds, cds := readTestData(t, "lds.json"), readTestData(t, "cds.json")
+	defer stubShell(func(command string) (string, error) {
+		switch {
+		case strings.Contains(command, "-l infra=pilot"):
+			return "istio-pilot-pod", nil
+		case strings.Contains(command, "jsonpath={.status.podIP}"):
+			return "10.0.0.5", nil
+		case strings.HasPrefix(command, "kubectl exec istio-pilot-pod ") && strings.Contains(command, "/v1/listeners/"):
+			return lds, nil
+		case strings.HasPrefix(command, "kubectl exec istio-pilot-pod ") && strings.Contains(command, "/v1/clusters/"):
+			return cds, nil
+		}
+		// only the pods with a sidecar are queried
+		fields := strings.Fields(command)
+		if pod := admin[fields[2]]; pod != nil && strings.Contains(command, "-c "+inject.ProxyContainerName+" ") {
+			if out, ok := pod[command[strings.LastIndex(command, "/"):]]; ok {
+				return out, nil
+			}
+		}
+		return "", fmt.Errorf("unexpected command %q", command)
+	})()
+
+	infra := makeTestInfra()
+	infra.apps["a"] = []string{"a-pod"}
+	// an app without sidecar and a control plane pod
+	infra.apps["t"] = []string{"t-pod"}
+	infra.apps["istio-pilot"] = []string{"istio-pilot-pod"}
+	if err := infra.waitForProxySync(10 * time.Millisecond); err != nil {
+		t.Errorf("expected synced proxies, got %v", err)
+	}
+
+	infra.apps["b"] = []string{"b-pod"}
+	err := infra.waitForProxySync(10 * time.Millisecond)
+	want := "b-pod (missing cluster out.*.google.com|external-HTTPS-443, missing cluster out.fake-control.app.svc.cluster.local|http, " +
+		"missing listener 10.0.0.5:27017, missing listener 10.0.0.5:90, missing route table 80)"
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("expected a timeout listing the stale proxy, got %v", err)
+	}
+	if err != nil && strings.Contains(err.Error(), "a-pod") {
+		t.Errorf("only b-pod should be stale: %v", err)
+	}
+}
+
+func TestMatchRoute(t *testing.T) {
+	rds := readTestData(t, "rds.json")
+	const (
+		v1     = "out.c.app.svc.cluster.local|http|version=v1"
+		v2     = "out.c.app.svc.cluster.local|http|version=v2"
+		vhostC = "c.app.svc.cluster.local|http"
+	)
+
+	cases := []struct {
+		authority, path string
+		want            RouteMatch
+	}{
+		{"c", "/api/status", RouteMatch{vhostC, "path /api/status", []string{v2}}},
+		{"c:80", "/api/v1/items", RouteMatch{vhostC, "prefix /api/v1", []string{v1}}},
+		{"c.app", "/api/v3/items", RouteMatch{vhostC, "prefix /api", []string{v1, v2}}},
+		{"c", "/", RouteMatch{vhostC, "prefix /", []string{"out.c.app.svc.cluster.local|http"}}},
+		{"a", "/api/v1/items", RouteMatch{"a.app.svc.cluster.local|http", "prefix /", []string{"out.a.app.svc.cluster.local|http"}}},
+	}
+	for _, c := range cases {
+		got, err := matchRoute(rds, c.authority, c.path)
+		if err != nil {
+			t.Errorf("%s%s: unexpected error %v", c.authority, c.path, err)
+		} else if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s%s: got %v, want %v", c.authority, c.path, got, c.want)
+		}
+	}
+
+	if _, err := matchRoute(rds, "unknown", "/"); err == nil {
+		t.Error("expected an error for an unknown authority")
+	}
+}
+
+func TestResolveRoute(t *testing.T) {
+	defer stubPilot(t, map[string]string{
+		"/v1/routes/8080/a/sidecar~10.0.0.5~a-pod.app~app.svc.cluster.local": `{"virtual_hosts":[{"name":"c.app.svc.cluster.local|http-two",` +
+			`"domains":["c:8080"],"routes":[{"prefix":"/","cluster":"out.c.app.svc.cluster.local|http-two"}]}]}`,
+	})()
+
+	infra := makeTestInfra()
+	infra.apps["a"] = []string{"a-pod"}
+
+	got, err := infra.resolveRoute("a", "c:8080", "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Clusters) != 1 || got.Clusters[0] != "out.c.app.svc.cluster.local|http-two" {
+		t.Errorf("unexpected route %v", got)
+	}
+}
+
+func TestParseRegistration(t *testing.T) {
+	registration := readTestData(t, "registration.json")
+	for _, c := range []struct {
+		host string
+		want []string
+	}{
+		{"external.app.svc.cluster.local", []string{"192.168.10.1:3306", "192.168.10.2:3306"}},
+		{"c.app.svc.cluster.local", []string{"10.4.1.7:80", "10.4.1.7:8080", "10.4.2.9:80", "10.4.2.9:8080"}},
+		{"empty.app.svc.cluster.local", []string{}},
+	} {
+		got, err := parseRegistration(registration, c.host)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", c.host, err)
+		} else if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got endpoints %v, want %v", c.host, got, c.want)
+		}
+	}
+
+	if _, err := parseRegistration(registration, "unknown.app.svc.cluster.local"); err == nil {
+		t.Error("expected an error for an unknown host")
+	}
+}
+
+func TestParseSubsetEndpoints(t *testing.T) {
+	got, err := parseSubsetEndpoints(readTestData(t, "sds-subset.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10.4.2.9", "10.4.3.12"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got addresses %v, want %v", got, want)
+	}
+
+	if got, err = parseSubsetEndpoints(`{"hosts": []}`); err != nil || len(got) != 0 {
+		t.Errorf("expected no addresses for an empty subset, got %v (%v)", got, err)
+	}
+	if _, err = parseSubsetEndpoints("no healthy upstream"); err == nil {
+		t.Error("expected an error for an invalid response")
+	}
+}
+
+func TestSubsetEndpoints(t *testing.T) {
+	defer stubPilot(t, map[string]string{
+		"/v1/registration/c.app.svc.cluster.local%7Chttp%7Cversion=v2": readTestData(t, "sds-subset.json"),
+	})()
+
+	infra := makeTestInfra()
+	if _, err := infra.subsetEndpoints("c", "v2"); err == nil {
+		t.Error("expected an error without a destination rule")
+	}
+
+	if err := infra.applyConfig("rule-route-subsets.yaml.tmpl", map[string]string{"destination": "c"}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := infra.subsetEndpoints("c", "v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10.4.2.9", "10.4.3.12"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got addresses %v, want %v", got, want)
+	}
+	if _, err = infra.subsetEndpoints("c", "v3"); err == nil {
+		t.Error("expected an error for an unknown subset")
+	}
+}
+
+func TestParseListenerProtocol(t *testing.T) {
+	lds := readTestData(t, "lds.json")
+	for _, c := range []struct {
+		address string
+		want    string
+	}{
+		{"tcp://10.0.0.5:80", "HTTP"},
+		{"tcp://10.0.0.5:90", "TCP"},
+		{"tcp://10.0.0.5:27017", "Mongo"},
+		{"tcp://0.0.0.0:80", "HTTP"},
+	} {
+		got, err := parseListenerProtocol(lds, c.address)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", c.address, err)
+		} else if got != c.want {
+			t.Errorf("%s: got protocol %s, want %s", c.address, got, c.want)
+		}
+	}
+
+	for _, address := range []string{"tcp://10.0.0.5:70", "tcp://10.0.0.5:8080"} {
+		if _, err := parseListenerProtocol(lds, address); err == nil {
+			t.Errorf("%s: expected an error", address)
+		}
+	}
+}
+
+func TestListenerConflicts(t *testing.T) {
+	conflicts, err := listenerConflicts(readTestData(t, "lds.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 0 {
+		t.Errorf("unexpected conflicts %v", conflicts)
+	}
+
+	if conflicts, err = listenerConflicts(readTestData(t, "lds-conflict.json")); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"tcp://0.0.0.0:8080 bound by http_0.0.0.0_8080, tcp_0.0.0.0_8080"}
+	if !reflect.DeepEqual(conflicts, want) {
+		t.Errorf("got conflicts %v, want %v", conflicts, want)
+	}
+
+	if _, err = listenerConflicts("no such cluster"); err == nil {
+		t.Error("expected an error for an invalid response")
+	}
+}
+
+func TestAssertNoListenerConflicts(t *testing.T) {
+	defer stubPilot(t, map[string]string{
+		"/v1/listeners/a/sidecar~10.0.0.5~a-pod.app~app.svc.cluster.local": readTestData(t, "lds-conflict.json"),
+		"/v1/listeners/b/sidecar~10.0.0.5~b-pod.app~app.svc.cluster.local": readTestData(t, "lds.json"),
+	})()
+
+	infra := makeTestInfra()
+	infra.apps["a"] = []string{"a-pod"}
+	infra.apps["b"] = []string{"b-pod"}
+	if err := infra.assertNoListenerConflicts("b"); err != nil {
+		t.Error(err)
+	}
+	err := infra.assertNoListenerConflicts("a")
+	if err == nil || !strings.Contains(err.Error(), "tcp://0.0.0.0:8080 bound by http_0.0.0.0_8080, tcp_0.0.0.0_8080") {
+		t.Errorf("expected the conflict on port 8080, got %v", err)
+	}
+}
+
+func TestDetectedProtocol(t *testing.T) {
+	defer stubPilot(t, map[string]string{
+		"/v1/listeners/a/sidecar~10.0.0.5~a-pod.app~app.svc.cluster.local": readTestData(t, "lds.json"),
+	})()
+
+	infra := makeTestInfra()
+	if _, err := infra.detectedProtocol("a", 90); err == nil {
+		t.Error("expected an error for an app without pods")
+	}
+
+	infra.apps["a"] = []string{"a-pod"}
+	got, err := infra.detectedProtocol("a", 90)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "TCP" {
+		t.Errorf("got protocol %s for port 90, want TCP", got)
+	}
+}
@@ -0,0 +1,1010 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	multierror "github.com/hashicorp/go-multierror"
+	"k8s.io/api/core/v1"
+
+	"istio.io/istio/pilot/platform/kube/inject"
+	"istio.io/istio/pkg/log"
+	"istio.io/istio/security/pkg/pki"
+)
+
+// sidecar proxy inspection utilities
+
+const (
+	// proxyAdminPort is the default port of the Envoy admin interface in the sidecar
+	proxyAdminPort = 15000
+
+	// proxyHealthPort is the port of the agent serving the rewritten app probes
+	proxyHealthPort = 15020
+
+	// proxyBootstrapPath is the config file of the first proxy epoch
+	proxyBootstrapPath = "/etc/istio/proxy/envoy-rev0.json"
+
+	// proxyCertChainPath is the workload certificate chain mounted from the Istio CA secret
+	proxyCertChainPath = "/etc/certs/cert-chain.pem"
+
+	// proxyCapturePath is the temporary pcap file written by capturePackets
+	proxyCapturePath = "/tmp/istio-capture.pcap"
+
+	// proxyRedirectChain is the nat chain set up by the init container to redirect
+	// the traffic of the pod to the proxy
+	proxyRedirectChain = "ISTIO_REDIRECT"
+
+	// proxyInboundChain and proxyOutputChain are the nat chains of the inbound and
+	// outbound traffic, where the excluded ports return before the redirect
+	proxyInboundChain = "ISTIO_INBOUND"
+	proxyOutputChain  = "ISTIO_OUTPUT"
+
+	// timeoutExitStatus is returned by timeout when the command is stopped
+	timeoutExitStatus = "exit status 124"
+)
+
+// proxyExec runs a command in the proxy container of the first pod of the app
+func (infra *infra) proxyExec(app, command string) (string, error) {
+	if len(infra.apps[app]) == 0 {
+		return "", fmt.Errorf("missing pod names for app %q", app)
+	}
+	return infra.proxyExecPod(infra.apps[app][0], command)
+}
+
+// proxyExecPod runs a command in the proxy container of the pod
+func (infra *infra) proxyExecPod(pod, command string) (string, error) {
+	return shell(fmt.Sprintf("kubectl exec %s --kubeconfig %s -n %s -c %s -- %s",
+		pod, kubeconfig, infra.Namespace, inject.ProxyContainerName, command))
+}
+
+// proxyAdmin fetches a path from the Envoy admin interface of the app sidecar
+func (infra *infra) proxyAdmin(app, path string) (string, error) {
+	return infra.proxyExec(app, infra.adminRequest(path))
+}
+
+// adminPort returns the port of the Envoy admin interface in the sidecars
+func (infra *infra) adminPort() int {
+	if infra.AdminPort != 0 {
+		return infra.AdminPort
+	}
+	return proxyAdminPort
+}
+
+// adminRequest returns the command fetching a path from the Envoy admin interface
+func (infra *infra) adminRequest(path string) string {
+	return fmt.Sprintf("curl -s http://localhost:%d%s", infra.adminPort(), path)
+}
+
+// proxyVersion returns the version of the sidecar proxy running in the app pod
+func (infra *infra) proxyVersion(app string) (string, error) {
+	out, err := infra.proxyAdmin(app, "/server_info")
+	if err != nil {
+		return "", err
+	}
+	return parseServerInfo(out)
+}
+
+// parseServerInfo extracts the version from the output of the /server_info
+// admin endpoint. Older proxies print "envoy <version> <state> ..." instead of JSON.
+func parseServerInfo(out string) (string, error) {
+	var info struct {
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal([]byte(out), &info); err == nil {
+		if info.Version == "" {
+			return "", fmt.Errorf("missing version in server info: %q", out)
+		}
+		return info.Version, nil
+	}
+
+	fields := strings.Fields(out)
+	if len(fields) < 2 || fields[0] != "envoy" {
+		return "", fmt.Errorf("cannot parse server info: %q", out)
+	}
+	return fields[1], nil
+}
+
+// proxyBootstrap returns the decoded config generated by the agent for the first
+// epoch of the app sidecar
+func (infra *infra) proxyBootstrap(app string) (map[string]interface{}, error) {
+	out, err := infra.proxyExec(app, "cat "+proxyBootstrapPath)
+	if err != nil {
+		return nil, err
+	}
+	return parseBootstrap(out)
+}
+
+// parseBootstrap decodes a proxy bootstrap config
+func parseBootstrap(out string) (map[string]interface{}, error) {
+	var bootstrap map[string]interface{}
+	if err := json.Unmarshal([]byte(out), &bootstrap); err != nil {
+		return nil, fmt.Errorf("cannot parse bootstrap config: %v", err)
+	}
+	if len(bootstrap) == 0 {
+		return nil, fmt.Errorf("empty bootstrap config: %q", out)
+	}
+	return bootstrap, nil
+}
+
+// outlierEjections returns the number of endpoints of the cluster currently
+// ejected by the outlier detection of the app sidecar
+func (infra *infra) outlierEjections(app, cluster string) (int, error) {
+	stats, err := infra.proxyAdmin(app, "/stats")
+	if err != nil {
+		return 0, err
+	}
+	return parseStat(stats, fmt.Sprintf("cluster.%s.outlier_detection.ejections_active", cluster))
+}
+
+// proxyRetries returns the number of requests to the cluster retried by the app sidecar
+func (infra *infra) proxyRetries(app, cluster string) (int, error) {
+	stats, err := infra.proxyAdmin(app, "/stats")
+	if err != nil {
+		return 0, err
+	}
+	return parseStat(stats, fmt.Sprintf("cluster.%s.upstream_rq_retry", cluster))
+}
+
+// activeConnections returns the number of connections to the cluster currently
+// open by the app sidecar, e.g. to check the maxConnections limit of a pool
+func (infra *infra) activeConnections(app, cluster string) (int, error) {
+	stats, err := infra.proxyAdmin(app, "/stats")
+	if err != nil {
+		return 0, err
+	}
+	return parseStat(stats, fmt.Sprintf("cluster.%s.upstream_cx_active", cluster))
+}
+
+// assertAccessLog polls the logs of the app sidecar until a line logged since
+// the call satisfies the matcher, e.g. the access log entry of a request in the
+// accessLogFormat of the mesh config, and fails if none does within the duration
+func (infra *infra) assertAccessLog(app string, matcher func(line string) bool, within time.Duration) error {
+	if len(infra.apps[app]) == 0 {
+		return fmt.Errorf("missing pod names for app %q", app)
+	}
+	pod := infra.apps[app][0]
+
+	// log timestamps have a second precision
+	since := time.Now().Add(-time.Second).UTC().Format(time.RFC3339)
+	return infra.waitForLogLine("proxy of "+pod, func() (string, error) {
+		return shell(fmt.Sprintf("kubectl logs %s --kubeconfig %s -n %s -c %s --since-time=%s",
+			pod, kubeconfig, infra.Namespace, inject.ProxyContainerName, since))
+	}, matcher, within)
+}
+
+// proxyStats returns the counters and gauges of the app sidecar keyed by name
+func (infra *infra) proxyStats(app string) (map[string]int, error) {
+	stats, err := infra.proxyAdmin(app, "/stats")
+	if err != nil {
+		return nil, err
+	}
+	out := parseStats(stats)
+	infra.recordProxyStats(app, out)
+	return out, nil
+}
+
+// parseStats parses the integer stats in the output of the /stats admin endpoint,
+// histograms and other non integer values are skipped
+func parseStats(stats string) map[string]int {
+	out := make(map[string]int)
+	for _, line := range strings.Split(stats, "\n") {
+		i := strings.LastIndex(line, ": ")
+		if i < 0 {
+			continue
+		}
+		if value, err := strconv.Atoi(strings.TrimSpace(line[i+2:])); err == nil {
+			out[line[:i]] = value
+		}
+	}
+	return out
+}
+
+// parseStat returns the value of the stat in the output of the /stats admin endpoint
+func parseStat(stats, name string) (int, error) {
+	value, exists := parseStats(stats)[name]
+	if !exists {
+		return 0, fmt.Errorf("missing stat %s", name)
+	}
+	return value, nil
+}
+
+// inboundRequests returns the total number of requests to the inbound clusters
+func inboundRequests(stats map[string]int) int {
+	total := 0
+	for name, value := range stats {
+		if strings.HasPrefix(name, "cluster.in.") && strings.HasSuffix(name, ".upstream_rq_total") {
+			total += value
+		}
+	}
+	return total
+}
+
+// localityDistribution returns the number of upstream connections opened by
+// the app sidecar to each zone, summed over the outbound clusters
+func (infra *infra) localityDistribution(app string) (map[string]int, error) {
+	stats, err := infra.proxyStats(app)
+	if err != nil {
+		return nil, err
+	}
+	return parseLocalityDistribution(stats), nil
+}
+
+// parseLocalityDistribution sums the zone aware connection counters of the form
+// cluster.<name>.zone.<local zone>.<upstream zone>.upstream_cx_total by upstream zone
+func parseLocalityDistribution(stats map[string]int) map[string]int {
+	out := make(map[string]int)
+	for name, value := range stats {
+		i := strings.LastIndex(name, ".zone.")
+		if !strings.HasPrefix(name, "cluster.") || i < 0 {
+			continue
+		}
+		parts := strings.Split(name[i+len(".zone."):], ".")
+		if len(parts) != 3 || parts[2] != "upstream_cx_total" {
+			continue
+		}
+		out[parts[1]] += value
+	}
+	return out
+}
+
+var (
+	// failoverRequests is the number of requests sent in each phase of assertFailover
+	failoverRequests = 20
+
+	// localityTolerance is the fraction of new upstream connections allowed
+	// outside of the expected zone
+	localityTolerance = 0.1
+)
+
+// assertFailover checks that the requests from the app to the URL go to the
+// primary zone, induces the failure of the primary zone and checks that the
+// requests shift to the failover zone. The failure is induced by the function,
+// e.g. wrapping blockEgressFromApp or scaling down the primary pods, and is
+// restored before returning.
+func (infra *infra) assertFailover(app, url, primaryZone, failoverZone string,
+	induceFailure func() (restore func() error, err error)) error {
+	before, err := infra.localityDistribution(app)
+	if err != nil {
+		return err
+	}
+	primary, err := infra.zoneTrafficFrom(app, url)
+	if err != nil {
+		return err
+	}
+	if err = checkZoneTraffic(before, primary, primaryZone); err != nil {
+		return fmt.Errorf("before failover: %v", err)
+	}
+
+	restore, err := induceFailure()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if restoreErr := restore(); restoreErr != nil {
+			log.Infof("Failed to restore the primary zone %s: %v", primaryZone, restoreErr)
+		}
+	}()
+
+	failover, err := infra.zoneTrafficFrom(app, url)
+	if err != nil {
+		return err
+	}
+	if err = checkZoneTraffic(primary, failover, failoverZone); err != nil {
+		return fmt.Errorf("after failover: %v", err)
+	}
+	return nil
+}
+
+// zoneTrafficFrom sends failoverRequests from the app to the URL and returns
+// the locality distribution of the app sidecar afterwards
+func (infra *infra) zoneTrafficFrom(app, url string) (map[string]int, error) {
+	resp := infra.clientRequest(app, url, failoverRequests, "")
+	if len(resp.code) == 0 {
+		return nil, fmt.Errorf("no responses from %s to %s", app, url)
+	}
+	return infra.localityDistribution(app)
+}
+
+// checkZoneTraffic checks that the upstream connections opened between the two
+// locality distributions went to the zone, within localityTolerance
+func checkZoneTraffic(before, after map[string]int, zone string) error {
+	delta := make(map[string]int)
+	total := 0
+	for z, count := range after {
+		if d := count - before[z]; d > 0 {
+			delta[z] = d
+			total += d
+		}
+	}
+	if total == 0 {
+		return fmt.Errorf("no new upstream connections, expected connections to zone %s", zone)
+	}
+	if float64(delta[zone]) < (1-localityTolerance)*float64(total) {
+		return fmt.Errorf("expected new upstream connections to zone %s => Got %v", zone, delta)
+	}
+	return nil
+}
+
+// assertMirrored sends requests from the primary app and checks that the sidecar
+// of the mirror app received about as many requests. Mirrored requests are sent
+// asynchronously, so up to a tenth of them may still be in flight.
+func (infra *infra) assertMirrored(primaryApp, mirrorApp, url string, count int) error {
+	before, err := infra.proxyStats(mirrorApp)
+	if err != nil {
+		return err
+	}
+
+	resp := infra.clientRequest(primaryApp, url, count, "")
+	if codes := counts(resp.code); codes[httpOk] != count {
+		return fmt.Errorf("expected %d successful requests from %s to %s => Got %v", count, primaryApp, url, codes)
+	}
+
+	after, err := infra.proxyStats(mirrorApp)
+	if err != nil {
+		return err
+	}
+	return checkMirrored(mirrorApp, inboundRequests(after)-inboundRequests(before), count)
+}
+
+// checkMirrored checks the number of requests received by the mirror
+func checkMirrored(mirrorApp string, mirrored, count int) error {
+	if mirrored <= 0 {
+		return fmt.Errorf("mirror %s saw no traffic, expected %d requests", mirrorApp, count)
+	}
+
+	tolerance := count / 10
+	if tolerance < 1 {
+		tolerance = 1
+	}
+	if mirrored < count-tolerance {
+		return fmt.Errorf("mirror %s saw %d requests, expected %d", mirrorApp, mirrored, count)
+	}
+	return nil
+}
+
+// maxMirroredLatency bounds the latency of requests to a mirrored route. Requests
+// to the echo app take milliseconds, a proxy waiting on a slow or unreachable
+// mirror before responding exceeds the bound.
+const maxMirroredLatency = time.Second
+
+// assertMirrorTransparent sends requests from the primary app to a mirrored route
+// and checks that the client saw only the responses of the primary version of the
+// destination, without waiting on the mirror
+func (infra *infra) assertMirrorTransparent(primaryApp, url, primaryVersion string, count int) error {
+	resp := infra.clientRequest(primaryApp, url, count, "")
+	if err := checkMirrorTransparent(resp, primaryVersion, count); err != nil {
+		return fmt.Errorf("mirrored requests from %s to %s: %v", primaryApp, url, err)
+	}
+	return nil
+}
+
+// checkMirrorTransparent checks that all requests succeeded with the responses
+// of the primary version within maxMirroredLatency
+func checkMirrorTransparent(resp response, primaryVersion string, count int) error {
+	if codes := counts(resp.code); codes[httpOk] != count {
+		return fmt.Errorf("expected %d successful requests => Got %v", count, codes)
+	}
+	if versions := counts(resp.version); versions[primaryVersion] != count {
+		return fmt.Errorf("expected %d responses of the primary version %s => Got %v", count, primaryVersion, versions)
+	}
+	if len(resp.latency) != count {
+		return fmt.Errorf("got %d latencies for %d responses", len(resp.latency), count)
+	}
+	for i, latency := range resp.latency {
+		if latency > maxMirroredLatency {
+			return fmt.Errorf("request %d took %v, longer than %v, the proxy waited on the mirror", i, latency, maxMirroredLatency)
+		}
+	}
+	return nil
+}
+
+// waitForWorkloadCert waits for the Istio CA to issue the workload certificate
+// of the app sidecar and returns the leaf certificate
+func (infra *infra) waitForWorkloadCert(app string, timeout time.Duration) (*x509.Certificate, error) {
+	if len(infra.apps[app]) == 0 {
+		return nil, fmt.Errorf("missing pod names for app %q", app)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		out, err := infra.proxyExec(app, "cat "+proxyCertChainPath)
+		if err == nil {
+			var cert *x509.Certificate
+			if cert, err = parseLeafCert(out); err == nil {
+				return cert, nil
+			}
+		}
+		log.Infof("Workload certificate of %s is not issued yet: %v", app, err)
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out after %v waiting for the workload certificate of %s", timeout, app)
+		}
+		if err = infra.sleep(pollInterval); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// parseLeafCert returns the leaf, i.e. first, certificate of a PEM encoded chain
+func parseLeafCert(chain string) (*x509.Certificate, error) {
+	return pki.ParsePemEncodedCertificate([]byte(chain))
+}
+
+// assertProbeRewrite checks that the injector rewrote the HTTP probes of the app
+// containers in the first pod of the app to the agent health port. The returned
+// error details the probes that were not rewritten. The injector of this tree
+// does not rewrite probes and its agent serves no health port, so the check is
+// meant for apps injected by a newer release and is not part of the default suite.
+func (infra *infra) assertProbeRewrite(app string) (bool, error) {
+	pod, err := infra.appPod(app)
+	if err != nil {
+		return false, err
+	}
+	return probesRewritten(pod)
+}
+
+const (
+	// oomKilledReason is the termination reason of a container exceeding its memory limit
+	oomKilledReason = "OOMKilled"
+
+	// proxyStartTimeout bounds the wait for the proxies of a deployed app to be ready
+	proxyStartTimeout = 2 * time.Minute
+)
+
+// assertProxyStartsUnderLimit deploys the app with the memory limit of the
+// injected proxy, e.g. "64Mi", and checks that the proxies became ready without
+// being OOM killed. The app is deleted on teardown.
+func (infra *infra) assertProxyStartsUnderLimit(app string, memLimit string) error {
+	yaml, err := infra.appYAML(app, app, 8080, 80, 9090, 90, 7070, 70, "v1", true, false,
+		appOptions{proxyMemoryLimit: memLimit})
+	if err != nil {
+		return err
+	}
+	if err = infra.kubeApply(yaml, infra.Namespace); err != nil {
+		return err
+	}
+	infra.deferCleanup(func() error {
+		return infra.kubeDelete(yaml, infra.Namespace)
+	})
+
+	deadline := time.Now().Add(proxyStartTimeout)
+	for {
+		var pods []string
+		pods, err = infra.startedProxies(app)
+		if err != nil {
+			return err
+		}
+		if len(pods) > 0 {
+			infra.apps[app] = pods
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("proxies of %s with the memory limit %s are not ready after %v", app, memLimit, proxyStartTimeout)
+		}
+		if err = infra.sleep(pollInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// startedProxies returns the pods of the app once all their proxies are ready,
+// and fails if a proxy was OOM killed
+func (infra *infra) startedProxies(app string) ([]string, error) {
+	out, err := shell(fmt.Sprintf("kubectl get pods --kubeconfig %s -n %s -l app=%s -o json",
+		kubeconfig, infra.Namespace, app))
+	if err != nil {
+		log.Infof("Failed to get the pods of %s: %v", app, err)
+		return nil, nil
+	}
+	var list v1.PodList
+	if err = json.Unmarshal([]byte(out), &list); err != nil {
+		return nil, err
+	}
+
+	var pods []string
+	for _, pod := range list.Items {
+		ready, startErr := checkProxyStarted(pod)
+		if startErr != nil {
+			return nil, startErr
+		}
+		if !ready {
+			log.Infof("Proxy of %s is not ready", pod.Name)
+			return nil, nil
+		}
+		pods = append(pods, pod.Name)
+	}
+	return pods, nil
+}
+
+// checkProxyStarted returns whether the proxy container of the pod is ready,
+// and fails if it was OOM killed
+func checkProxyStarted(pod v1.Pod) (bool, error) {
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name != inject.ProxyContainerName {
+			continue
+		}
+		for _, state := range []v1.ContainerState{status.State, status.LastTerminationState} {
+			if state.Terminated != nil && state.Terminated.Reason == oomKilledReason {
+				return false, fmt.Errorf("proxy of %s was OOM killed, restarted %d times", pod.Name, status.RestartCount)
+			}
+		}
+		return status.Ready, nil
+	}
+	return false, nil
+}
+
+// appPod returns the spec and status of the first pod of the app
+func (infra *infra) appPod(app string) (v1.Pod, error) {
+	var pod v1.Pod
+	if len(infra.apps[app]) == 0 {
+		return pod, fmt.Errorf("missing pod names for app %q", app)
+	}
+
+	out, err := shell(fmt.Sprintf("kubectl get pod %s --kubeconfig %s -n %s -o json",
+		infra.apps[app][0], kubeconfig, infra.Namespace))
+	if err != nil {
+		return pod, err
+	}
+
+	err = json.Unmarshal([]byte(out), &pod)
+	return pod, err
+}
+
+// probesRewritten checks that the HTTP probes of the pod containers other than
+// the proxy point at the agent health port. A pod without HTTP probes is an error
+// as there is nothing to rewrite.
+func probesRewritten(pod v1.Pod) (bool, error) {
+	var probes int
+	var original []string
+	for _, container := range pod.Spec.Containers {
+		if container.Name == inject.ProxyContainerName {
+			continue
+		}
+		for name, probe := range map[string]*v1.Probe{
+			"liveness":  container.LivenessProbe,
+			"readiness": container.ReadinessProbe,
+		} {
+			if probe == nil || probe.HTTPGet == nil {
+				continue
+			}
+			probes++
+			if probe.HTTPGet.Port.IntValue() != proxyHealthPort {
+				original = append(original, fmt.Sprintf("%s probe of container %s on port %s",
+					name, container.Name, probe.HTTPGet.Port.String()))
+			}
+		}
+	}
+
+	if probes == 0 {
+		return false, fmt.Errorf("pod %s has no HTTP probes to rewrite", pod.Name)
+	}
+	if len(original) > 0 {
+		sort.Strings(original)
+		return false, fmt.Errorf("probes of pod %s not rewritten to port %d: %s",
+			pod.Name, proxyHealthPort, strings.Join(original, ", "))
+	}
+	return true, nil
+}
+
+// proxyEnv returns the environment variables of the sidecar container of the app
+func (infra *infra) proxyEnv(app string) (map[string]string, error) {
+	pod, err := infra.appPod(app)
+	if err != nil {
+		return nil, err
+	}
+	return parseProxyEnv(pod)
+}
+
+// parseProxyEnv returns the environment variables of the proxy container of the
+// pod, the variables set from a source such as a field reference have an empty value
+func parseProxyEnv(pod v1.Pod) (map[string]string, error) {
+	for _, container := range pod.Spec.Containers {
+		if container.Name != inject.ProxyContainerName {
+			continue
+		}
+		env := make(map[string]string, len(container.Env))
+		for _, e := range container.Env {
+			env[e.Name] = e.Value
+		}
+		return env, nil
+	}
+	return nil, fmt.Errorf("pod %s has no %s container", pod.Name, inject.ProxyContainerName)
+}
+
+// capturePackets captures the packets of the interface of the app pod with tcpdump
+// for the duration and returns the pcap file, e.g. to check whether the traffic of
+// the proxy is encrypted. tcpdump is only shipped in the debug proxy image.
+func (infra *infra) capturePackets(app, iface string, duration time.Duration) ([]byte, error) {
+	if !infra.debugImagesAndMode {
+		return nil, errors.New("packet capture requires the debug proxy image (-debug)")
+	}
+	if _, err := infra.proxyExec(app, "tcpdump --version"); err != nil {
+		return nil, fmt.Errorf("tcpdump is not available in the proxy of %s: %v", app, err)
+	}
+
+	// timeout stops tcpdump with SIGINT so that the capture is flushed
+	if _, err := infra.proxyExec(app, tcpdumpCommand(iface, duration)); err != nil &&
+		!strings.Contains(err.Error(), timeoutExitStatus) {
+		return nil, fmt.Errorf("packet capture in %s failed: %v", app, err)
+	}
+
+	// the binary capture is encoded as the exec output mixes in stderr
+	encoded, err := infra.proxyExec(app, "base64 "+proxyCapturePath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = infra.proxyExec(app, "rm -f "+proxyCapturePath); err != nil {
+		log.Infof("Failed to remove the capture of %s: %v", app, err)
+	}
+	pcap, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode the capture of %s: %v", app, err)
+	}
+	return pcap, nil
+}
+
+// tcpdumpCommand returns the command capturing the interface for the duration,
+// rounded up to seconds, all interfaces are captured if the interface is empty
+func tcpdumpCommand(iface string, duration time.Duration) string {
+	if iface == "" {
+		iface = "any"
+	}
+	seconds := int(math.Ceil(duration.Seconds()))
+	return fmt.Sprintf("timeout -s INT %d tcpdump -i %s -w %s", seconds, iface, proxyCapturePath)
+}
+
+// iptablesRules returns the nat rules of the app pod. The init container and the
+// proxy share the network namespace of the pod, and the debug proxy is privileged
+// to read them.
+func (infra *infra) iptablesRules(app string) (string, error) {
+	if !infra.debugImagesAndMode {
+		return "", errors.New("reading the iptables rules requires the privileged debug proxy (-debug)")
+	}
+	return infra.proxyExec(app, "iptables-save -t nat")
+}
+
+// assertTrafficCaptured checks that the init container of the app pod redirects
+// the inbound and outbound traffic to the proxy
+func (infra *infra) assertTrafficCaptured(app string) error {
+	rules, err := infra.iptablesRules(app)
+	if err != nil {
+		return err
+	}
+	if err = checkTrafficCaptured(parseIptablesRules(rules)); err != nil {
+		return fmt.Errorf("traffic of %s is not captured: %v", app, err)
+	}
+	return nil
+}
+
+// parseIptablesRules maps the chains of the iptables-save output to their rules
+func parseIptablesRules(rules string) map[string][]string {
+	chains := make(map[string][]string)
+	for _, line := range strings.Split(rules, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, ":"):
+			if fields := strings.Fields(line[1:]); len(fields) > 0 && chains[fields[0]] == nil {
+				chains[fields[0]] = []string{}
+			}
+		case strings.HasPrefix(line, "-A "):
+			if fields := strings.Fields(line); len(fields) > 2 {
+				chains[fields[1]] = append(chains[fields[1]], strings.Join(fields[2:], " "))
+			}
+		}
+	}
+	return chains
+}
+
+// checkTrafficCaptured checks that the redirect chain sends the TCP traffic to the
+// proxy and that the inbound traffic jumps to it
+func checkTrafficCaptured(chains map[string][]string) error {
+	redirect, exists := chains[proxyRedirectChain]
+	if !exists {
+		return fmt.Errorf("missing chain %s", proxyRedirectChain)
+	}
+	if !jumpsTo(redirect, "REDIRECT") {
+		return fmt.Errorf("chain %s does not redirect to the proxy: %v", proxyRedirectChain, redirect)
+	}
+	if !jumpsTo(chains["PREROUTING"], proxyRedirectChain) {
+		return fmt.Errorf("inbound traffic does not jump to chain %s", proxyRedirectChain)
+	}
+	return nil
+}
+
+// assertPortExcluded checks that the iptables rules of the app pod bypass the proxy
+// for the port in the direction, "inbound" or "outbound", as set by the
+// excludeInboundPorts and excludeOutboundPorts annotations
+func (infra *infra) assertPortExcluded(app string, port int, direction string) error {
+	rules, err := infra.iptablesRules(app)
+	if err != nil {
+		return err
+	}
+	if err = checkPortExcluded(parseIptablesRules(rules), port, direction); err != nil {
+		return fmt.Errorf("%s port %d of %s is not excluded: %v", direction, port, app, err)
+	}
+	return nil
+}
+
+// checkPortExcluded checks that the chain of the direction returns for the
+// destination port before any rule matching the port redirects it to the proxy
+func checkPortExcluded(chains map[string][]string, port int, direction string) error {
+	var chain string
+	switch direction {
+	case "inbound":
+		chain = proxyInboundChain
+	case "outbound":
+		chain = proxyOutputChain
+	default:
+		return fmt.Errorf("unknown direction %q, expected inbound or outbound", direction)
+	}
+
+	rules, exists := chains[chain]
+	if !exists {
+		return fmt.Errorf("missing chain %s", chain)
+	}
+	for _, rule := range rules {
+		if !ruleMatchesPort(rule, port) {
+			continue
+		}
+		if jumpsTo([]string{rule}, "RETURN") {
+			return nil
+		}
+		if jumpsTo([]string{rule}, proxyRedirectChain) {
+			return fmt.Errorf("rule %q of chain %s redirects the port first", rule, chain)
+		}
+	}
+	return fmt.Errorf("no rule of chain %s returns for the port", chain)
+}
+
+// ruleMatchesPort returns whether the rule has a destination port match for the port
+func ruleMatchesPort(rule string, port int) bool {
+	fields := strings.Fields(rule)
+	for i := 0; i < len(fields)-1; i++ {
+		if fields[i] != "--dport" && fields[i] != "--dports" && fields[i] != "--destination-port" {
+			continue
+		}
+		negated := i > 0 && fields[i-1] == "!"
+		return portInList(fields[i+1], port) != negated
+	}
+	return false
+}
+
+// portInList returns whether the port is in the comma separated list of ports
+// and port ranges of an iptables match
+func portInList(list string, port int) bool {
+	for _, item := range strings.Split(list, ",") {
+		bounds := strings.SplitN(item, ":", 2)
+		low, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			continue
+		}
+		high := low
+		if len(bounds) == 2 {
+			if high, err = strconv.Atoi(bounds[1]); err != nil {
+				continue
+			}
+		}
+		if low <= port && port <= high {
+			return true
+		}
+	}
+	return false
+}
+
+// jumpsTo returns whether one of the rules jumps to the target
+func jumpsTo(rules []string, target string) bool {
+	for _, rule := range rules {
+		if strings.Contains(rule+" ", "-j "+target+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+// assertAppWaitedForProxy checks that the app container of the app pod, deployed
+// with holdApplicationUntilProxyStarts, did not start before the proxy
+func (infra *infra) assertAppWaitedForProxy(app string) error {
+	pod, err := infra.appPod(app)
+	if err != nil {
+		return err
+	}
+	return checkAppWaitedForProxy(pod)
+}
+
+// checkAppWaitedForProxy checks that the proxy is the first container of the pod
+// and that the other containers started after it
+func checkAppWaitedForProxy(pod v1.Pod) error {
+	if len(pod.Spec.Containers) == 0 || pod.Spec.Containers[0].Name != inject.ProxyContainerName {
+		return fmt.Errorf("proxy is not the first container of pod %s", pod.Name)
+	}
+
+	started := make(map[string]time.Time, len(pod.Status.ContainerStatuses))
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Running == nil {
+			return fmt.Errorf("container %s of pod %s is not running", status.Name, pod.Name)
+		}
+		started[status.Name] = status.State.Running.StartedAt.Time
+	}
+	proxyStarted, exists := started[inject.ProxyContainerName]
+	if !exists {
+		return fmt.Errorf("pod %s has no %s container status", pod.Name, inject.ProxyContainerName)
+	}
+	for name, at := range started {
+		if at.Before(proxyStarted) {
+			return fmt.Errorf("container %s of pod %s started at %v before the proxy at %v", name, pod.Name, at, proxyStarted)
+		}
+	}
+	return nil
+}
+
+// proxyConfig holds the items of each section of the config of a proxy, keyed by
+// name, with a canonical form of their content
+type proxyConfig map[string]map[string]string
+
+// assertConfigConsistent checks that the clusters, listeners and routes of the
+// sidecars of all the pods of the app are identical, e.g. to catch a stale proxy
+func (infra *infra) assertConfigConsistent(app string) error {
+	pods := infra.apps[app]
+	if len(pods) == 0 {
+		return fmt.Errorf("missing pod names for app %q", app)
+	}
+
+	var first proxyConfig
+	var errs error
+	for i, pod := range pods {
+		config, err := infra.podProxyConfig(pod)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			first = config
+			continue
+		}
+		if diffs := diffProxyConfig(first, config); len(diffs) > 0 {
+			errs = multierror.Append(errs, fmt.Errorf("config of %s diverges from %s: %s",
+				pod, pods[0], strings.Join(diffs, "; ")))
+		}
+	}
+	return errs
+}
+
+// podIPPlaceholder replaces the IP of the pod in the config of its sidecar, so
+// that the inbound listeners of the replicas compare equal
+const podIPPlaceholder = "<pod-ip>"
+
+// podProxyConfig fetches the clusters, listeners and routes of the sidecar of the
+// pod, with the IP of the pod replaced by podIPPlaceholder
+func (infra *infra) podProxyConfig(pod string) (proxyConfig, error) {
+	ip, err := infra.podIP(pod)
+	if err != nil {
+		return nil, err
+	}
+	if ip == "" {
+		return nil, fmt.Errorf("pod %s has no IP", pod)
+	}
+	podIPRex := regexp.MustCompile(`\b` + regexp.QuoteMeta(ip) + `\b`)
+
+	config := make(proxyConfig)
+	for _, section := range []struct {
+		path  string
+		parse func(string) (map[string]string, error)
+	}{
+		{"/clusters", parseAdminClusters},
+		{"/listeners", parseAdminListeners},
+		{"/routes", parseAdminRoutes},
+	} {
+		out, err := infra.proxyExecPod(pod, infra.adminRequest(section.path))
+		if err != nil {
+			return nil, err
+		}
+		out = podIPRex.ReplaceAllString(out, podIPPlaceholder)
+		if config[section.path], err = section.parse(out); err != nil {
+			return nil, fmt.Errorf("invalid %s of %s: %v", section.path, pod, err)
+		}
+	}
+	return config, nil
+}
+
+// parseAdminClusters returns the clusters and their hosts, as "<cluster> <host>",
+// listed by the clusters admin endpoint, skipping the statistics
+func parseAdminClusters(out string) (map[string]string, error) {
+	items := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.Split(line, "::")
+		if len(fields) < 3 {
+			continue
+		}
+		items[fields[0]] = ""
+		if _, _, err := net.SplitHostPort(fields[1]); err == nil {
+			items[fields[0]+" "+fields[1]] = ""
+		}
+	}
+	return items, nil
+}
+
+// parseAdminListeners returns the addresses listed by the listeners admin endpoint
+func parseAdminListeners(out string) (map[string]string, error) {
+	var addresses []string
+	if err := json.Unmarshal([]byte(out), &addresses); err != nil {
+		return nil, err
+	}
+	items := make(map[string]string, len(addresses))
+	for _, address := range addresses {
+		items[address] = ""
+	}
+	return items, nil
+}
+
+// parseAdminRoutes returns the route tables dumped by the routes admin endpoint,
+// keyed by name
+func parseAdminRoutes(out string) (map[string]string, error) {
+	var tables []struct {
+		Name  string          `json:"route_config_name"`
+		Table json.RawMessage `json:"route_table_dump"`
+	}
+	if err := json.Unmarshal([]byte(out), &tables); err != nil {
+		return nil, err
+	}
+	items := make(map[string]string, len(tables))
+	for _, table := range tables {
+		// re-encoding sorts the object keys
+		var content interface{}
+		if err := json.Unmarshal(table.Table, &content); err != nil {
+			return nil, err
+		}
+		canonical, err := json.Marshal(content)
+		if err != nil {
+			return nil, err
+		}
+		items[table.Name] = string(canonical)
+	}
+	return items, nil
+}
+
+// diffProxyConfig describes the items missing from, added to or changed in the
+// second config, sorted
+func diffProxyConfig(want, got proxyConfig) []string {
+	var diffs []string
+	for section, wantItems := range want {
+		gotItems := got[section]
+		for name, content := range wantItems {
+			if gotContent, exists := gotItems[name]; !exists {
+				diffs = append(diffs, fmt.Sprintf("%s: missing %s", section, name))
+			} else if gotContent != content {
+				diffs = append(diffs, fmt.Sprintf("%s: %s differs", section, name))
+			}
+		}
+		for name := range gotItems {
+			if _, exists := wantItems[name]; !exists {
+				diffs = append(diffs, fmt.Sprintf("%s: unexpected %s", section, name))
+			}
+		}
+	}
+	sort.Strings(diffs)
+	return diffs
+}
@@ -0,0 +1,851 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"istio.io/istio/pilot/platform/kube/inject"
+	"istio.io/istio/security/pkg/pki"
+)
+
+// readTestData reads a fixture from the testdata directory
+func readTestData(t *testing.T, name string) string {
+	data, err := ioutil.ReadFile(testDataDir + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestParseServerInfo(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		want string
+		err  bool
+	}{
+		{
+			name: "json",
+			in:   readTestData(t, "server_info.json"),
+			want: "5d25f466c3410c0dfa735d7d4358beb76b2da507/1.6.0-dev/Clean/RELEASE",
+		},
+		{
+			name: "text",
+			in:   "envoy 5d25f466c3410c0dfa735d7d4358beb76b2da507/1.5.0/Clean/RELEASE live 126 126 0",
+			want: "5d25f466c3410c0dfa735d7d4358beb76b2da507/1.5.0/Clean/RELEASE",
+		},
+		{
+			name: "missing version",
+			in:   `{"state": "LIVE"}`,
+			err:  true,
+		},
+		{
+			name: "garbage",
+			in:   "connection refused",
+			err:  true,
+		},
+	}
+
+	for _, c := range cases {
+		got, err := parseServerInfo(c.in)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got version %q", c.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", c.name, err)
+		} else if got != c.want {
+			t.Errorf("%s: got version %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestProxyAdminPort(t *testing.T) {
+	var commands []string
+	defer stubShell(func(command string) (string, error) {
+		commands = append(commands, command)
+		return "", nil
+	})()
+
+	infra := makeTestInfra()
+	infra.apps["a"] = []string{"a-pod"}
+	if _, err := infra.proxyAdmin("a", "/stats"); err != nil {
+		t.Fatal(err)
+	}
+	infra.AdminPort = 15900
+	if _, err := infra.proxyStats("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"curl -s http://localhost:15000/stats", "curl -s http://localhost:15900/stats"}
+	if len(commands) != len(want) {
+		t.Fatalf("got commands %q, want %d", commands, len(want))
+	}
+	for i, command := range commands {
+		if !strings.HasSuffix(command, " -- "+want[i]) {
+			t.Errorf("got command %q, want %q", command, want[i])
+		}
+	}
+}
+
+func TestProxyVersionMissingPods(t *testing.T) {
+	infra := makeTestInfra()
+	if _, err := infra.proxyVersion("a"); err == nil {
+		t.Error("expected an error for an app without pods")
+	}
+}
+
+func TestParseBootstrap(t *testing.T) {
+	bootstrap, err := parseBootstrap(readTestData(t, "envoy-rev0.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin, ok := bootstrap["admin"].(map[string]interface{})
+	if !ok || admin["address"] != "tcp://127.0.0.1:15000" {
+		t.Errorf("unexpected admin config %v", bootstrap["admin"])
+	}
+	if _, ok = bootstrap["tracing"]; !ok {
+		t.Error("missing tracing config")
+	}
+
+	for _, out := range []string{"", "{}", "cat: /etc/istio/proxy/envoy-rev0.json: No such file or directory"} {
+		if _, err = parseBootstrap(out); err == nil {
+			t.Errorf("expected an error for %q", out)
+		}
+	}
+}
+
+func TestProxyBootstrapMissingPods(t *testing.T) {
+	infra := makeTestInfra()
+	if _, err := infra.proxyBootstrap("a"); err == nil {
+		t.Error("expected an error for an app without pods")
+	}
+}
+
+func TestParseStat(t *testing.T) {
+	stats := readTestData(t, "stats.txt")
+	for _, c := range []struct {
+		cluster string
+		want    int
+	}{
+		{"out.c.app.svc.cluster.local|http", 1},
+		{"out.fake-control.app.svc.cluster.local|http", 0},
+	} {
+		got, err := parseStat(stats, "cluster."+c.cluster+".outlier_detection.ejections_active")
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", c.cluster, err)
+		} else if got != c.want {
+			t.Errorf("%s: got %d ejections, want %d", c.cluster, got, c.want)
+		}
+	}
+
+	if _, err := parseStat(stats, "cluster.in.8080.outlier_detection.ejections_active"); err == nil {
+		t.Error("expected an error for a missing stat")
+	}
+}
+
+func TestOutlierEjectionsMissingPods(t *testing.T) {
+	infra := makeTestInfra()
+	if _, err := infra.outlierEjections("a", "out.c.app.svc.cluster.local|http"); err == nil {
+		t.Error("expected an error for an app without pods")
+	}
+}
+
+func TestParseRetries(t *testing.T) {
+	stats := readTestData(t, "stats.txt")
+	got, err := parseStat(stats, "cluster.out.c.app.svc.cluster.local|http.upstream_rq_retry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 4 {
+		t.Errorf("got %d retries, want 4", got)
+	}
+}
+
+func TestProxyRetriesMissingPods(t *testing.T) {
+	infra := makeTestInfra()
+	if _, err := infra.proxyRetries("a", "out.c.app.svc.cluster.local|http"); err == nil {
+		t.Error("expected an error for an app without pods")
+	}
+}
+
+func TestParseActiveConnections(t *testing.T) {
+	stats := readTestData(t, "stats.txt")
+	got, err := parseStat(stats, "cluster.out.c.app.svc.cluster.local|http.upstream_cx_active")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 2 {
+		t.Errorf("got %d active connections, want 2", got)
+	}
+}
+
+func TestActiveConnectionsMissingPods(t *testing.T) {
+	infra := makeTestInfra()
+	if _, err := infra.activeConnections("a", "out.c.app.svc.cluster.local|http"); err == nil {
+		t.Error("expected an error for an app without pods")
+	}
+}
+
+func TestParseLocalityDistribution(t *testing.T) {
+	got := parseLocalityDistribution(parseStats(readTestData(t, "locality-stats.txt")))
+	want := map[string]int{"us-central1-a": 17, "us-central1-b": 3}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got distribution %v, want %v", got, want)
+	}
+}
+
+func TestLocalityDistributionMissingPods(t *testing.T) {
+	infra := makeTestInfra()
+	if _, err := infra.localityDistribution("a"); err == nil {
+		t.Error("expected an error for an app without pods")
+	}
+}
+
+func TestCheckZoneTraffic(t *testing.T) {
+	before := parseLocalityDistribution(parseStats(readTestData(t, "locality-failover-before.txt")))
+	primary := parseLocalityDistribution(parseStats(readTestData(t, "locality-failover-primary.txt")))
+	failover := parseLocalityDistribution(parseStats(readTestData(t, "locality-failover-after.txt")))
+
+	if err := checkZoneTraffic(before, primary, "us-central1-a"); err != nil {
+		t.Errorf("unexpected error before failover %v", err)
+	}
+	if err := checkZoneTraffic(primary, failover, "us-central1-b"); err != nil {
+		t.Errorf("unexpected error after failover %v", err)
+	}
+	if err := checkZoneTraffic(primary, failover, "us-central1-a"); err == nil {
+		t.Error("expected an error for traffic shifted away from the zone")
+	}
+	if err := checkZoneTraffic(primary, primary, "us-central1-a"); err == nil {
+		t.Error("expected an error without new connections")
+	}
+}
+
+func TestAssertFailover(t *testing.T) {
+	stats := []string{"locality-failover-before.txt", "locality-failover-primary.txt", "locality-failover-after.txt"}
+	defer stubShell(func(command string) (string, error) {
+		switch {
+		case strings.HasSuffix(command, "/stats"):
+			if len(stats) == 0 {
+				return "", errors.New("no more stats")
+			}
+			out := readTestData(t, stats[0])
+			stats = stats[1:]
+			return out, nil
+		case strings.Contains(command, " -- client -url http://c/a "):
+			return versionOutput(failoverRequests, "v1"), nil
+		}
+		return "", fmt.Errorf("unexpected command %q", command)
+	})()
+
+	infra := makeTestInfra()
+	infra.apps = map[string][]string{"a": {"a-pod"}}
+	induced, restored := false, false
+	err := infra.assertFailover("a", "http://c/a", "us-central1-a", "us-central1-b", func() (func() error, error) {
+		induced = true
+		return func() error {
+			restored = true
+			return nil
+		}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !induced || !restored {
+		t.Errorf("expected the failure to be induced and restored, got induced %t and restored %t", induced, restored)
+	}
+}
+
+func TestParseLeafCert(t *testing.T) {
+	cert, err := parseLeafCert(readTestData(t, "cert-chain.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.IsCA {
+		t.Error("expected the leaf certificate, got the root")
+	}
+
+	ids, err := pki.ExtractIDs(cert.Extensions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"spiffe://cluster.local/ns/app/sa/default"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("got identities %v, want %v", ids, want)
+	}
+
+	if _, err = parseLeafCert("cat: /etc/certs/cert-chain.pem: No such file or directory"); err == nil {
+		t.Error("expected an error for a missing certificate")
+	}
+}
+
+func TestWaitForWorkloadCert(t *testing.T) {
+	chain := readTestData(t, "cert-chain.pem")
+	polls := 0
+	defer stubShell(func(command string) (string, error) {
+		polls++
+		if polls <= 2 {
+			return "", fmt.Errorf("cat: %s: No such file or directory", proxyCertChainPath)
+		}
+		return chain, nil
+	})()
+
+	infra := makeTestInfra()
+	if _, err := infra.waitForWorkloadCert("a", time.Second); err == nil {
+		t.Error("expected an error for an app without pods")
+	}
+
+	infra.apps["a"] = []string{"a-pod"}
+	if _, err := infra.waitForWorkloadCert("a", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if polls != 3 {
+		t.Errorf("expected the certificate on the third poll, got %d polls", polls)
+	}
+}
+
+func TestAssertMirrored(t *testing.T) {
+	stats := []string{readTestData(t, "mirror-stats-before.txt"), readTestData(t, "mirror-stats-after.txt")}
+	if delta := inboundRequests(parseStats(stats[1])) - inboundRequests(parseStats(stats[0])); delta != 9 {
+		t.Errorf("got %d mirrored requests, want 9", delta)
+	}
+
+	var requests int
+	defer stubShell(func(command string) (string, error) {
+		switch {
+		case strings.HasPrefix(command, "kubectl exec a-pod ") && strings.Contains(command, " -- client "):
+			requests++
+			out := ""
+			for i := 0; i < 10; i++ {
+				out += fmt.Sprintf("[%d] StatusCode=200\n", i)
+			}
+			return out, nil
+		case strings.HasPrefix(command, "kubectl exec b-pod ") && strings.HasSuffix(command, "/stats"):
+			return stats[requests], nil
+		}
+		return "", fmt.Errorf("unexpected command %q", command)
+	})()
+
+	infra := makeTestInfra()
+	infra.apps["a"] = []string{"a-pod"}
+	infra.apps["b"] = []string{"b-pod"}
+
+	// one of ten mirrored requests is tolerated to be in flight
+	if err := infra.assertMirrored("a", "b", "http://c/a", 10); err != nil {
+		t.Error(err)
+	}
+
+	for _, c := range []struct {
+		mirrored int
+		ok       bool
+	}{{0, false}, {5, false}, {9, true}, {10, true}} {
+		if err := checkMirrored("b", c.mirrored, 10); (err == nil) != c.ok {
+			t.Errorf("%d of 10 mirrored requests: got error %v", c.mirrored, err)
+		}
+	}
+}
+
+func TestCheckMirrorTransparent(t *testing.T) {
+	primary := parseResponse(readTestData(t, "mirror-primary-response.txt"))
+	if err := checkMirrorTransparent(primary, "v1", 10); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := checkMirrorTransparent(primary, "v1", 20); err == nil {
+		t.Error("expected an error for missing responses")
+	}
+	if err := checkMirrorTransparent(primary, "v2", 10); err == nil {
+		t.Error("expected an error for responses of another version")
+	}
+
+	leaked := parseResponse(readTestData(t, "mirror-leaked-response.txt"))
+	if err := checkMirrorTransparent(leaked, "v1", 10); err == nil || !strings.Contains(err.Error(), "unversioned") {
+		t.Errorf("expected an error for responses of the mirror, got %v", err)
+	}
+
+	mirrored := parseResponse(readTestData(t, "mirror-only-response.txt"))
+	if err := checkMirrorTransparent(mirrored, "v1", 10); err == nil || !strings.Contains(err.Error(), "unversioned:10") {
+		t.Errorf("expected an error for responses all from the mirror, got %v", err)
+	}
+
+	blocking := parseResponse(readTestData(t, "mirror-blocking-response.txt"))
+	if err := checkMirrorTransparent(blocking, "v1", 10); err == nil || !strings.Contains(err.Error(), "waited on the mirror") {
+		t.Errorf("expected an error for requests waiting on the mirror, got %v", err)
+	}
+}
+
+func TestAssertProbeRewrite(t *testing.T) {
+	infra := makeTestInfra()
+	infra.apps["a"] = []string{"a-5d4c8f7b9-x2kqp"}
+
+	for _, c := range []struct {
+		fixture string
+		want    bool
+		err     string
+	}{
+		{"pod-probe-rewritten.json", true, ""},
+		{"pod-probe-original.json", false, "liveness probe of container app on port 3333"},
+		{"pod-proxy-env.json", false, "pod a-5d4c8f7b9-x2kqp has no HTTP probes to rewrite"},
+	} {
+		pod := readTestData(t, c.fixture)
+		restore := stubShell(func(command string) (string, error) {
+			if !strings.HasPrefix(command, "kubectl get pod a-5d4c8f7b9-x2kqp ") {
+				t.Errorf("unexpected command %q", command)
+			}
+			return pod, nil
+		})
+		got, err := infra.assertProbeRewrite("a")
+		restore()
+
+		if got != c.want {
+			t.Errorf("%s: got %t, want %t (%v)", c.fixture, got, c.want, err)
+		}
+		if c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Errorf("%s: expected an error with %q, got %v", c.fixture, c.err, err)
+		}
+	}
+}
+
+func TestCheckProxyStarted(t *testing.T) {
+	for _, c := range []struct {
+		fixture string
+		ready   bool
+		err     string
+	}{
+		{"pod-proxy-ready.json", true, ""},
+		{"pod-proxy-oomkilled.json", false, "proxy of a-7c9d6b5f4-m2x8q was OOM killed, restarted 3 times"},
+		{"pod-proxy-env.json", false, ""},
+	} {
+		var pod v1.Pod
+		if err := json.Unmarshal([]byte(readTestData(t, c.fixture)), &pod); err != nil {
+			t.Fatal(err)
+		}
+		ready, err := checkProxyStarted(pod)
+		if c.err == "" && err != nil {
+			t.Errorf("%s: unexpected error %v", c.fixture, err)
+		} else if c.err != "" && (err == nil || err.Error() != c.err) {
+			t.Errorf("%s: got error %v, want %q", c.fixture, err, c.err)
+		}
+		if ready != c.ready {
+			t.Errorf("%s: got ready %t, want %t", c.fixture, ready, c.ready)
+		}
+	}
+}
+
+func TestAssertProxyStartsUnderLimit(t *testing.T) {
+	var applied string
+	defer stubRunInput(func(_, input string) error {
+		applied = input
+		return nil
+	})()
+	statuses := []string{"pod-proxy-env.json", "pod-proxy-oomkilled.json"}
+	defer stubShell(func(command string) (string, error) {
+		if !strings.HasPrefix(command, "kubectl get pods ") || !strings.HasSuffix(command, " -n app -l app=a -o json") {
+			return "", fmt.Errorf("unexpected command %q", command)
+		}
+		status := statuses[0]
+		if len(statuses) > 1 {
+			statuses = statuses[1:]
+		}
+		return `{"items": [` + readTestData(t, status) + `]}`, nil
+	})()
+
+	infra := makeTestInfra()
+	infra.InjectConfig = testInjectConfig()
+	infra.SkipControlPlane = true
+	if err := infra.assertProxyStartsUnderLimit("a", "16Mi"); err == nil || !strings.Contains(err.Error(), "OOM killed") {
+		t.Errorf("expected the proxy to be OOM killed, got %v", err)
+	}
+	spec := deploymentPodSpec(t, applied)
+	if len(spec.Containers) != 2 || spec.Containers[1].Name != inject.ProxyContainerName {
+		t.Fatalf("expected the proxy to be injected: %v", spec.Containers)
+	}
+	if limit := spec.Containers[1].Resources.Limits[v1.ResourceMemory]; limit.String() != "16Mi" {
+		t.Errorf("got proxy memory limit %s, want 16Mi", limit.String())
+	}
+	if _, exists := spec.Containers[0].Resources.Limits[v1.ResourceMemory]; exists {
+		t.Error("the app container should not be limited")
+	}
+
+	statuses = []string{"pod-proxy-ready.json"}
+	if err := infra.assertProxyStartsUnderLimit("a", "128Mi"); err != nil {
+		t.Error(err)
+	}
+	if pods := infra.apps["a"]; len(pods) != 1 || pods[0] != "a-7c9d6b5f4-m2x8q" {
+		t.Errorf("got pods %v, want [a-7c9d6b5f4-m2x8q]", pods)
+	}
+	if err := infra.assertProxyStartsUnderLimit("a", "lots"); err == nil {
+		t.Error("expected an error for an invalid limit")
+	}
+	infra.teardown()
+}
+
+func TestParseProxyEnv(t *testing.T) {
+	var pod v1.Pod
+	if err := json.Unmarshal([]byte(readTestData(t, "pod-proxy-env.json")), &pod); err != nil {
+		t.Fatal(err)
+	}
+
+	env, err := parseProxyEnv(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"ISTIO_META_WORKLOAD_NAME": "a",
+		"ISTIO_PROXY_CONCURRENCY":  "2",
+	} {
+		if got := env[name]; got != want {
+			t.Errorf("got %s=%q, want %q", name, got, want)
+		}
+	}
+	if _, exists := env["APP_ENV"]; exists {
+		t.Error("env of the app container should not be returned")
+	}
+
+	pod.Spec.Containers = pod.Spec.Containers[:1]
+	if _, err = parseProxyEnv(pod); err == nil {
+		t.Error("expected an error for a pod without a proxy")
+	}
+}
+
+func TestCapturePackets(t *testing.T) {
+	var commands []string
+	tcpdump := true
+	defer stubShell(func(command string) (string, error) {
+		if !strings.HasPrefix(command, "kubectl exec a-pod ") {
+			return "", fmt.Errorf("unexpected command %q", command)
+		}
+		command = command[strings.Index(command, " -- ")+4:]
+		commands = append(commands, command)
+		switch {
+		case !tcpdump && strings.HasPrefix(command, "tcpdump "):
+			return "", errors.New(`command failed: "exec: \"tcpdump\": executable file not found in $PATH"`)
+		case strings.HasPrefix(command, "timeout "):
+			return "", fmt.Errorf("command %q failed: %v", command, timeoutExitStatus)
+		case strings.HasPrefix(command, "base64 "):
+			return "1MOyoQIABAA=\n", nil
+		}
+		return "", nil
+	})()
+
+	infra := makeTestInfra()
+	infra.apps["a"] = []string{"a-pod"}
+	if _, err := infra.capturePackets("a", "eth0", time.Second); err == nil {
+		t.Error("expected an error without the debug image")
+	}
+
+	infra.debugImagesAndMode = true
+	got, err := infra.capturePackets("a", "eth0", 1500*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pcap := []byte{0xd4, 0xc3, 0xb2, 0xa1, 0x02, 0x00, 0x04, 0x00}; !reflect.DeepEqual(got, pcap) {
+		t.Errorf("got capture %x, want %x", got, pcap)
+	}
+	want := []string{
+		"tcpdump --version",
+		"timeout -s INT 2 tcpdump -i eth0 -w " + proxyCapturePath,
+		"base64 " + proxyCapturePath,
+		"rm -f " + proxyCapturePath,
+	}
+	if !reflect.DeepEqual(commands, want) {
+		t.Errorf("got commands %q, want %q", commands, want)
+	}
+	if cmd := tcpdumpCommand("", time.Second); cmd != "timeout -s INT 1 tcpdump -i any -w "+proxyCapturePath {
+		t.Errorf("unexpected command %q for all interfaces", cmd)
+	}
+
+	tcpdump = false
+	commands = nil
+	if _, err = infra.capturePackets("a", "eth0", time.Second); err == nil || !strings.Contains(err.Error(), "tcpdump is not available") {
+		t.Errorf("expected an error for a missing tcpdump, got %v", err)
+	}
+	if len(commands) != 1 {
+		t.Errorf("expected no capture without tcpdump, got commands %q", commands)
+	}
+}
+
+func TestParseIptablesRules(t *testing.T) {
+	chains := parseIptablesRules(readTestData(t, "iptables-save.txt"))
+	if len(chains["ISTIO_OUTPUT"]) != 4 {
+		t.Errorf("expected 4 rules in ISTIO_OUTPUT, got %v", chains["ISTIO_OUTPUT"])
+	}
+	if rules, exists := chains["POSTROUTING"]; !exists || len(rules) != 0 {
+		t.Errorf("expected an empty POSTROUTING chain, got %v (%t)", rules, exists)
+	}
+	if err := checkTrafficCaptured(chains); err != nil {
+		t.Error(err)
+	}
+
+	for name, rules := range map[string]string{
+		"no chain":    "*nat\n:PREROUTING ACCEPT [0:0]\n:OUTPUT ACCEPT [0:0]\nCOMMIT\n",
+		"no redirect": "*nat\n:PREROUTING ACCEPT [0:0]\n:ISTIO_REDIRECT - [0:0]\n-A PREROUTING -j ISTIO_REDIRECT\nCOMMIT\n",
+		"no inbound": "*nat\n:PREROUTING ACCEPT [0:0]\n:ISTIO_REDIRECT - [0:0]\n" +
+			"-A ISTIO_REDIRECT -p tcp -j REDIRECT --to-ports 15001\nCOMMIT\n",
+	} {
+		if err := checkTrafficCaptured(parseIptablesRules(rules)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestAssertTrafficCaptured(t *testing.T) {
+	rules := readTestData(t, "iptables-save.txt")
+	defer stubShell(func(command string) (string, error) {
+		if !strings.HasPrefix(command, "kubectl exec a-pod ") || !strings.HasSuffix(command, " -- iptables-save -t nat") {
+			return "", fmt.Errorf("unexpected command %q", command)
+		}
+		return rules, nil
+	})()
+
+	infra := makeTestInfra()
+	infra.debugImagesAndMode = true
+	if err := infra.assertTrafficCaptured("a"); err == nil {
+		t.Error("expected an error for an app without pods")
+	}
+
+	infra.apps["a"] = []string{"a-pod"}
+	if err := infra.assertTrafficCaptured("a"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCheckPortExcluded(t *testing.T) {
+	chains := parseIptablesRules(readTestData(t, "iptables-save-excluded.txt"))
+	for _, c := range []struct {
+		port      int
+		direction string
+		excluded  bool
+	}{
+		{9090, "inbound", true},
+		{22, "inbound", true},
+		{8080, "inbound", false},
+		{7070, "inbound", false},
+		{3306, "outbound", true},
+		{5433, "outbound", true},
+		{9090, "outbound", false},
+		{3306, "sideways", false},
+	} {
+		err := checkPortExcluded(chains, c.port, c.direction)
+		if c.excluded && err != nil {
+			t.Errorf("%s port %d: unexpected error %v", c.direction, c.port, err)
+		} else if !c.excluded && err == nil {
+			t.Errorf("%s port %d: expected the port to be captured", c.direction, c.port)
+		}
+	}
+
+	// the default rules capture all inbound ports
+	if err := checkPortExcluded(parseIptablesRules(readTestData(t, "iptables-save.txt")), 9090, "inbound"); err == nil {
+		t.Error("expected an error without the inbound chain")
+	}
+}
+
+func TestAssertPortExcluded(t *testing.T) {
+	defer stubShell(func(command string) (string, error) {
+		if !strings.HasPrefix(command, "kubectl exec a-pod ") || !strings.HasSuffix(command, " -- iptables-save -t nat") {
+			return "", fmt.Errorf("unexpected command %q", command)
+		}
+		return readTestData(t, "iptables-save-excluded.txt"), nil
+	})()
+
+	infra := makeTestInfra()
+	infra.apps["a"] = []string{"a-pod"}
+	if err := infra.assertPortExcluded("a", 9090, "inbound"); err == nil {
+		t.Error("expected an error without the debug proxy")
+	}
+
+	infra.debugImagesAndMode = true
+	if err := infra.assertPortExcluded("a", 9090, "inbound"); err != nil {
+		t.Error(err)
+	}
+	if err := infra.assertPortExcluded("a", 8080, "inbound"); err == nil || !strings.Contains(err.Error(), "redirects the port first") {
+		t.Errorf("expected the port to be redirected first, got %v", err)
+	}
+}
+
+func TestCheckAppWaitedForProxy(t *testing.T) {
+	start := time.Date(2018, 1, 16, 10, 0, 0, 0, time.UTC)
+	pod := func(first string, proxyStart, appStart time.Time) v1.Pod {
+		containers := []v1.Container{{Name: first}}
+		if first == "app" {
+			containers = append(containers, v1.Container{Name: inject.ProxyContainerName})
+		} else {
+			containers = append(containers, v1.Container{Name: "app"})
+		}
+		running := func(at time.Time) v1.ContainerState {
+			return v1.ContainerState{Running: &v1.ContainerStateRunning{StartedAt: meta_v1.NewTime(at)}}
+		}
+		return v1.Pod{
+			ObjectMeta: meta_v1.ObjectMeta{Name: "a-pod"},
+			Spec:       v1.PodSpec{Containers: containers},
+			Status: v1.PodStatus{ContainerStatuses: []v1.ContainerStatus{
+				{Name: "app", State: running(appStart)},
+				{Name: inject.ProxyContainerName, State: running(proxyStart)},
+			}},
+		}
+	}
+
+	for _, c := range []struct {
+		name string
+		pod  v1.Pod
+		ok   bool
+	}{
+		{"app after proxy", pod(inject.ProxyContainerName, start, start.Add(3*time.Second)), true},
+		{"app before proxy", pod(inject.ProxyContainerName, start, start.Add(-time.Second)), false},
+		{"proxy injected last", pod("app", start, start.Add(3*time.Second)), false},
+	} {
+		if err := checkAppWaitedForProxy(c.pod); (err == nil) != c.ok {
+			t.Errorf("%s: got error %v", c.name, err)
+		}
+	}
+}
+
+func TestParseAdminClusters(t *testing.T) {
+	clusters, err := parseAdminClusters(readTestData(t, "admin-clusters-1.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range []string{
+		"out.c.app.svc.cluster.local|http",
+		"out.c.app.svc.cluster.local|http 10.4.2.9:80",
+		"out.c.app.svc.cluster.local|http|version=v2 10.4.2.9:80",
+		"in.80 127.0.0.1:80",
+	} {
+		if _, exists := clusters[item]; !exists {
+			t.Errorf("missing %q", item)
+		}
+	}
+	if _, exists := clusters["in.80 default_priority"]; exists {
+		t.Error("circuit breaker settings should not be listed as hosts")
+	}
+}
+
+func TestAssertConfigConsistent(t *testing.T) {
+	clusters := map[string]string{
+		"a-1": readTestData(t, "admin-clusters-1.txt"),
+		"a-2": readTestData(t, "admin-clusters-2.txt"),
+		"a-3": readTestData(t, "admin-clusters-1.txt"),
+	}
+	// the inbound listeners of the replicas are bound to their own pod IP
+	podIPs := map[string]string{"a-1": "10.4.1.5", "a-2": "10.4.1.5", "a-3": "10.4.1.6"}
+	listeners := map[string]string{
+		"a-1": readTestData(t, "admin-listeners-pod-1.json"),
+		"a-2": readTestData(t, "admin-listeners-pod-1.json"),
+		"a-3": readTestData(t, "admin-listeners-pod-2.json"),
+	}
+	routes := readTestData(t, "admin-routes.json")
+	defer stubShell(func(command string) (string, error) {
+		pod := strings.Fields(command)[2]
+		switch {
+		case strings.HasSuffix(command, "jsonpath={.status.podIP}"):
+			return podIPs[pod], nil
+		case strings.HasSuffix(command, "/clusters"):
+			return clusters[pod], nil
+		case strings.HasSuffix(command, "/listeners"):
+			return listeners[pod], nil
+		case strings.HasSuffix(command, "/routes"):
+			return routes, nil
+		}
+		return "", fmt.Errorf("unexpected command %q", command)
+	})()
+
+	infra := makeTestInfra()
+	if err := infra.assertConfigConsistent("a"); err == nil {
+		t.Error("expected an error for an app without pods")
+	}
+
+	infra.apps["a"] = []string{"a-1", "a-3"}
+	if err := infra.assertConfigConsistent("a"); err != nil {
+		t.Errorf("expected consistent proxies, got %v", err)
+	}
+
+	infra.apps["a"] = []string{"a-1", "a-2", "a-3"}
+	err := infra.assertConfigConsistent("a")
+	if err == nil {
+		t.Fatal("expected the stale proxy to diverge")
+	}
+	for _, want := range []string{"config of a-2 diverges", "/clusters: missing out.c.app.svc.cluster.local|http|version=v2"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %v", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), "a-3") {
+		t.Errorf("only a-2 should diverge: %v", err)
+	}
+}
+
+func TestDiffProxyConfig(t *testing.T) {
+	want := proxyConfig{"/routes": {"80": `{"virtual_hosts":[]}`, "8080": "{}"}}
+	got := proxyConfig{"/routes": {"80": `{"virtual_hosts":[{}]}`, "9090": "{}"}}
+	diffs := diffProxyConfig(want, got)
+	expected := []string{"/routes: 80 differs", "/routes: missing 8080", "/routes: unexpected 9090"}
+	if !reflect.DeepEqual(diffs, expected) {
+		t.Errorf("got diffs %v, want %v", diffs, expected)
+	}
+}
+
+func TestAssertAccessLog(t *testing.T) {
+	stream := []string{
+		"[2018-01-16 10:00:01.000][11][info][upstream] cds: add 12 cluster(s), remove 0 cluster(s)",
+		"[2018-01-16T10:00:02.100Z] \"GET /b HTTP/1.1\" 200 - 0 12 3 2 \"-\" \"Go-http-client/1.1\" \"-\" \"b\" \"10.4.2.7:80\"",
+		"[2018-01-16 10:00:02.300][11][info][main] lds: add/update listener '10.4.1.5:80'",
+		"[2018-01-16T10:00:03.200Z] upstream=10.4.2.9:80 path=/c status=200 authority=c",
+	}
+	polls := 0
+	defer stubShell(func(command string) (string, error) {
+		if !strings.HasPrefix(command, "kubectl logs a-pod ") || !strings.Contains(command, " -c "+inject.ProxyContainerName+" --since-time=") {
+			return "", fmt.Errorf("unexpected command %q", command)
+		}
+		polls++
+		if polls > len(stream) {
+			polls = len(stream)
+		}
+		return strings.Join(stream[:polls], "\n"), nil
+	})()
+
+	infra := makeTestInfra()
+	custom := func(line string) bool {
+		return strings.Contains(line, "path=/c status=200")
+	}
+	if err := infra.assertAccessLog("a", custom, time.Second); err == nil {
+		t.Error("expected an error for an app without pods")
+	}
+
+	infra.apps["a"] = []string{"a-pod"}
+	if err := infra.assertAccessLog("a", custom, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if polls != len(stream) {
+		t.Errorf("expected the entry on poll %d, got %d polls", len(stream), polls)
+	}
+
+	if err := infra.assertAccessLog("a", func(line string) bool {
+		return strings.Contains(line, "path=/d")
+	}, 0); err == nil {
+		t.Error("expected an error for a missing entry")
+	}
+}
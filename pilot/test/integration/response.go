@@ -0,0 +1,674 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/textproto"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	multierror "github.com/hashicorp/go-multierror"
+
+	"istio.io/istio/pkg/log"
+)
+
+// response body assertion helpers
+
+// bodyContains checks whether the aggregated body contains the substring
+func (r response) bodyContains(substr string) bool {
+	return strings.Contains(r.body, substr)
+}
+
+// bodyMatches checks whether the aggregated body matches the regular expression
+func (r response) bodyMatches(re *regexp.Regexp) bool {
+	return re.MatchString(r.body)
+}
+
+// bodyCount counts the occurrences of the substring across all iterations
+func (r response) bodyCount(substr string) int {
+	return strings.Count(r.body, substr)
+}
+
+// expectVersion checks that every response was served by the version
+func (r response) expectVersion(version string) error {
+	if len(r.version) == 0 {
+		return fmt.Errorf("no responses, expected version %s", version)
+	}
+	if len(r.version) != len(r.code) {
+		return fmt.Errorf("got %d versions for %d responses", len(r.version), len(r.code))
+	}
+
+	if count := counts(r.version); count[version] != len(r.version) {
+		return fmt.Errorf("expected all %d responses from version %s => Got %v", len(r.version), version, count)
+	}
+	return nil
+}
+
+// mixerDenialRex matches the body of a request denied by a Mixer check, e.g.
+// "PERMISSION_DENIED:denyall.denier.istio-system:Not allowed"
+var mixerDenialRex = regexp.MustCompile(`PERMISSION_DENIED:(.*)`)
+
+// mixerDenial returns the reason of the Mixer denial of all requests
+func (r response) mixerDenial() (string, error) {
+	if len(r.code) == 0 {
+		return "", errors.New("no responses, expected a denial")
+	}
+	if count := counts(r.code); count["403"] != len(r.code) {
+		return "", fmt.Errorf("expected all %d responses to be denied => Got %v", len(r.code), count)
+	}
+
+	match := mixerDenialRex.FindStringSubmatch(r.body)
+	if match == nil {
+		return "", fmt.Errorf("403 responses without a Mixer denial: %q", r.body)
+	}
+	return strings.TrimSpace(match[1]), nil
+}
+
+// expectDenied requests the URL from the app and checks that Mixer denied it
+func (infra *infra) expectDenied(app, url string) error {
+	reason, err := infra.clientRequest(app, url, 1, "").mixerDenial()
+	if err != nil {
+		return err
+	}
+	log.Infof("Request from %s to %s denied: %s", app, url, reason)
+	return nil
+}
+
+// httpForbidden is the status code of a request denied by an authorization policy
+const httpForbidden = "403"
+
+// maxAuthzRequests bounds the requests of an authorization matrix in flight
+var maxAuthzRequests = 8
+
+// authzMatrix requests the path from every source app to every destination
+// service, e.g. "/a" as http://<dest>/a, and returns whether the requests were
+// allowed keyed by source and destination. A request is allowed with a 200 and
+// denied with a 403, other outcomes are logged and count as denied.
+func (infra *infra) authzMatrix(sources, dests []string, url string) map[string]map[string]bool {
+	out := make(map[string]map[string]bool, len(sources))
+	for _, src := range sources {
+		out[src] = make(map[string]bool, len(dests))
+	}
+
+	inFlight := make(chan struct{}, maxAuthzRequests)
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	for _, src := range sources {
+		for _, dst := range dests {
+			inFlight <- struct{}{}
+			wg.Add(1)
+			go func(src, dst string) {
+				defer wg.Done()
+				defer func() { <-inFlight }()
+				target := fmt.Sprintf("http://%s%s", dst, url)
+				resp := infra.clientRequest(src, target, 1, "")
+				codes := counts(resp.code)
+				allowed := len(resp.code) == 1 && codes[httpOk] == 1
+				if !allowed && (len(resp.code) != 1 || codes[httpForbidden] != 1) {
+					log.Warnf("Request from %s to %s was neither allowed nor denied => Got %v", src, target, codes)
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				out[src][dst] = allowed
+			}(src, dst)
+		}
+	}
+	wg.Wait()
+	return out
+}
+
+// httpUnauthorized is the status code of a request rejected by the JWT
+// authentication of the proxy
+const httpUnauthorized = "401"
+
+// jwtRejectionRex matches the body of a request rejected by the JWT
+// authentication, e.g. "Jwt verification fails" or "Required JWT token is missing"
+var jwtRejectionRex = regexp.MustCompile(`\[\d+ body\] (.*(?i:jwt).*)`)
+
+// jwtRejection returns the reason of the JWT authentication rejecting all requests
+func (r response) jwtRejection() (string, error) {
+	if len(r.code) == 0 {
+		return "", errors.New("no responses, expected a rejection")
+	}
+	if count := counts(r.code); count[httpUnauthorized] != len(r.code) {
+		return "", fmt.Errorf("expected all %d responses to be rejected => Got %v", len(r.code), count)
+	}
+
+	match := jwtRejectionRex.FindStringSubmatch(r.body)
+	if match == nil {
+		return "", fmt.Errorf("401 responses without a JWT rejection: %q", r.body)
+	}
+	return strings.TrimSpace(match[1]), nil
+}
+
+// expectJWTRejected requests the URL from the app with the invalid token and
+// checks that the JWT authentication rejected it
+func (infra *infra) expectJWTRejected(app, url, badToken string) error {
+	reason, err := infra.requestWithJWT(app, url, badToken, 1).jwtRejection()
+	if err != nil {
+		return err
+	}
+	log.Infof("Request from %s to %s rejected: %s", app, url, reason)
+	return nil
+}
+
+// httpGatewayTimeout is the status code of a request cut off by the proxy timeout
+const httpGatewayTimeout = "504"
+
+// timeoutTolerance is the fraction of the expected timeout by which the latency of
+// a timed out request may deviate, with a floor of minTimeoutSlack
+const (
+	timeoutTolerance = 0.2
+	minTimeoutSlack  = 200 * time.Millisecond
+)
+
+// checkTimeout checks that every request timed out at the proxy after about the
+// expected timeout
+func (r response) checkTimeout(expected time.Duration) error {
+	if len(r.code) == 0 {
+		return errors.New("no responses, expected a timeout")
+	}
+	if count := counts(r.code); count[httpGatewayTimeout] != len(r.code) {
+		return fmt.Errorf("expected all %d responses to time out => Got %v", len(r.code), count)
+	}
+	if len(r.latency) != len(r.code) {
+		return fmt.Errorf("got %d latencies for %d responses", len(r.latency), len(r.code))
+	}
+
+	slack := time.Duration(float64(expected) * timeoutTolerance)
+	if slack < minTimeoutSlack {
+		slack = minTimeoutSlack
+	}
+	for _, latency := range r.latency {
+		if latency < expected-slack {
+			return fmt.Errorf("request timed out after %v, before the timeout of %v", latency, expected)
+		}
+		if latency > expected+slack {
+			return fmt.Errorf("request timed out after %v, well after the timeout of %v", latency, expected)
+		}
+	}
+	return nil
+}
+
+// assertTimeout requests the URL of a slow endpoint from the app and checks that
+// the proxy cut the request off after about the expected timeout
+func (infra *infra) assertTimeout(app, url string, expectedTimeout time.Duration) error {
+	resp := infra.clientRequest(app, url, 1, "")
+	if err := resp.checkTimeout(expectedTimeout); err != nil {
+		return err
+	}
+	log.Infof("Request from %s to %s timed out after %v", app, url, resp.latency)
+	return nil
+}
+
+// headerValues returns the values of the request header echoed by the app
+// across all responses
+func (r response) headerValues(name string) []string {
+	rex := regexp.MustCompile(`\[\d+ body\] ` + regexp.QuoteMeta(textproto.CanonicalMIMEHeaderKey(name)) + `=(.*)`)
+	var values []string
+	for _, match := range rex.FindAllStringSubmatch(r.body, -1) {
+		values = append(values, strings.TrimSpace(match[1]))
+	}
+	return values
+}
+
+// checkHeaderAdded checks that the app received the header with the value in
+// every successful request
+func (r response) checkHeaderAdded(name, value string) error {
+	if err := r.expectOk(); err != nil {
+		return err
+	}
+	values := r.headerValues(name)
+	if len(values) != len(r.code) {
+		return fmt.Errorf("header %s is missing from %d of %d requests", name, len(r.code)-len(values), len(r.code))
+	}
+	for _, v := range values {
+		if v != value {
+			return fmt.Errorf("expected header %s=%s => Got %v", name, value, values)
+		}
+	}
+	return nil
+}
+
+// checkHeaderRemoved checks that the app did not receive the header in any of
+// the successful requests
+func (r response) checkHeaderRemoved(name string) error {
+	if err := r.expectOk(); err != nil {
+		return err
+	}
+	if values := r.headerValues(name); len(values) > 0 {
+		return fmt.Errorf("expected header %s to be removed => Got %v", name, values)
+	}
+	return nil
+}
+
+// handshakeSucceeded checks that the TLS handshakes of all requests succeeded
+func (r response) handshakeSucceeded() bool {
+	if len(r.handshake) == 0 {
+		return false
+	}
+	for _, h := range r.handshake {
+		if h != "ok" {
+			return false
+		}
+	}
+	return true
+}
+
+// expectOk checks that all requests succeeded
+func (r response) expectOk() error {
+	if len(r.code) == 0 {
+		return errors.New("no responses")
+	}
+	if count := counts(r.code); count[httpOk] != len(r.code) {
+		return fmt.Errorf("expected all %d requests to succeed => Got %v", len(r.code), count)
+	}
+	return nil
+}
+
+// assertHeaderAdded requests the URL from the app and checks that the
+// destination received the header with the expected value
+func (infra *infra) assertHeaderAdded(app, url, headerName, expectedValue string) error {
+	return infra.clientRequest(app, url, 1, "").checkHeaderAdded(headerName, expectedValue)
+}
+
+// assertHeaderRemoved requests the URL from the app and checks that the
+// destination did not receive the header
+func (infra *infra) assertHeaderRemoved(app, url, headerName string) error {
+	return infra.clientRequest(app, url, 1, "").checkHeaderRemoved(headerName)
+}
+
+// sourceRoutingRequests is the number of requests sent from each source by
+// assertSourceLabelRouting
+const sourceRoutingRequests = 10
+
+// checkSourceLabelRouting checks that the requests of the matching source were
+// all served by the version and that the requests of the other source were not
+func checkSourceLabelRouting(matched, other response, version string) error {
+	if err := matched.expectVersion(version); err != nil {
+		return fmt.Errorf("matching source: %v", err)
+	}
+	if len(other.version) == 0 {
+		return errors.New("no responses for the other source")
+	}
+	if count := counts(other.version); count[version] == len(other.version) {
+		return fmt.Errorf("expected the other source to reach versions other than %s => Got %v", version, count)
+	}
+	return nil
+}
+
+// otherSource returns the first sidecar app other than the source and the
+// service, or "" if there is none
+func (infra *infra) otherSource(fromApp, toService string) string {
+	for _, app := range infra.sidecarApps() {
+		if app != fromApp && app != toService {
+			return app
+		}
+	}
+	return ""
+}
+
+// assertSourceLabelRouting checks that the requests from the app, whose labels
+// match the source of a route rule, are routed to the version of the service,
+// while the requests from another sidecar app, labeled with its own name, are
+// not. The source labels of the apps are set with the labels option of their
+// deployment.
+func (infra *infra) assertSourceLabelRouting(fromApp, toService, url, expectedVersion string) error {
+	otherApp := infra.otherSource(fromApp, toService)
+	if otherApp == "" {
+		return fmt.Errorf("no other source than %s to request %s from", fromApp, toService)
+	}
+	matched := infra.clientRequest(fromApp, url, sourceRoutingRequests, "")
+	other := infra.clientRequest(otherApp, url, sourceRoutingRequests, "")
+	if err := checkSourceLabelRouting(matched, other, expectedVersion); err != nil {
+		return fmt.Errorf("routing of %s from %s and %s: %v", toService, fromApp, otherApp, err)
+	}
+	return nil
+}
+
+// faultTolerance is the fraction of requests allowed to deviate from the
+// expected fault scoping
+const faultTolerance = 0.1
+
+// faultRate returns the fraction of requests aborted by a fault
+func (r response) faultRate() float64 {
+	if len(r.code) == 0 {
+		return 0
+	}
+	return float64(len(r.code)-counts(r.code)[httpOk]) / float64(len(r.code))
+}
+
+// checkFaultScoped checks that the faults aborted the matched requests and
+// spared the unmatched ones, within faultTolerance
+func checkFaultScoped(matched, unmatched response, count int) error {
+	if len(matched.code) != count || len(unmatched.code) != count {
+		return fmt.Errorf("expected %d responses => Got %d matched and %d unmatched", count, len(matched.code), len(unmatched.code))
+	}
+	if rate := matched.faultRate(); rate < 1-faultTolerance {
+		return fmt.Errorf("expected faults in matched requests => Got %v", counts(matched.code))
+	}
+	if rate := unmatched.faultRate(); rate > faultTolerance {
+		return fmt.Errorf("expected no faults in unmatched requests => Got %v", counts(unmatched.code))
+	}
+	return nil
+}
+
+// assertFaultScoped requests both URLs from the app and checks that an abort
+// fault applies to the requests of matchURL only
+func (infra *infra) assertFaultScoped(app, matchURL, nonMatchURL string, count int) error {
+	matched := infra.clientRequest(app, matchURL, count, "")
+	unmatched := infra.clientRequest(app, nonMatchURL, count, "")
+	return checkFaultScoped(matched, unmatched, count)
+}
+
+// traceIDHeader is the B3 header carrying the trace id of a request
+const traceIDHeader = "x-b3-traceid"
+
+// checkTracePropagated checks that every request was served by one of the
+// pods and that the pod received the trace id
+func (r response) checkTracePropagated(pods []string, traceID string) error {
+	if err := r.expectOk(); err != nil {
+		return err
+	}
+	hostnames := r.headerValues("Hostname")
+	if len(hostnames) != len(r.code) {
+		return fmt.Errorf("hostname is missing from %d of %d responses", len(r.code)-len(hostnames), len(r.code))
+	}
+	for _, hostname := range hostnames {
+		if !containsString(pods, hostname) {
+			return fmt.Errorf("expected responses from pods %v => Got %s", pods, hostname)
+		}
+	}
+	return r.checkHeaderAdded(traceIDHeader, traceID)
+}
+
+// assertTracePropagation requests the URL from the app with a known B3 trace id
+// and checks that the destination app received the same trace id
+func (infra *infra) assertTracePropagation(fromApp, toApp, url string) error {
+	pods := infra.apps[toApp]
+	if len(pods) == 0 {
+		return fmt.Errorf("missing pod names for app %q", toApp)
+	}
+	traceID := fmt.Sprintf("%016x", time.Now().UnixNano())
+	return infra.requestWithHeader(fromApp, url, traceIDHeader, traceID, 1).checkTracePropagated(pods, traceID)
+}
+
+// distributionBatch is the number of requests sampled per distribution check
+const distributionBatch = 100
+
+// versionDistribution returns the fraction of the responses served by each version
+func (r response) versionDistribution() map[string]float64 {
+	out := make(map[string]float64)
+	for version, count := range counts(r.version) {
+		out[version] = float64(count) / float64(len(r.version))
+	}
+	return out
+}
+
+// checkDistribution checks that the observed fraction of every version is within
+// the tolerance of the wanted fraction, versions which are not wanted count as zero
+func checkDistribution(got, want map[string]float64, tolerance float64) error {
+	if len(got) == 0 {
+		return errors.New("no responses with a version")
+	}
+	for version, fraction := range want {
+		if math.Abs(got[version]-fraction) > tolerance {
+			return fmt.Errorf("expected %.2f (+/-%.2f) of the requests to reach %s => Got %v", fraction, tolerance, version, got)
+		}
+	}
+	for version, fraction := range got {
+		if _, exists := want[version]; !exists && fraction > tolerance {
+			return fmt.Errorf("expected no requests to reach %s => Got %v", version, got)
+		}
+	}
+	return nil
+}
+
+// assertEventualDistribution sends batches of requests from the app until the
+// distribution of the versions serving them is within the tolerance of the
+// wanted fractions, e.g. while a weight change reaches all the proxies
+func (infra *infra) assertEventualDistribution(app, url string, want map[string]float64, tolerance float64,
+	timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		got := infra.clientRequest(app, url, distributionBatch, "").versionDistribution()
+		err := checkDistribution(got, want, tolerance)
+		if err == nil {
+			log.Infof("Requests from %s to %s converged to %v", app, url, got)
+			return nil
+		}
+		log.Infof("Requests from %s to %s did not converge yet: %v", app, url, err)
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %v waiting for the distribution of %s: %v", timeout, url, err)
+		}
+		if err = infra.sleep(pollInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// responses aggregates the responses of a load run
+type responses []response
+
+// latencyPercentiles returns the nearest rank percentiles, in the range [0, 100],
+// of the request latencies across all responses. Percentiles are zero if no
+// latency was reported.
+func (rs responses) latencyPercentiles(ps ...float64) map[float64]time.Duration {
+	var latencies []time.Duration
+	for _, r := range rs {
+		latencies = append(latencies, r.latency...)
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	out := make(map[float64]time.Duration, len(ps))
+	for _, p := range ps {
+		if len(latencies) == 0 {
+			out[p] = 0
+			continue
+		}
+		rank := int(math.Ceil(p / 100 * float64(len(latencies))))
+		if rank < 1 {
+			rank = 1
+		} else if rank > len(latencies) {
+			rank = len(latencies)
+		}
+		out[p] = latencies[rank-1]
+	}
+	return out
+}
+
+var (
+	// rampTick is the interval between two request batches of a ramp
+	rampTick = time.Second
+
+	// maxRampBatches bounds the request batches of a ramp in flight
+	maxRampBatches = 8
+)
+
+// rampBatchSizes returns the number of requests of each tick of a linear ramp
+// from startRPS to endRPS, sampling the rate in the middle of each tick
+func rampBatchSizes(startRPS, endRPS int, duration time.Duration) []int {
+	ticks := int(duration / rampTick)
+	sizes := make([]int, ticks)
+	for i := range sizes {
+		rate := float64(startRPS) + float64(endRPS-startRPS)*(float64(i)+0.5)/float64(ticks)
+		sizes[i] = int(math.Floor(rate*rampTick.Seconds() + 0.5))
+	}
+	return sizes
+}
+
+// clientRamp sends requests from the app with a rate increasing linearly from
+// startRPS to endRPS over the duration, e.g. to see circuit breakers engage. A
+// batch of requests is issued every tick and at most maxRampBatches are in flight,
+// so the rate of slow responses lags behind the ramp.
+func (infra *infra) clientRamp(app, url string, startRPS, endRPS int, duration time.Duration) (responses, error) {
+	if len(infra.apps[app]) == 0 {
+		return nil, fmt.Errorf("missing pod names for app %q", app)
+	}
+	if startRPS < 0 || endRPS < 0 || duration < rampTick {
+		return nil, fmt.Errorf("invalid ramp from %d to %d requests per second over %v", startRPS, endRPS, duration)
+	}
+
+	sizes := rampBatchSizes(startRPS, endRPS, duration)
+	out := make(responses, len(sizes))
+	inFlight := make(chan struct{}, maxRampBatches)
+	ticker := time.NewTicker(rampTick)
+	defer ticker.Stop()
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		errs   error
+		ctxErr error
+	)
+	for i, size := range sizes {
+		if size > 0 {
+			inFlight <- struct{}{}
+			wg.Add(1)
+			go func(i, size int) {
+				defer wg.Done()
+				defer func() { <-inFlight }()
+				resp := infra.clientRequest(app, url, size, "")
+				mu.Lock()
+				defer mu.Unlock()
+				out[i] = resp
+				if len(resp.code) == 0 {
+					errs = multierror.Append(errs, fmt.Errorf("batch %d of %d requests from %s to %s failed", i, size, app, url))
+				}
+			}(i, size)
+		}
+
+		if i == len(sizes)-1 {
+			break
+		}
+		select {
+		case <-ticker.C:
+		case <-infra.context().Done():
+			ctxErr = infra.context().Err()
+		}
+		if ctxErr != nil {
+			break
+		}
+	}
+	wg.Wait()
+	infra.recordLatencies(fmt.Sprintf("ramp %s %s", app, url), out)
+
+	if ctxErr != nil {
+		return out, ctxErr
+	}
+	return out, errs
+}
+
+// drainBatchSize is the number of requests of each batch of the load sent while
+// a pod drains
+const drainBatchSize = 10
+
+// no5xx checks that no request of the load failed with a server error and that
+// every batch got responses, a failed client counts as failed requests
+func (rs responses) no5xx() error {
+	var errs error
+	for i, r := range rs {
+		if len(r.code) == 0 {
+			errs = multierror.Append(errs, fmt.Errorf("batch %d got no responses", i))
+			continue
+		}
+		failed := 0
+		for _, code := range r.code {
+			if strings.HasPrefix(code, "5") {
+				failed++
+			}
+		}
+		if failed > 0 {
+			errs = multierror.Append(errs, fmt.Errorf("batch %d got %d of %d server errors: %v", i, failed, len(r.code), r.code))
+		}
+	}
+	return errs
+}
+
+// assertDrainCompletes deletes the first pod of the app while the second pod
+// sends continuous load to the service of the app, and checks that no request
+// failed and that the pod terminated within the deadline. The terminated pod is
+// dropped from the pods of the app, its replacement is not waited for.
+func (infra *infra) assertDrainCompletes(app string, deadline time.Duration) error {
+	pods := infra.apps[app]
+	if len(pods) < 2 {
+		return fmt.Errorf("draining a pod of %q without downtime requires 2 pods, got %d", app, len(pods))
+	}
+	pod, url := pods[0], "http://"+app
+
+	stop := make(chan struct{})
+	loaded := make(chan responses)
+	go func() {
+		var out responses
+		for {
+			out = append(out, infra.clientRequestFromPod(app, 1, url, drainBatchSize, ""))
+			select {
+			case <-stop:
+				loaded <- out
+				return
+			default:
+			}
+		}
+	}()
+
+	start := time.Now()
+	terminated := infra.deletePod(app, 0, defaultGracePeriod)
+	if terminated == nil {
+		terminated = infra.waitForPodDeleted(pod, deadline-time.Since(start))
+	}
+	close(stop)
+	out := <-loaded
+	infra.recordLatencies(fmt.Sprintf("drain %s", app), out)
+	if terminated != nil {
+		return fmt.Errorf("pod %s of %s did not drain within %v: %v", pod, app, deadline, terminated)
+	}
+	log.Infof("Pod %s of %s terminated after %v", pod, app, time.Since(start))
+	infra.apps[app] = append([]string(nil), pods[1:]...)
+
+	if err := out.no5xx(); err != nil {
+		return fmt.Errorf("requests to %s failed while pod %s drained: %v", app, pod, err)
+	}
+	return nil
+}
+
+// waitForPodDeleted polls the pod in the app namespace until it is deleted
+func (infra *infra) waitForPodDeleted(pod string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		_, err := shell(fmt.Sprintf("kubectl get pod %s --kubeconfig %s -n %s -o name",
+			pod, kubeconfig, infra.Namespace))
+		if err != nil && strings.Contains(err.Error(), "NotFound") {
+			return nil
+		} else if err != nil {
+			log.Infof("Failed to get pod %s: %v", pod, err)
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("pod %s did not terminate within %v", pod, timeout)
+		}
+		if err = infra.sleep(pollInterval); err != nil {
+			return err
+		}
+	}
+}
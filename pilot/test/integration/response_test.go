@@ -0,0 +1,571 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testResponseBody = `[0] ServiceVersion=v1
+[0] StatusCode=200
+[0] X-Forwarded-For=10.0.0.1
+[1] ServiceVersion=v2
+[1] StatusCode=200
+[1] X-Forwarded-For=10.0.0.1
+`
+
+func TestResponseBodyHelpers(t *testing.T) {
+	resp := response{body: testResponseBody}
+
+	cases := []struct {
+		name     string
+		contains string
+		re       *regexp.Regexp
+		want     bool
+		count    int
+	}{
+		{
+			name:     "present",
+			contains: "X-Forwarded-For",
+			re:       regexp.MustCompile("(?i)x-forwarded-for=10\\.0\\.0\\.1"),
+			want:     true,
+			count:    2,
+		},
+		{
+			name:     "absent",
+			contains: "X-Envoy-Upstream",
+			re:       regexp.MustCompile("ServiceVersion=v3"),
+			want:     false,
+			count:    0,
+		},
+		{
+			name:     "single iteration",
+			contains: "ServiceVersion=v2",
+			re:       regexp.MustCompile(`\[1\] ServiceVersion=v\d`),
+			want:     true,
+			count:    1,
+		},
+	}
+
+	for _, c := range cases {
+		if got := resp.bodyContains(c.contains); got != c.want {
+			t.Errorf("%s: bodyContains(%q) => got %t, want %t", c.name, c.contains, got, c.want)
+		}
+		if got := resp.bodyMatches(c.re); got != c.want {
+			t.Errorf("%s: bodyMatches(%v) => got %t, want %t", c.name, c.re, got, c.want)
+		}
+		if got := resp.bodyCount(c.contains); got != c.count {
+			t.Errorf("%s: bodyCount(%q) => got %d, want %d", c.name, c.contains, got, c.count)
+		}
+	}
+}
+
+func TestResponseExpectVersion(t *testing.T) {
+	cases := []struct {
+		name string
+		body string
+		ok   bool
+	}{
+		{
+			name: "single version",
+			body: "[0] StatusCode=200\n[0 body] ServiceVersion=v2\n[1] StatusCode=200\n[1 body] ServiceVersion=v2\n",
+			ok:   true,
+		},
+		{
+			name: "mixed versions",
+			body: "[0] StatusCode=200\n[0 body] ServiceVersion=v2\n[1] StatusCode=200\n[1 body] ServiceVersion=v1\n",
+		},
+		{
+			name: "failed request",
+			body: "[0] StatusCode=200\n[0 body] ServiceVersion=v2\n[1] StatusCode=503\n",
+		},
+		{
+			name: "no responses",
+			body: "",
+		},
+	}
+
+	for _, c := range cases {
+		err := parseResponse(c.body).expectVersion("v2")
+		if c.ok && err != nil {
+			t.Errorf("%s: unexpected error %v", c.name, err)
+		} else if !c.ok && err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+	}
+}
+
+func TestLatencyPercentiles(t *testing.T) {
+	// latencies of 1ms to 100ms in reverse order split across two responses
+	var outputs [2]string
+	for i := 100; i > 0; i-- {
+		outputs[i%2] += fmt.Sprintf("[%d] StatusCode=200\n[%d] Latency=%dms\n", i, i, i)
+	}
+	rs := responses{parseResponse(outputs[0]), parseResponse(outputs[1])}
+
+	got := rs.latencyPercentiles(50, 99)
+	if got[50] != 50*time.Millisecond || got[99] != 99*time.Millisecond {
+		t.Errorf("got p50 %v and p99 %v, want 50ms and 99ms", got[50], got[99])
+	}
+
+	if got = (responses{}).latencyPercentiles(50, 99); got[50] != 0 || got[99] != 0 {
+		t.Errorf("expected zero percentiles without latencies, got %v", got)
+	}
+}
+
+func TestMixerDenial(t *testing.T) {
+	reason, err := parseResponse(readTestData(t, "denied-response.txt")).mixerDenial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "denyc.denier.istio-system:Not allowed"; reason != want {
+		t.Errorf("got denial reason %q, want %q", reason, want)
+	}
+
+	for _, out := range []string{
+		"",
+		"[0] StatusCode=200\n[0 body] ServiceVersion=v1\n",
+		"[0] StatusCode=403\n[0 body] RBAC: access denied\n",
+	} {
+		if _, err = parseResponse(out).mixerDenial(); err == nil {
+			t.Errorf("expected an error for %q", out)
+		}
+	}
+}
+
+func TestJWTRejection(t *testing.T) {
+	reason, err := parseResponse(readTestData(t, "jwt-rejected-response.txt")).jwtRejection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Jwt verification fails"; reason != want {
+		t.Errorf("got rejection reason %q, want %q", reason, want)
+	}
+
+	accepted := parseResponse(readTestData(t, "jwt-accepted-response.txt"))
+	if err = accepted.expectOk(); err != nil {
+		t.Errorf("unexpected error for the accepted token %v", err)
+	}
+	for _, r := range []response{
+		accepted,
+		parseResponse(""),
+		parseResponse("[0] StatusCode=401\n[0 body] Unauthorized\n"),
+	} {
+		if _, err = r.jwtRejection(); err == nil {
+			t.Errorf("expected an error for %q", r.body)
+		}
+	}
+}
+
+func TestRequestWithJWT(t *testing.T) {
+	var commands []string
+	defer stubShell(func(command string) (string, error) {
+		commands = append(commands, command)
+		return readTestData(t, "jwt-rejected-response.txt"), nil
+	})()
+
+	infra := makeTestInfra()
+	infra.apps = map[string][]string{"a": {"a-pod"}}
+	if err := infra.expectJWTRejected("a", "http://c/a", "bad.token.sig"); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if len(commands) != 1 || !strings.HasSuffix(commands[0], " -- client -url http://c/a -count 1 -token bad.token.sig") {
+		t.Errorf("unexpected commands %q", commands)
+	}
+
+	if resp := infra.requestWithJWT("a", "http://c/a", "bad token", 1); len(resp.code) != 0 || len(commands) != 1 {
+		t.Errorf("expected no request for a token with whitespace, got %q", commands)
+	}
+}
+
+func TestCheckTimeout(t *testing.T) {
+	resp := parseResponse(readTestData(t, "timeout-response.txt"))
+	if err := resp.checkTimeout(time.Second); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	for _, expected := range []time.Duration{3 * time.Second, 200 * time.Millisecond} {
+		if err := resp.checkTimeout(expected); err == nil {
+			t.Errorf("expected an error for a timeout of %v", expected)
+		}
+	}
+
+	for _, out := range []string{
+		"",
+		"[0] StatusCode=200\n[0] Latency=1s\n",
+		"[0] StatusCode=504\n",
+	} {
+		if err := parseResponse(out).checkTimeout(time.Second); err == nil {
+			t.Errorf("expected an error for %q", out)
+		}
+	}
+}
+
+func TestCheckHeaders(t *testing.T) {
+	added := parseResponse(readTestData(t, "header-added-response.txt"))
+	if err := added.checkHeaderAdded("x-istio-test", "added"); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := added.checkHeaderAdded("X-Istio-Test", "other"); err == nil {
+		t.Error("expected an error for a different header value")
+	}
+	if err := added.checkHeaderRemoved("X-Istio-Test"); err == nil {
+		t.Error("expected an error for a header which is present")
+	}
+
+	removed := parseResponse(readTestData(t, "header-removed-response.txt"))
+	if err := removed.checkHeaderRemoved("X-Istio-Test"); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := removed.checkHeaderAdded("X-Istio-Test", "added"); err == nil {
+		t.Error("expected an error for a missing header")
+	}
+
+	if err := parseResponse("[0] StatusCode=503\n").checkHeaderRemoved("X-Istio-Test"); err == nil {
+		t.Error("expected an error for a failed request")
+	}
+}
+
+func TestCheckTracePropagated(t *testing.T) {
+	traced := parseResponse(readTestData(t, "trace-response.txt"))
+	pods := []string{"c-v1-6d8c9b7f4-q2xbn"}
+	if err := traced.checkTracePropagated(pods, "463ac35c9f6413ad"); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := traced.checkTracePropagated(pods, "80f198ee56343ba8"); err == nil {
+		t.Error("expected an error for a different trace id")
+	}
+	if err := traced.checkTracePropagated([]string{"b-v1-7f9c8d6b5-x4kz2"}, "463ac35c9f6413ad"); err == nil {
+		t.Error("expected an error for a response from another app")
+	}
+
+	untraced := parseResponse(readTestData(t, "header-added-response.txt"))
+	if err := untraced.checkTracePropagated(pods, "463ac35c9f6413ad"); err == nil {
+		t.Error("expected an error for a request without the trace id")
+	}
+}
+
+func TestCheckFaultScoped(t *testing.T) {
+	matched := parseResponse(readTestData(t, "fault-matched-response.txt"))
+	unmatched := parseResponse(readTestData(t, "fault-unmatched-response.txt"))
+	bleed := parseResponse(readTestData(t, "fault-bleed-response.txt"))
+
+	if err := checkFaultScoped(matched, unmatched, 10); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := checkFaultScoped(matched, bleed, 10); err == nil {
+		t.Error("expected an error for faults in unmatched requests")
+	}
+	if err := checkFaultScoped(unmatched, unmatched, 10); err == nil {
+		t.Error("expected an error for matched requests without faults")
+	}
+	if err := checkFaultScoped(matched, unmatched, 20); err == nil {
+		t.Error("expected an error for missing responses")
+	}
+}
+
+func TestAssertFaultScoped(t *testing.T) {
+	defer stubShell(func(command string) (string, error) {
+		if strings.Contains(command, "-url http://c/faulty ") {
+			return readTestData(t, "fault-matched-response.txt"), nil
+		}
+		return readTestData(t, "fault-unmatched-response.txt"), nil
+	})()
+
+	infra := makeTestInfra()
+	infra.apps = map[string][]string{"a": {"a-pod"}}
+	if err := infra.assertFaultScoped("a", "http://c/faulty", "http://c/a", 10); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := infra.assertFaultScoped("a", "http://c/a", "http://c/faulty", 10); err == nil {
+		t.Error("expected an error for faults on the unmatched URL")
+	}
+}
+
+func TestCheckSourceLabelRouting(t *testing.T) {
+	matched := parseResponse(versionOutput(10, "v2"))
+	split := parseResponse(versionOutput(10, "v1", "v2"))
+
+	if err := checkSourceLabelRouting(matched, split, "v2"); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := checkSourceLabelRouting(split, split, "v2"); err == nil {
+		t.Error("expected an error for a matching source reaching several versions")
+	}
+	if err := checkSourceLabelRouting(matched, matched, "v2"); err == nil {
+		t.Error("expected an error for the other source routed like the matching source")
+	}
+	if err := checkSourceLabelRouting(matched, response{}, "v2"); err == nil {
+		t.Error("expected an error without responses for the other source")
+	}
+}
+
+func TestAssertSourceLabelRouting(t *testing.T) {
+	var sources []string
+	defer stubShell(func(command string) (string, error) {
+		pod := strings.Fields(command)[2]
+		sources = append(sources, pod)
+		if pod == "a-pod" {
+			return versionOutput(sourceRoutingRequests, "v2"), nil
+		}
+		return versionOutput(sourceRoutingRequests, "v1", "v2"), nil
+	})()
+
+	infra := makeTestInfra()
+	// the destination and the apps without sidecar are not used as the other source
+	infra.apps = map[string][]string{"a": {"a-pod"}, "b": {"b-pod"}, "c": {"c-v1-pod"}, "t": {"t-pod"}}
+	if err := infra.assertSourceLabelRouting("a", "c", "http://c/a", "v2"); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if want := []string{"a-pod", "b-pod"}; !reflect.DeepEqual(sources, want) {
+		t.Errorf("got requests from %v, want %v", sources, want)
+	}
+	if err := infra.assertSourceLabelRouting("b", "c", "http://c/a", "v2"); err == nil {
+		t.Error("expected an error for a source not matching the route rule")
+	}
+
+	infra.apps = map[string][]string{"a": {"a-pod"}, "c": {"c-v1-pod"}}
+	if err := infra.assertSourceLabelRouting("a", "c", "http://c/a", "v2"); err == nil {
+		t.Error("expected an error without another source")
+	}
+}
+
+// versionOutput returns the client output of requests served by the versions in turn
+func versionOutput(count int, versions ...string) string {
+	var out bytes.Buffer
+	for i := 0; i < count; i++ {
+		fmt.Fprintf(&out, "[%d] StatusCode=200\n[%d body] ServiceVersion=%s\n", i, i, versions[i%len(versions)])
+	}
+	return out.String()
+}
+
+func TestAssertEventualDistribution(t *testing.T) {
+	batches := 0
+	defer stubShell(func(string) (string, error) {
+		batches++
+		if batches < 3 {
+			return versionOutput(distributionBatch, "v1"), nil
+		}
+		return versionOutput(distributionBatch, "v1", "v2"), nil
+	})()
+
+	infra := makeTestInfra()
+	infra.apps["a"] = []string{"a-pod"}
+	want := map[string]float64{"v1": 0.5, "v2": 0.5}
+	if err := infra.assertEventualDistribution("a", "http://c/a", want, 0.05, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if batches != 3 {
+		t.Errorf("got %d batches, want 3", batches)
+	}
+}
+
+func TestAssertEventualDistributionTimeout(t *testing.T) {
+	defer stubShell(func(string) (string, error) {
+		return versionOutput(distributionBatch, "v1", "v1", "v1", "v2"), nil
+	})()
+
+	infra := makeTestInfra()
+	infra.apps["a"] = []string{"a-pod"}
+	err := infra.assertEventualDistribution("a", "http://c/a", map[string]float64{"v2": 1}, 0.05, 10*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "v1:0.75") {
+		t.Errorf("expected a timeout with the last distribution, got %v", err)
+	}
+}
+
+func TestClientRamp(t *testing.T) {
+	defer func(tick time.Duration) { rampTick = tick }(rampTick)
+	rampTick = 10 * time.Millisecond
+
+	var mu sync.Mutex
+	var requests, batches int
+	defer stubShell(func(command string) (string, error) {
+		var count int
+		if _, err := fmt.Sscanf(command[strings.Index(command, " -count "):], " -count %d", &count); err != nil {
+			return "", err
+		}
+		mu.Lock()
+		requests += count
+		batches++
+		mu.Unlock()
+		return versionOutput(count, "v1"), nil
+	})()
+
+	infra := makeTestInfra()
+	if _, err := infra.clientRamp("a", "http://c/a", 1000, 3000, 100*time.Millisecond); err == nil {
+		t.Error("expected an error for an app without pods")
+	}
+
+	infra.apps["a"] = []string{"a-pod"}
+	got, err := infra.clientRamp("a", "http://c/a", 1000, 3000, 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a ramp from 10 to 30 requests per tick over 10 ticks
+	if requests < 190 || requests > 210 {
+		t.Errorf("got %d requests, want about 200", requests)
+	}
+	if batches != 10 || len(got) != 10 {
+		t.Errorf("got %d batches and %d responses, want 10", batches, len(got))
+	}
+	if len(got[0].code) >= len(got[9].code) {
+		t.Errorf("expected the batches to grow, got %d then %d requests", len(got[0].code), len(got[9].code))
+	}
+
+	if _, err = infra.clientRamp("a", "http://c/a", 10, 20, time.Millisecond); err == nil {
+		t.Error("expected an error for a ramp shorter than a tick")
+	}
+}
+
+func TestAuthzMatrix(t *testing.T) {
+	defer func(max int) { maxAuthzRequests = max }(maxAuthzRequests)
+	maxAuthzRequests = 2
+
+	// a may call b and c, b may call c, d is unreachable
+	policy := map[string]string{
+		"a-pod http://b/authz": httpOk,
+		"a-pod http://c/authz": httpOk,
+		"a-pod http://d/authz": "503",
+		"b-pod http://b/authz": httpForbidden,
+		"b-pod http://c/authz": httpOk,
+		"b-pod http://d/authz": "503",
+	}
+	var (
+		mu                    sync.Mutex
+		inFlight, maxInFlight int
+		requests              int
+	)
+	defer stubShell(func(command string) (string, error) {
+		mu.Lock()
+		inFlight++
+		requests++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		defer func() {
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+		}()
+
+		var url string
+		if _, err := fmt.Sscanf(command[strings.Index(command, " -url "):], " -url %s", &url); err != nil {
+			return "", err
+		}
+		code, exists := policy[strings.Fields(command)[2]+" "+url]
+		if !exists {
+			return "", fmt.Errorf("unexpected command %q", command)
+		}
+		return fmt.Sprintf("[0] Url=%s\n[0] StatusCode=%s\n", url, code), nil
+	})()
+
+	infra := makeTestInfra()
+	infra.apps["a"] = []string{"a-pod"}
+	infra.apps["b"] = []string{"b-pod"}
+	got := infra.authzMatrix([]string{"a", "b"}, []string{"b", "c", "d"}, "/authz")
+	want := map[string]map[string]bool{
+		"a": {"b": true, "c": true, "d": false},
+		"b": {"b": false, "c": true, "d": false},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got matrix %v, want %v", got, want)
+	}
+	if requests != 6 {
+		t.Errorf("got %d requests, want 6", requests)
+	}
+	if maxInFlight > 2 {
+		t.Errorf("got %d requests in flight, want at most 2", maxInFlight)
+	}
+}
+
+func TestNo5xx(t *testing.T) {
+	ok := parseResponse(versionOutput(3, "v1"))
+	failed := parseResponse("[0] StatusCode=200\n[1] StatusCode=503\n[2] StatusCode=404\n")
+	if err := (responses{ok, ok}).no5xx(); err != nil {
+		t.Error(err)
+	}
+	if err := (responses{ok, failed}).no5xx(); err == nil || !strings.Contains(err.Error(), "batch 1 got 1 of 3 server errors") {
+		t.Errorf("expected a server error in batch 1, got %v", err)
+	}
+	if err := (responses{{}, ok}).no5xx(); err == nil || !strings.Contains(err.Error(), "batch 0 got no responses") {
+		t.Errorf("expected a failed batch, got %v", err)
+	}
+}
+
+func TestAssertDrainCompletes(t *testing.T) {
+	var mu sync.Mutex
+	var deleted []string
+	polls, failDuringDrain := 0, false
+	defer stubShell(func(command string) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case strings.HasPrefix(command, "kubectl exec b-pod-2 ") && strings.Contains(command, " client -url http://b -count 10 "):
+			if failDuringDrain && len(deleted) > 0 {
+				return "[0] StatusCode=200\n[1] StatusCode=503\n", nil
+			}
+			return versionOutput(drainBatchSize, "v1"), nil
+		case strings.HasPrefix(command, "kubectl delete pod "):
+			deleted = append(deleted, strings.Fields(command)[3])
+			return "", nil
+		case strings.HasPrefix(command, "kubectl get pod b-pod-1 "):
+			// the pod terminates on the third poll
+			if polls++; polls%3 != 0 {
+				return "pod/b-pod-1", nil
+			}
+			return "", fmt.Errorf("command %q failed: %q exit status 1", command, `Error from server (NotFound): pods "b-pod-1" not found`)
+		}
+		return "", fmt.Errorf("unexpected command %q", command)
+	})()
+
+	infra := makeTestInfra()
+	infra.apps["b"] = []string{"b-pod-1"}
+	if err := infra.assertDrainCompletes("b", time.Minute); err == nil {
+		t.Error("expected an error for an app with a single pod")
+	}
+
+	infra.apps["b"] = []string{"b-pod-1", "b-pod-2"}
+	if err := infra.assertDrainCompletes("b", time.Minute); err != nil {
+		t.Error(err)
+	}
+	if len(deleted) != 1 || deleted[0] != "b-pod-1" {
+		t.Errorf("expected pod b-pod-1 to be deleted, got %v", deleted)
+	}
+	if pods := infra.apps["b"]; len(pods) != 1 || pods[0] != "b-pod-2" {
+		t.Errorf("expected the terminated pod to be dropped, got %v", pods)
+	}
+
+	deleted, failDuringDrain = nil, true
+	infra.apps["b"] = []string{"b-pod-1", "b-pod-2"}
+	if err := infra.assertDrainCompletes("b", time.Minute); err == nil || !strings.Contains(err.Error(), "server errors") {
+		t.Errorf("expected failed requests during the drain, got %v", err)
+	}
+
+	// the pod is still terminating at the deadline
+	deleted, failDuringDrain = nil, false
+	infra.apps["b"] = []string{"b-pod-1", "b-pod-2"}
+	if err := infra.assertDrainCompletes("b", 0); err == nil || !strings.Contains(err.Error(), "did not drain within") {
+		t.Errorf("expected the drain to time out, got %v", err)
+	}
+}
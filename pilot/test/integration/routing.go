@@ -20,7 +20,6 @@ import (
 	"fmt"
 	"regexp"
 	"strconv"
-	"strings"
 	"time"
 
 	multierror "github.com/hashicorp/go-multierror"
@@ -132,7 +131,7 @@ func (t *routing) run() error {
 			return err
 		}
 
-		if err := repeat(cs.check, 3, time.Second); err != nil {
+		if err := t.repeat(cs.check, 3, time.Second); err != nil {
 			log.Infof("Failed the test with %v", err)
 			errs = multierror.Append(errs, multierror.Prefix(err, cs.description))
 		} else {
@@ -197,7 +196,7 @@ func (t *routing) verifyDecorator(operation string) error {
 	}
 
 	text := fmt.Sprintf("\"name\":\"%s\"", operation)
-	if strings.Count(response.body, text) != 10 {
+	if response.bodyCount(text) != 10 {
 		return errAgain
 	}
 
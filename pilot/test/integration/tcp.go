@@ -81,5 +81,5 @@ func (t *tcp) run() error {
 			}
 		}
 	}
-	return parallel(funcs)
+	return t.parallel(funcs)
 }
@@ -16,7 +16,6 @@ package main
 
 import (
 	"fmt"
-	"strings"
 	"sync"
 
 	uuid "github.com/satori/go.uuid"
@@ -76,7 +75,7 @@ func (t *zipkin) makeRequests() error {
 			return errAgain
 		}
 	}
-	return parallel(funcs)
+	return t.parallel(funcs)
 }
 
 // verify that the traces were picked up by Zipkin
@@ -96,14 +95,14 @@ func (t *zipkin) verifyTraces() error {
 
 			// ensure that sent trace IDs are a subset of the trace IDs in Zipkin.
 			// this is inefficient, but the alternatives are ugly regexps or extensive JSON parsing.
-			if !strings.Contains(response.body, id) {
+			if !response.bodyContains(id) {
 				return errAgain
 			}
 		}
 		return nil
 	}
 
-	return parallel(map[string]func() status{
+	return t.parallel(map[string]func() status{
 		"Ensure traces are picked up by Zipkin": f,
 	})
 }
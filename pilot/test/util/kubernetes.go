@@ -100,7 +100,7 @@ func describeNotReadyPods(items []v1.Pod, kubeconfig, ns string) {
 }
 
 // GetAppPods awaits till all pods are running in a namespace, and returns a map
-// from "app" label value to the pod names.
+// from "app" label value to the pod names. Terminating pods are ignored.
 func GetAppPods(cl kubernetes.Interface, kubeconfig string, nslist []string) (map[string][]string, error) {
 	pods := make(map[string][]string)
 	var items []v1.Pod
@@ -117,6 +117,9 @@ func GetAppPods(cl kubernetes.Interface, kubeconfig string, nslist []string) (ma
 			ready := true
 
 			for _, pod := range items {
+				if pod.DeletionTimestamp != nil {
+					continue
+				}
 				if pod.Status.Phase != "Running" {
 					log.Infof("Pod %s.%s has status %s", pod.Name, ns, pod.Status.Phase)
 					ready = false
@@ -137,6 +140,9 @@ func GetAppPods(cl kubernetes.Interface, kubeconfig string, nslist []string) (ma
 
 			if ready {
 				for _, pod := range items {
+					if pod.DeletionTimestamp != nil {
+						continue
+					}
 					if app, exists := pod.Labels["app"]; exists {
 						pods[app] = append(pods[app], pod.Name)
 					}
@@ -0,0 +1,37 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"time"
+
+	"istio.io/istio/pkg/log"
+)
+
+// Retry calls f until it succeeds, returns an error it does not retry on, or
+// the attempts are exhausted. The delay between two attempts starts at backoff
+// and doubles after each attempt. The last error is returned.
+func Retry(attempts int, backoff time.Duration, f func() (retry bool, err error)) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		var retry bool
+		if retry, err = f(); err == nil || !retry || attempt >= attempts {
+			return err
+		}
+		log.Infof("Attempt %d of %d failed, retrying in %v: %v", attempt, attempts, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
@@ -15,7 +15,9 @@
 package util
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"strings"
@@ -49,8 +51,13 @@ func RunInput(command, input string) error {
 	c := exec.Command(parts[0], parts[1:]...)
 	c.Stdin = strings.NewReader(input)
 	c.Stdout = os.Stdout
-	c.Stderr = os.Stderr
-	return c.Run()
+	// keep the errors of the command to tell failures apart
+	var stderr bytes.Buffer
+	c.Stderr = io.MultiWriter(os.Stderr, &stderr)
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("command %q failed: %q %v", command, stderr.String(), err)
+	}
+	return nil
 }
 
 // Shell out a command and aggregate output